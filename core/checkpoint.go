@@ -0,0 +1,162 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrSoarCheckpoint 表示 Soar 或 Flap 的状态未能写入 Store, 此时 Soar 会被置为失败
+var ErrSoarCheckpoint = errors.New("failed to checkpoint soar")
+
+// CheckpointOptions 控制引擎将状态变化写入 Store 的频率
+// Soar 自身的状态变化 (启动、暂停、结束等) 总是立即写入; Flap 的每次派发 (包括重试和恢复后重新执行) 前总是先写入执行中的状态,
+// 借助 Revision 保证同一次尝试不会被多个实例执行; 批量只作用于 Flap 执行结束后的状态变化
+type CheckpointOptions struct {
+	// BatchSize 累积多少个状态发生变化的 Flap 后写入 Store, 小于等于 1 表示每次状态变化都立即写入
+	BatchSize int
+	// FlushInterval 大于 0 时, 累积的状态变化最迟在该时间后写入 Store
+	// BatchSize 大于 1 且 FlushInterval 为 0 时, 不足一批的变化在 Soar 状态变化或运行结束时写入
+	FlushInterval time.Duration
+}
+
+// setStatus 更新 Soar 的状态, 并标记需要持久化, 调用方需持有 soar.lock
+func (soar *Soar) setStatus(status SoarStatus) {
+	if soar.status != status {
+		from := soar.status
+		soar.status, soar.soarDirty = status, true
+		soar.recordEvent(Event{Type: EventSoarStatus, From: from.String(), To: status.String(), Err: errString(soar.err)})
+	}
+}
+
+// markDirty 记录 Flap 当前数据的副本, 等待下次 checkpoint 时写入 Store, 调用方需持有 soar.lock
+// 同一个 Flap 在两次写入之间的多次变化只保留最新的副本
+func (soar *Soar) markDirty(flap *Flap) {
+	if soar.dirty == nil {
+		soar.dirty = make(map[ID]*Flap)
+	}
+	if len(soar.dirty) == 0 {
+		soar.dirtySince = time.Now()
+	}
+	soar.dirty[flap.ID] = flap.snapshot()
+}
+
+// shouldFlush 判断是否需要将累积的状态变化写入 Store, 调用方需持有 soar.lock
+func (soar *Soar) shouldFlush(now time.Time) bool {
+	if soar.soarDirty {
+		return true
+	}
+	if len(soar.dirty) == 0 {
+		return false
+	}
+	if len(soar.dirty) >= soar.checkpointOpts.BatchSize {
+		return true
+	}
+	interval := soar.checkpointOpts.FlushInterval
+	return interval > 0 && now.Sub(soar.dirtySince) >= interval
+}
+
+// flushDelay 返回距离累积的状态变化必须写入的时长, 不需要定时写入时返回 false, 调用方需持有 soar.lock
+func (soar *Soar) flushDelay(now time.Time) (time.Duration, bool) {
+	interval := soar.checkpointOpts.FlushInterval
+	if len(soar.dirty) == 0 || interval <= 0 {
+		return 0, false
+	}
+	return soar.dirtySince.Add(interval).Sub(now), true
+}
+
+// checkpoint 将累积的 Flap 状态变化和 Soar 的状态写入 Store, 并将累积的事件追加到 EventLog
+// force 为 true 时忽略批量设置立即写入
+// 副本在 soar.lock 内获取, 写入时不持有 soar.lock; 多次 checkpoint 串行执行, 保证写入顺序与状态变化顺序一致
+// Flap 先于 Soar 写入, Store 中 Soar 的终态不会早于其 Flap 的终态出现
+// 写入冲突时说明 Soar 已被其他写入者修改, Soar 在当前实例上停止运行并丢弃累积的状态变化和事件, 返回 ConflictError
+func (soar *Soar) checkpoint(force bool) error {
+	soar.checkpointLock.Lock()
+	defer soar.checkpointLock.Unlock()
+
+	soar.lock.Lock()
+	if soar.fenced {
+		// 已由其他实例接管, 丢弃累积的状态变化
+		soar.dirty, soar.soarDirty, soar.pendingEvents = nil, false, nil
+		soar.lock.Unlock()
+		return nil
+	}
+	if !force && !soar.shouldFlush(time.Now()) {
+		soar.lock.Unlock()
+		return nil
+	}
+	dirty, saveSoar, events := soar.dirty, soar.soarDirty, soar.pendingEvents
+	soar.dirty, soar.soarDirty, soar.pendingEvents = nil, false, nil
+	soar.lock.Unlock()
+
+	err := soar.saveDirty(dirty, saveSoar)
+	if errors.Is(err, ErrRevisionConflict) {
+		soar.fence(err)
+		return err
+	}
+	if len(events) > 0 {
+		if appendErr := soar.events.Append(events...); appendErr != nil && err == nil {
+			err = fmt.Errorf("%w: append events: %s", ErrSoarCheckpoint, appendErr)
+		}
+	}
+	return err
+}
+
+// saveDirty 将 Flap 的副本和 Soar 写入 Store, 每次写入成功后更新内存中记录的 Revision
+// 调用方需持有 soar.checkpointLock, 不能持有 soar.lock
+func (soar *Soar) saveDirty(dirty map[ID]*Flap, saveSoar bool) error {
+	if soar.store == nil {
+		return nil
+	}
+	flapIDs := make([]ID, 0, len(dirty))
+	for flapID := range dirty {
+		flapIDs = append(flapIDs, flapID)
+	}
+	sort.Strings(flapIDs)
+	for _, flapID := range flapIDs {
+		snap := dirty[flapID]
+		if err := soar.store.SaveFlap(snap); err != nil {
+			return checkpointError("flap", flapID, err)
+		}
+		// 写入期间产生的新副本基于本次写入后的 Revision
+		soar.lock.Lock()
+		if flap := soar.IFlapIndex.GetFlap(flapID); flap != nil {
+			flap.revision = snap.revision + 1
+		}
+		if next := soar.dirty[flapID]; next != nil {
+			next.revision = snap.revision + 1
+		}
+		soar.lock.Unlock()
+	}
+	if saveSoar {
+		if err := soar.store.SaveSoar(soar); err != nil {
+			return checkpointError("soar", soar.id, err)
+		}
+		soar.lock.Lock()
+		soar.revision++
+		soar.lock.Unlock()
+	}
+	return nil
+}
+
+// checkpointError 包装写入 Store 的错误, 写入冲突时原样返回, 以便调用方识别 ConflictError
+func checkpointError(kind string, id ID, err error) error {
+	if errors.Is(err, ErrRevisionConflict) {
+		return err
+	}
+	return fmt.Errorf("%w: save %s %s: %s", ErrSoarCheckpoint, kind, id, err)
+}
+
+// snapshot 复制 Flap 当前的数据, 用于在锁外持久化, 调用方需保证 Flap 没有被并发修改
+func (f *Flap) snapshot() *Flap {
+	cp := *f
+	cp.PrevFlaps = append([]ID(nil), f.PrevFlaps...)
+	cp.NextFlaps = append([]ID(nil), f.NextFlaps...)
+	cp.Output = cloneMap(f.Output)
+	if f.NextAwakeTime != nil {
+		t := *f.NextAwakeTime
+		cp.NextAwakeTime = &t
+	}
+	return &cp
+}
@@ -0,0 +1,92 @@
+package core_test
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// failingStore 第 failAfter 次之后的 SaveFlap 失败
+type failingStore struct {
+	core.Store
+	saves     int64
+	failAfter int64
+}
+
+func (s *failingStore) SaveFlap(flap *core.Flap) error {
+	if atomic.AddInt64(&s.saves, 1) > s.failAfter {
+		return errors.New("disk full")
+	}
+	return s.Store.SaveFlap(flap)
+}
+
+func TestCheckpointBatch(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts core.CheckpointOptions
+		// written a 执行结束后是否在 b 执行期间写入 Store
+		written bool
+	}{
+		{"immediate", core.CheckpointOptions{}, true},
+		{"batch", core.CheckpointOptions{BatchSize: 100}, false},
+		{"interval", core.CheckpointOptions{BatchSize: 100, FlushInterval: 20 * time.Millisecond}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w, s := newWyvern(t)
+			w.SetCheckpointOptions(c.opts)
+			started, release := make(chan string, 1), make(chan struct{})
+			slow := behave(t, gated(started, release))
+			id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: pair
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: none}}
+      - {name: b, plugin: test, pluginConfig: {key: %q}}
+`, slow), "pair")
+			h := mustRun(t, w, id)
+			<-started
+
+			deadline := time.Now().Add(100 * time.Millisecond)
+			for time.Now().Before(deadline) && storedFlap(t, s, id, "a").State != core.FlapStateSuccess {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if written := storedFlap(t, s, id, "a").State == core.FlapStateSuccess; written != c.written {
+				t.Errorf("expect a written while b runs: %v, got %v", c.written, written)
+			}
+
+			// 不足一批的变化在运行结束时写入
+			close(release)
+			if _, err := waitRun(t, h); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			for _, name := range []string{"a", "b"} {
+				if state := storedFlap(t, s, id, name).State; state != core.FlapStateSuccess {
+					t.Errorf("flap %s: expect success in store, got %s", name, state)
+				}
+			}
+			probe := &core.Soar{}
+			if err := s.LoadSoar(probe, id); err != nil || probe.Status() != core.SoarStatusSucceeded {
+				t.Errorf("expect succeeded soar in store, got %s (%v)", probe.Status(), err)
+			}
+		})
+	}
+}
+
+func TestCheckpointFailureFailsSoar(t *testing.T) {
+	_, mem := newWyvern(t)
+	// 加载时写入 3 个 Flap, 之后的写入全部失败
+	w := core.NewWyvern(&failingStore{Store: mem, failAfter: 3})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, "none", "none"), "chain")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarCheckpoint) && !errors.Is(result.Err, core.ErrSoarCheckpoint) {
+		t.Fatalf("expect ErrSoarCheckpoint, got %v (%v)", err, result.Err)
+	}
+	if result.Status != core.SoarStatusFailed {
+		t.Errorf("expect failed soar, got %s", result.Status)
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+// CompensationStatus Flap 补偿动作的执行状态
+type CompensationStatus int
+
+const (
+	// CompensationNone 未执行补偿
+	CompensationNone CompensationStatus = iota
+	// CompensationSucceeded 补偿成功
+	CompensationSucceeded
+	// CompensationFailed 补偿失败, 错误记录在 Flap.CompensationErr 中
+	CompensationFailed
+)
+
+// String 返回补偿状态的名称
+func (s CompensationStatus) String() string {
+	switch s {
+	case CompensationNone:
+		return "none"
+	case CompensationSucceeded:
+		return "succeeded"
+	case CompensationFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("CompensationStatus(%d)", int(s))
+}
+
+// MarshalText 实现 encoding.TextMarshaler, 持久化时以名称表示补偿状态
+func (s CompensationStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText 实现 encoding.TextUnmarshaler, 从名称解析补偿状态
+func (s *CompensationStatus) UnmarshalText(text []byte) error {
+	for v := CompensationStatus(CompensationNone); v <= CompensationFailed; v++ {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compensation status %q", text)
+}
+
+// compensate 在 Soar 失败后, 按逆拓扑序依次执行所有已成功 Flap 的补偿动作
+// 每个 Flap 的补偿动作只执行一次, 失败或超时时记录错误并继续补偿其余 Flap
+// 每个补偿动作结束后立即写入其结果; Soar 已由其他实例接管或 ctx 结束时停止补偿并返回 false,
+// ctx 结束时被中断的补偿动作不记录结果, Soar 保持补偿中, 之后由 Recover 继续补偿
+func (soar *Soar) compensate(ctx context.Context) bool {
+	soar.lock.Lock()
+	order := soar.topoOrder()
+	soar.lock.Unlock()
+
+	for i := len(order) - 1; i >= 0; i-- {
+		flap := order[i]
+		soar.lock.Lock()
+		if flap.State != FlapStateSuccess || flap.compensate == nil || flap.Compensation != CompensationNone {
+			soar.lock.Unlock()
+			continue
+		}
+		ac := flap.actionContext(flap.AttemptRetryCount)
+		config, err := renderTemplate(flap.compensate.PluginConfig, flap.compensateScope(), true)
+		soar.lock.Unlock()
+
+		if err == nil {
+			var action flaps.FlapActionV2
+			if action, err = flaps.MakeFlapAction(flap.compensate.Plugin, config); err == nil {
+				timeout := flap.compensate.Timeout.Std()
+				if timeout == 0 {
+					timeout = flaps.DefaultCompensateTimeout
+				}
+				_, _, err = executeAction(ctx, action, timeout, ac)
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		soar.lock.Lock()
+		flap.Compensation, flap.CompensationErr = CompensationSucceeded, err
+		if err != nil {
+			flap.Compensation = CompensationFailed
+		}
+		soar.markDirty(flap)
+		soar.recordEvent(Event{
+			Type:     EventFlapCompensation,
+			FlapID:   flap.ID,
+			FlapName: flap.ConfName,
+			From:     CompensationNone.String(),
+			To:       flap.Compensation.String(),
+			Attempt:  flap.AttemptRetryCount,
+			Err:      errString(flap.CompensationErr),
+		})
+		soar.lock.Unlock()
+		// 写入失败时运行结束前的 checkpoint 会将 Soar 置为失败, 此处只需在被接管时停止
+		_ = soar.checkpoint(true)
+		if soar.fenceError() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// compensateScope 生成渲染补偿动作配置时使用的数据, 在父节点之外还包含当前 Flap 自身
+func (f *Flap) compensateScope() map[string]any {
+	scope := f.templateScope()
+	scope["flaps"].(map[string]any)[f.ConfName] = map[string]any{
+		"id":     f.ID,
+		"state":  f.State.String(),
+		"output": f.Output,
+	}
+	return scope
+}
+
+// topoOrder 返回所有 Flap 的拓扑序, 同一层级内按 ID 排序以保证顺序稳定, 调用方需持有 soar.lock
+func (soar *Soar) topoOrder() []*Flap {
+	flapIDs := soar.IFlapIndex.ListAllFlapID()
+	sort.Strings(flapIDs)
+
+	indegree := make(map[ID]int, len(flapIDs))
+	var queue []ID
+	for _, flapID := range flapIDs {
+		indegree[flapID] = len(soar.IFlapIndex.GetFlap(flapID).PrevFlaps)
+		if indegree[flapID] == 0 {
+			queue = append(queue, flapID)
+		}
+	}
+
+	order := make([]*Flap, 0, len(flapIDs))
+	for len(queue) > 0 {
+		flap := soar.IFlapIndex.GetFlap(queue[0])
+		queue = queue[1:]
+		order = append(order, flap)
+		for _, childID := range flap.NextFlaps {
+			if indegree[childID]--; indegree[childID] == 0 {
+				queue = append(queue, childID)
+			}
+		}
+	}
+	return order
+}
+
+// compensateContext 生成执行补偿使用的 context, 保留 ctx 中的值但不随本次运行的取消和超时结束,
+// 只在所属的 Wyvern 被 Close 强制结束时取消
+func (soar *Soar) compensateContext(ctx context.Context) context.Context {
+	owner := context.Background()
+	if soar.wyvern != nil {
+		owner = soar.wyvern.ctx
+	}
+	return detachedContext{Context: owner, parent: ctx}
+}
+
+// detachedContext 保留 parent 中的值, 取消信号和截止时间来自内嵌的 owner 而不是 parent
+// 用于 Soar 因超时或取消结束后仍需完成的收尾工作, 例如补偿
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func (c detachedContext) Value(key any) any { return c.parent.Value(key) }
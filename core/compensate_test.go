@@ -0,0 +1,112 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+// compensateYAML 中 a 成功后 b 失败, a 的补偿动作调用 undo 对应的 behaviour
+const compensateYAML = `
+soars:
+  - name: rollback
+    flaps:
+      - name: a
+        plugin: test
+        pluginConfig: {key: ok}
+        compensate: {plugin: test, pluginConfig: {key: %q}}
+      - {name: b, plugin: test, pluginConfig: {key: %q}, prevFlaps: [a]}
+`
+
+func TestCompensateResumesAfterCrash(t *testing.T) {
+	w, s := newWyvern(t)
+	crashed := make(chan struct{})
+	t.Cleanup(func() { close(crashed) })
+	entered := make(chan struct{}, 2)
+	var calls int32
+	undo := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		entered <- struct{}{}
+		// 第一次补偿停在执行中, 模拟实例在补偿中途退出
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-crashed
+		}
+		return &flaps.ActionResult{}, nil
+	})
+	fail := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return nil, errors.New("boom")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(compensateYAML, undo, fail), "rollback")
+	mustRun(t, w, id)
+	<-entered
+
+	soar, _ := w.GetSoar(id)
+	if err := soar.Cancel(); !errors.Is(err, core.ErrSoarCompensating) {
+		t.Errorf("Cancel while compensating: expect ErrSoarCompensating, got %v", err)
+	}
+	if err := soar.Pause(); !errors.Is(err, core.ErrSoarCompensating) {
+		t.Errorf("Pause while compensating: expect ErrSoarCompensating, got %v", err)
+	}
+	probe := &core.Soar{}
+	if err := s.LoadSoar(probe, id); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	if probe.Status() != core.SoarStatusCompensating {
+		t.Fatalf("expect compensating status in store before compensating, got %s", probe.Status())
+	}
+
+	// 另一个实例从 Store 恢复时继续补偿
+	w2 := core.NewWyvern(s)
+	handles, err := w2.Recover(context.Background())
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if len(handles) != 1 {
+		t.Fatalf("expect 1 recovered soar, got %d", len(handles))
+	}
+	result, err := waitRun(t, handles[0])
+	if !errors.Is(err, core.ErrSoarFailed) || result.FailedFlap != "b" {
+		t.Fatalf("expect soar failed at b, got %v (failed flap %q)", err, result.FailedFlap)
+	}
+	if got := result.Flaps["a"].Compensation; got != core.CompensationSucceeded {
+		t.Errorf("expect a compensated, got %s", got)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expect compensation to run again after recover, got %d calls", n)
+	}
+}
+
+func TestCompensateFailedSoar(t *testing.T) {
+	w, s := newWyvern(t)
+	c := &counter{}
+	undo := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		defer c.enter()()
+		return &flaps.ActionResult{}, nil
+	})
+	fail := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return nil, errors.New("boom")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(compensateYAML, undo, fail), "rollback")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarFailed) {
+		t.Fatalf("expect ErrSoarFailed, got %v", err)
+	}
+	if result.Status != core.SoarStatusFailed || result.Flaps["a"].Compensation != core.CompensationSucceeded {
+		t.Errorf("expect failed soar with a compensated, got %s / %s", result.Status, result.Flaps["a"].Compensation)
+	}
+	if calls := c.Calls(); calls != 1 {
+		t.Errorf("expect 1 compensation, got %d", calls)
+	}
+	probe := &core.Soar{}
+	if err = s.LoadSoar(probe, id); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	if probe.Status() != core.SoarStatusFailed {
+		t.Errorf("expect failed status in store, got %s", probe.Status())
+	}
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bagaking/wyvern/core/expr"
+)
+
+var (
+	// ErrInvalidCondition 表示 FlapConfig.Conditions 中的表达式无法编译或引用了不存在的数据
+	ErrInvalidCondition = errors.New("invalid flap condition")
+	// ErrConditionEval 表示启动条件求值失败, 对应的 Flap 会被视为执行失败
+	ErrConditionEval = errors.New("flap condition evaluation failed")
+)
+
+// conditionRoots 启动条件中可以引用的根数据
+//   - flaps: 父节点的数据, 例如 flaps.fetch.state == "success", flaps.fetch.output.code == 200
+//   - inputs: Soar 运行时传入的参数
+//   - flap: 当前 Flap 的数据, 包括 id, name, attempt 和 start (unix 秒)
+var conditionRoots = map[string]bool{"flaps": true, "inputs": true, "flap": true}
+
+// compileConditions 编译 FlapConfig.Conditions 中的所有表达式
+func compileConditions(flapName string, conditions []string) ([]*expr.Program, error) {
+	programs := make([]*expr.Program, 0, len(conditions))
+	for _, src := range conditions {
+		p, err := expr.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: flap %s, %q: %v", ErrInvalidCondition, flapName, src, err)
+		}
+		for _, ref := range p.Refs() {
+			if !conditionRoots[ref[0]] {
+				return nil, fmt.Errorf("%w: flap %s, %q: unknown identifier %q", ErrInvalidCondition, flapName, src, ref[0])
+			}
+		}
+		programs = append(programs, p)
+	}
+	return programs, nil
+}
+
+// checkConditionRefs 检查启动条件中 flaps.<name> 引用的都是当前 Flap 的父节点, 需要在建立 Flap 关系之后调用
+func (f *Flap) checkConditionRefs() error {
+	parents := make(map[string]bool, len(f.PrevFlaps))
+	for _, parentID := range f.PrevFlaps {
+		if parent := f.index.GetFlap(parentID); parent != nil {
+			parents[parent.ConfName] = true
+		}
+	}
+	for _, p := range f.conditions {
+		for _, ref := range p.Refs() {
+			if ref[0] == "flaps" && len(ref) > 1 && !parents[ref[1]] {
+				return fmt.Errorf("%w: flap %s, %q: %q is not a parent flap", ErrInvalidCondition, f.ConfName, p, ref[1])
+			}
+		}
+	}
+	return nil
+}
+
+// evalConditions 依次对所有启动条件求值, 全部为 true 时返回 true
+func (f *Flap) evalConditions() (bool, error) {
+	if len(f.conditions) == 0 {
+		return true, nil
+	}
+	env := f.templateScope()
+	env["flap"] = map[string]any{
+		"id":      f.ID,
+		"name":    f.ConfName,
+		"attempt": f.AttemptRetryCount,
+		"start":   f.Start,
+	}
+	for _, p := range f.conditions {
+		ok, err := p.EvalBool(env)
+		if err != nil {
+			return false, fmt.Errorf("%w: flap %s, %q: %v", ErrConditionEval, f.ConfName, p, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
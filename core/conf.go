@@ -15,8 +15,17 @@ type WyvernConfig struct {
 type SoarConfig struct {
 	// Soar 名称
 	Name string `yaml:"name" json:"name"`
+	// 同时执行的 Flap 数量上限, 小于等于 0 表示不限制, 同时受 Wyvern 全局并行度的约束
+	MaxParallelism int `yaml:"maxParallelism" json:"maxParallelism"`
+	// 一次运行的总超时时间, 超时后取消所有执行中的 Flap 并将 Soar 置为失败, 为 0 表示不限制
+	Timeout flaps.Duration `yaml:"timeout" json:"timeout"`
+	// 运行参数的声明, 运行时通过 Wyvern.RunWithInputs 传入
+	Inputs []InputConfig `yaml:"inputs" json:"inputs,omitempty"`
 	// Flap 配置, 以 Prev/Next 表示 Flap 之间的关系, 平铺在一维数组中配置
 	Flaps []flaps.FlapConfig `yaml:"flaps" json:"flaps"`
+
+	// positions 从 YAML 加载时各字段在文本中的位置, key 为相对 Soar 的字段路径, 例如 flaps[1].nextFlaps[0]
+	positions map[string]position
 }
 
 // GetSoarConfByName - 从配置中获取指定名称的 Soar 配置
@@ -30,12 +39,44 @@ func (conf *WyvernConfig) GetSoarConfByName(name string) (SoarConfig, bool) {
 }
 
 // LoadWyvernConfig - 从文本中加载 Wyvern 配置
+// 文本中的 include 和环境变量保持原样, 需要时使用 LoadWyvernConfigFile 或 LoadWyvernConfigDir
 func LoadWyvernConfig(strConf string) (*WyvernConfig, error) {
-	// 以 yml 格式解析 strConf
+	// 以 yml 格式解析 strConf, 保留节点以便记录字段的行号
+	node := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(strConf), &node); err != nil {
+		return nil, err
+	}
 	conf := WyvernConfig{}
-	err := yaml.Unmarshal([]byte(strConf), &conf)
-	if err != nil {
+	// 空文本解析为空的文档节点
+	if len(node.Content) == 0 {
+		return &conf, nil
+	}
+	if err := decodeWyvernConfig(node.Content[0], nil, &conf); err != nil {
 		return nil, err
 	}
 	return &conf, nil
 }
+
+// LoadWyvernConfigJSON - 从 JSON 文本中加载 Wyvern 配置
+func LoadWyvernConfigJSON(strConf string) (*WyvernConfig, error) {
+	if err := checkJSON([]byte(strConf)); err != nil {
+		return nil, err
+	}
+	// JSON 是 YAML 的子集, 以相同的方式解析以便记录字段的行号
+	return LoadWyvernConfig(strConf)
+}
+
+// decodeWyvernConfig 将根节点解码为 Wyvern 配置, 并记录每个 Soar 中字段的位置
+func decodeWyvernConfig(root *yaml.Node, files map[*yaml.Node]string, conf *WyvernConfig) error {
+	if err := root.Decode(conf); err != nil {
+		return err
+	}
+	if soars := mappingValue(root, "soars"); soars != nil && soars.Kind == yaml.SequenceNode {
+		for i, soarNode := range soars.Content {
+			if i < len(conf.Soars) {
+				conf.Soars[i].positions = collectPositions(soarNode, files)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package core
+
+import "time"
+
+// EventType 事件类型
+type EventType string
+
+const (
+	// EventSoarStatus Soar 的状态发生变化, 包括创建
+	EventSoarStatus EventType = "soar_status"
+	// EventFlapStatus Flap 的状态发生变化, 包括创建和每次重试
+	EventFlapStatus EventType = "flap_status"
+	// EventFlapCompensation Flap 的补偿动作执行结束
+	EventFlapCompensation EventType = "flap_compensation"
+)
+
+// Event 一条状态变化的审计事件, 只追加不修改
+type Event struct {
+	// Seq 由 EventLog 在追加时分配, 同一个 EventLog 内单调递增
+	Seq uint64 `json:"seq"`
+	// Time 状态发生变化的时间
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// Actor 产生事件的 Wyvern 实例 ID
+	Actor  string `json:"actor,omitempty"`
+	SoarID ID     `json:"soarID"`
+	// FlapID 和 FlapName 只在 Flap 事件中有值
+	FlapID   ID     `json:"flapID,omitempty"`
+	FlapName string `json:"flapName,omitempty"`
+	// From 和 To 变化前后的状态名称, 创建时 From 为空; 补偿事件中为补偿状态
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	// Attempt 发生变化时 Flap 的重试次数
+	Attempt int `json:"attempt,omitempty"`
+	// Err 发生变化时的错误, 对 Flap 事件为 Flap 的错误或补偿错误, 对 Soar 事件为 Soar 级别的错误
+	Err string `json:"err,omitempty"`
+	// Output Flap 成功时的输出
+	Output map[string]any `json:"output,omitempty"`
+}
+
+// EventQuery 查询事件的条件, 零值的字段不参与过滤
+type EventQuery struct {
+	SoarID ID
+	FlapID ID
+	Types  []EventType
+	// Since 和 Until 按事件的 Time 过滤, 两端均包含
+	Since time.Time
+	Until time.Time
+	// Limit 大于 0 时最多返回的事件数量
+	Limit int
+}
+
+// Match 判断事件是否满足查询条件, 不考虑 Limit
+func (q EventQuery) Match(e Event) bool {
+	if q.SoarID != "" && e.SoarID != q.SoarID || q.FlapID != "" && e.FlapID != q.FlapID {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) || !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if e.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// EventLog 只追加的审计事件日志
+type EventLog interface {
+	// Append 按顺序追加事件, 并为每个事件分配 Seq
+	Append(events ...Event) error
+	// Query 按 Seq 顺序返回满足条件的事件
+	Query(q EventQuery) ([]Event, error)
+}
+
+// ReplayEvents 按顺序重放 Soar 的事件, 还原 Soar 在 at 时刻的状态, at 为零值时重放所有事件
+// 只有出现在事件中的 Flap 会出现在结果中, 错误以字符串的形式还原
+func ReplayEvents(soarID ID, events []Event, at time.Time) (RunResult, error) {
+	result := RunResult{SoarID: soarID, Flaps: make(map[string]FlapResult)}
+	for _, e := range events {
+		if e.SoarID != soarID || !at.IsZero() && e.Time.After(at) {
+			continue
+		}
+		switch e.Type {
+		case EventSoarStatus:
+			if err := result.Status.UnmarshalText([]byte(e.To)); err != nil {
+				return result, err
+			}
+			result.Err = stringError(e.Err)
+		case EventFlapStatus:
+			flap := result.Flaps[e.FlapName]
+			flap.ID, flap.Name, flap.Attempts = e.FlapID, e.FlapName, e.Attempt
+			if err := flap.State.UnmarshalText([]byte(e.To)); err != nil {
+				return result, err
+			}
+			flap.Err = stringError(e.Err)
+			if flap.State == FlapStateSuccess {
+				flap.Output = e.Output
+			}
+			if flap.State == FlapStateFailed && result.FailedFlap == "" {
+				result.FailedFlap = e.FlapName
+			}
+			result.Flaps[e.FlapName] = flap
+		case EventFlapCompensation:
+			flap := result.Flaps[e.FlapName]
+			if err := flap.Compensation.UnmarshalText([]byte(e.To)); err != nil {
+				return result, err
+			}
+			flap.CompensationErr = stringError(e.Err)
+			result.Flaps[e.FlapName] = flap
+		}
+	}
+	// 与 soar.result 一致, 失败时 Err 为失败 Flap 的错误
+	if result.FailedFlap != "" && result.Status == SoarStatusFailed {
+		result.Err = result.Flaps[result.FailedFlap].Err
+	}
+	return result, nil
+}
+
+// recordEvent 记录一条事件, 等待下次 checkpoint 时追加到 EventLog, 调用方需持有 soar.lock
+func (soar *Soar) recordEvent(e Event) {
+	if soar.events == nil {
+		return
+	}
+	e.Time, e.Actor, e.SoarID = time.Now(), soar.actor, soar.id
+	soar.pendingEvents = append(soar.pendingEvents, e)
+}
+
+// recordFlapEvent 记录 Flap 的状态变化, 调用方需持有 soar.lock
+func (soar *Soar) recordFlapEvent(f *Flap, from string) {
+	e := Event{
+		Type:     EventFlapStatus,
+		FlapID:   f.ID,
+		FlapName: f.ConfName,
+		From:     from,
+		To:       f.State.String(),
+		Attempt:  f.AttemptRetryCount,
+		Err:      errString(f.Err),
+	}
+	if f.State == FlapStateSuccess {
+		e.Output = cloneMap(f.Output)
+	}
+	soar.recordEvent(e)
+}
+
+// recordCreated 记录 Soar 和所有 Flap 的创建事件, 调用方需持有 soar.lock
+func (soar *Soar) recordCreated() {
+	soar.recordEvent(Event{Type: EventSoarStatus, To: soar.status.String(), Err: errString(soar.err)})
+	for _, flap := range soar.topoOrder() {
+		soar.recordFlapEvent(flap, "")
+	}
+}
+
+// onFlapUpdate Flap 状态变化后的回调, 记录副本和事件, 调用方需持有 soar.lock
+func (soar *Soar) onFlapUpdate(f *Flap, from FlapStatus) {
+	soar.markDirty(f)
+	soar.recordFlapEvent(f, from.String())
+}
@@ -0,0 +1,90 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+	"github.com/bagaking/wyvern/store/memory"
+)
+
+func TestEventsAndHistory(t *testing.T) {
+	w, _ := newWyvern(t)
+	w.SetEventLog(memory.NewEventLog())
+	flaky := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		if ac.Attempt == 0 {
+			return nil, errors.New("flaky")
+		}
+		return &flaps.ActionResult{Output: map[string]any{"n": 1}}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: audit
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q}, retry: {maxAttempts: 2, delay: 1ms}}
+      - {name: b, plugin: test, pluginConfig: {key: none}, prevFlaps: [a]}
+`, flaky), "audit")
+	result, err := waitRun(t, mustRun(t, w, id))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	soarEvents, err := w.Events(core.EventQuery{SoarID: id, Types: []core.EventType{core.EventSoarStatus}})
+	if err != nil {
+		t.Fatalf("Events: %v", err)
+	}
+	var statuses []string
+	for _, e := range soarEvents {
+		statuses = append(statuses, e.To)
+		if e.Actor != w.ID() {
+			t.Errorf("expect actor %s, got %s", w.ID(), e.Actor)
+		}
+	}
+	if fmt.Sprint(statuses) != "[pending running succeeded]" {
+		t.Errorf("unexpected soar statuses %v", statuses)
+	}
+
+	flapEvents, err := w.Events(core.EventQuery{FlapID: result.Flaps["a"].ID})
+	if err != nil {
+		t.Fatalf("Events: %v", err)
+	}
+	var transitions []string
+	for i, e := range flapEvents {
+		transitions = append(transitions, e.From+">"+e.To)
+		if i > 0 && e.Seq <= flapEvents[i-1].Seq {
+			t.Errorf("expect increasing seq, got %d after %d", e.Seq, flapEvents[i-1].Seq)
+		}
+	}
+	if fmt.Sprint(transitions) != "[>wait wait>in_progress in_progress>retry retry>in_progress in_progress>success]" {
+		t.Errorf("unexpected transitions of a %v", transitions)
+	}
+
+	history, err := w.History(id, time.Time{})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if history.Status != core.SoarStatusSucceeded || history.Flaps["a"].Attempts != 1 || history.Flaps["a"].Output["n"] != 1 {
+		t.Errorf("unexpected history %+v", history)
+	}
+	// 重放到第一次失败时的状态
+	var failedAt time.Time
+	for _, e := range flapEvents {
+		if e.To == "retry" {
+			failedAt = e.Time
+		}
+	}
+	past, err := w.History(id, failedAt)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if past.Status != core.SoarStatusRunning || past.Flaps["a"].Err == nil || past.Flaps["b"].State == core.FlapStateSuccess {
+		t.Errorf("unexpected history at first failure %+v", past)
+	}
+	if _, err = w.History("nope", time.Time{}); !errors.Is(err, core.ErrSoarNotFound) {
+		t.Errorf("expect ErrSoarNotFound, got %v", err)
+	}
+}
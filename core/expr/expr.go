@@ -0,0 +1,393 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrEval 表示表达式求值失败, 例如类型不匹配或除零
+	ErrEval = errors.New("expression evaluation failed")
+	// ErrNotBool 表示条件表达式的结果不是布尔值
+	ErrNotBool = errors.New("expression result is not a bool")
+)
+
+// Program 编译后的表达式, 可以被并发地多次求值
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile 编译表达式, 语法错误和未知的函数会在编译期返回 *SyntaxError
+func Compile(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// String 返回表达式的源码
+func (p *Program) String() string {
+	return p.src
+}
+
+// Refs 返回表达式中所有以标识符开头的静态访问路径, 例如 flaps.fetch.state 返回 [flaps fetch state]
+// 下标访问会截断路径, 可用于在加载配置时检查引用是否合法
+func (p *Program) Refs() [][]string {
+	var refs [][]string
+	var walk func(n node) []string
+	walk = func(n node) []string {
+		switch v := n.(type) {
+		case *identNode:
+			return []string{v.name}
+		case *memberNode:
+			if path := walk(v.obj); path != nil {
+				return append(path, v.key)
+			}
+		case *indexNode:
+			if path := walk(v.obj); path != nil {
+				refs = append(refs, path)
+			}
+			if path := walk(v.idx); path != nil {
+				refs = append(refs, path)
+			}
+		case *unaryNode:
+			if path := walk(v.x); path != nil {
+				refs = append(refs, path)
+			}
+		case *binaryNode:
+			for _, side := range []node{v.l, v.r} {
+				if path := walk(side); path != nil {
+					refs = append(refs, path)
+				}
+			}
+		case *callNode:
+			for _, arg := range v.args {
+				if path := walk(arg); path != nil {
+					refs = append(refs, path)
+				}
+			}
+		}
+		return nil
+	}
+	if path := walk(p.root); path != nil {
+		refs = append(refs, path)
+	}
+	return refs
+}
+
+// Eval 使用 env 作为根数据对表达式求值
+// 访问不存在的字段返回 null, 数字统一以 float64 参与运算
+func (p *Program) Eval(env map[string]any) (any, error) {
+	return eval(p.root, env)
+}
+
+// EvalBool 对表达式求值并要求结果为布尔值
+func (p *Program) EvalBool(env map[string]any) (bool, error) {
+	v, err := p.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%w: %s got %T", ErrNotBool, p.src, v)
+	}
+	return b, nil
+}
+
+// builtin 内置函数
+type builtin struct {
+	arity int
+	fn    func(args []any) (any, error)
+}
+
+// builtins 表达式中可以调用的内置函数
+var builtins = map[string]builtin{
+	// now 返回当前的 unix 时间, 单位为秒
+	"now": {arity: 0, fn: func(args []any) (any, error) {
+		return float64(time.Now().UnixNano()) / 1e9, nil
+	}},
+	// len 返回字符串、列表或 map 的长度
+	"len": {arity: 1, fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		rv := reflect.ValueOf(args[0])
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return float64(rv.Len()), nil
+		}
+		return nil, fmt.Errorf("%w: len of %T", ErrEval, args[0])
+	}},
+	// contains 判断字符串是否包含子串、列表是否包含元素或 map 是否包含 key
+	"contains": {arity: 2, fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case string:
+			sub, ok := args[1].(string)
+			return ok && strings.Contains(v, sub), nil
+		case map[string]any:
+			key, ok := args[1].(string)
+			_, exist := v[key]
+			return ok && exist, nil
+		case nil:
+			return false, nil
+		}
+		rv := reflect.ValueOf(args[0])
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, fmt.Errorf("%w: contains on %T", ErrEval, args[0])
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if equal(rv.Index(i).Interface(), args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}},
+}
+
+// eval 递归求值语法树
+func eval(n node, env map[string]any) (any, error) {
+	switch v := n.(type) {
+	case *literalNode:
+		return v.val, nil
+	case *identNode:
+		return normalize(env[v.name]), nil
+	case *memberNode:
+		obj, err := eval(v.obj, env)
+		if err != nil {
+			return nil, err
+		}
+		return member(obj, v.key)
+	case *indexNode:
+		obj, err := eval(v.obj, env)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := eval(v.idx, env)
+		if err != nil {
+			return nil, err
+		}
+		return index(obj, idx)
+	case *unaryNode:
+		x, err := eval(v.x, env)
+		if err != nil {
+			return nil, err
+		}
+		switch v.op {
+		case "!":
+			b, ok := x.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%w: operator ! on %T", ErrEval, x)
+			}
+			return !b, nil
+		case "-":
+			f, ok := x.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%w: operator - on %T", ErrEval, x)
+			}
+			return -f, nil
+		}
+	case *binaryNode:
+		return evalBinary(v, env)
+	case *callNode:
+		args := make([]any, 0, len(v.args))
+		for _, arg := range v.args {
+			a, err := eval(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+		}
+		return builtins[v.name].fn(args)
+	}
+	return nil, fmt.Errorf("%w: unknown node %T", ErrEval, n)
+}
+
+// evalBinary 对二元运算求值, && 和 || 短路求值
+func evalBinary(n *binaryNode, env map[string]any) (any, error) {
+	l, err := eval(n.l, env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: operator %s on %T", ErrEval, n.op, l)
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := eval(n.r, env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: operator %s on %T", ErrEval, n.op, r)
+		}
+		return rb, nil
+	}
+
+	r, err := eval(n.r, env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	}
+
+	// 字符串支持拼接和比较
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			switch n.op {
+			case "+":
+				return ls + rs, nil
+			case "<":
+				return ls < rs, nil
+			case "<=":
+				return ls <= rs, nil
+			case ">":
+				return ls > rs, nil
+			case ">=":
+				return ls >= rs, nil
+			}
+		}
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%w: operator %s on %T and %T", ErrEval, n.op, l, r)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("%w: division by zero", ErrEval)
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("%w: division by zero", ErrEval)
+		}
+		return math.Mod(lf, rf), nil
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	}
+	return nil, fmt.Errorf("%w: unknown operator %s", ErrEval, n.op)
+}
+
+// member 读取 map 的字段, obj 为 null 或字段不存在时返回 null
+func member(obj any, key string) (any, error) {
+	switch v := obj.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		return normalize(v[key]), nil
+	}
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+		item := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+		if !item.IsValid() {
+			return nil, nil
+		}
+		return normalize(item.Interface()), nil
+	}
+	return nil, fmt.Errorf("%w: field %q of %T", ErrEval, key, obj)
+}
+
+// index 下标访问, 列表使用数字下标, map 使用字符串下标, 越界时返回 null
+func index(obj, idx any) (any, error) {
+	if key, ok := idx.(string); ok {
+		return member(obj, key)
+	}
+	f, ok := idx.(float64)
+	if !ok || f != math.Trunc(f) {
+		return nil, fmt.Errorf("%w: invalid index %v", ErrEval, idx)
+	}
+	if obj == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%w: index of %T", ErrEval, obj)
+	}
+	i := int(f)
+	if i < 0 || i >= rv.Len() {
+		return nil, nil
+	}
+	return normalize(rv.Index(i).Interface()), nil
+}
+
+// equal 判断两个值是否相等, 数字按数值比较
+func equal(l, r any) bool {
+	l, r = normalize(l), normalize(r)
+	if lf, ok := l.(float64); ok {
+		rf, ok := r.(float64)
+		return ok && lf == rf
+	}
+	return reflect.DeepEqual(l, r)
+}
+
+// normalize 将各种数字类型统一为 float64, 时间统一为 unix 秒
+func normalize(v any) any {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case time.Time:
+		return float64(n.UnixNano()) / 1e9
+	case *time.Time:
+		if n == nil {
+			return nil
+		}
+		return float64(n.UnixNano()) / 1e9
+	}
+	return v
+}
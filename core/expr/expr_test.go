@@ -0,0 +1,185 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	env := map[string]any{
+		"n":    3,
+		"f":    1.5,
+		"s":    "hello",
+		"ok":   true,
+		"list": []any{"a", 2, nil},
+		"m":    map[string]any{"k": "v", "n": int64(7)},
+		"sm":   map[string]string{"x": "y"},
+		"t":    time.Unix(100, 0),
+	}
+	for _, c := range []struct {
+		src  string
+		want any
+	}{
+		{"1", 1.0},
+		{"-1.5", -1.5},
+		{`"a"`, "a"},
+		{`'a\'b'`, "a'b"},
+		{"true", true},
+		{"null", nil},
+		{"nil", nil},
+		{"n", 3.0},
+		{"missing", nil},
+		{"missing.deep.path", nil},
+		{"m.k", "v"},
+		{`m["k"]`, "v"},
+		{"m.n", 7.0},
+		{"sm.x", "y"},
+		{"sm.none", nil},
+		{"list[0]", "a"},
+		{"list[1]", 2.0},
+		{"list[5]", nil},
+		{"list[-1]", nil},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"7 % 4", 3.0},
+		{"10 / 4", 2.5},
+		{"n - f", 1.5},
+		{`s + " world"`, "hello world"},
+		{`"a" < "b"`, true},
+		{"n == 3", true},
+		{"n != 3", false},
+		{"m.n == 7", true},
+		{`s == "hello"`, true},
+		{"list == list", true},
+		{"n >= 3 && n < 4", true},
+		{"!ok || n > 10", false},
+		{"false && missing.x > 1", false},
+		{"true || 1 / 0", true},
+		{"t == 100", true},
+		{"len(s)", 5.0},
+		{"len(list)", 3.0},
+		{"len(m)", 2.0},
+		{"len(missing)", 0.0},
+		{`contains(s, "ell")`, true},
+		{`contains(list, 2)`, true},
+		{`contains(list, "z")`, false},
+		{`contains(m, "k")`, true},
+		{`contains(missing, "k")`, false},
+		{"now() > 0", true},
+	} {
+		p, err := Compile(c.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", c.src, err)
+			continue
+		}
+		got, err := p.Eval(env)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", c.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	env := map[string]any{"s": "x", "n": 1, "list": []any{1}}
+	for _, src := range []string{
+		"1 / 0",
+		"1 % 0",
+		"!n",
+		"-s",
+		"s - 1",
+		"n && true",
+		"true && n",
+		"n.x",
+		`list["x"]`,
+		"list[0.5]",
+		"n[0]",
+		"len(n)",
+		"contains(n, 1)",
+	} {
+		p, err := Compile(src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", src, err)
+			continue
+		}
+		if _, err = p.Eval(env); !errors.Is(err, ErrEval) {
+			t.Errorf("Eval(%q): expect ErrEval, got %v", src, err)
+		}
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	p, err := Compile("n + 1")
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	if _, err = p.EvalBool(map[string]any{"n": 1}); !errors.Is(err, ErrNotBool) {
+		t.Errorf("expect ErrNotBool, got %v", err)
+	}
+	p, err = Compile("n > 0")
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	if ok, err := p.EvalBool(map[string]any{"n": 1}); err != nil || !ok {
+		t.Errorf("expect true, got %v (%v)", ok, err)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		pos int
+	}{
+		{"", 0},
+		{"1 +", 3},
+		{"(1 + 2", 6},
+		{"a.", 2},
+		{"a[1", 3},
+		{"1 2", 2},
+		{`"open`, 0},
+		{"a @ b", 2},
+		{"unknown(1)", 0},
+		{"len()", 0},
+		{"len(1, 2)", 0},
+		{"contains(1,", 11},
+	} {
+		_, err := Compile(c.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Compile(%q): expect *SyntaxError, got %v", c.src, err)
+			continue
+		}
+		if syntaxErr.Pos != c.pos {
+			t.Errorf("Compile(%q): expect error at %d, got %d (%v)", c.src, c.pos, syntaxErr.Pos, err)
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want [][]string
+	}{
+		{"1", nil},
+		{"flaps.fetch.state", [][]string{{"flaps", "fetch", "state"}}},
+		{`flaps.a.output.n > 1 && inputs.env == "prod"`, [][]string{{"flaps", "a", "output", "n"}, {"inputs", "env"}}},
+		{`flaps["a"].state`, [][]string{{"flaps"}}},
+		{"list[i]", [][]string{{"list"}, {"i"}}},
+		{"!ok", [][]string{{"ok"}}},
+		{"len(flaps.a.output)", [][]string{{"flaps", "a", "output"}}},
+	} {
+		p, err := Compile(c.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", c.src, err)
+			continue
+		}
+		if got := p.Refs(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Refs(%q) = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
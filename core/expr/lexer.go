@@ -0,0 +1,112 @@
+// Package expr 实现 Flap 启动条件使用的表达式语言
+// 表达式只能读取求值时传入的数据和内置函数, 没有副作用, 可以安全地执行来自配置文件的表达式
+//
+// 支持的语法:
+//   - 字面量: 数字 1 / 1.5, 字符串 "a" / 'a', true, false, null
+//   - 访问: a.b.c, a["b"], list[0]
+//   - 运算: + - * / %, == != < <= > >=, && || !, 以及括号
+//   - 函数调用: now(), len(x), contains(x, y) 等内置函数
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenKind 词法单元类型
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+// token 词法单元, pos 为其在源码中的字节偏移
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators 所有运算符, 较长的运算符需排在前面以便优先匹配
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ",",
+}
+
+// lex 将表达式切分为词法单元
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], pos: start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			str, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: str, pos: i})
+			i += n
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// lexString 读取一个以引号开头的字符串字面量, 返回其内容和在源码中占用的字节数
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	builder := strings.Builder{}
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case quote:
+			return builder.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			i++
+			switch src[i] {
+			case 'n':
+				builder.WriteByte('\n')
+			case 't':
+				builder.WriteByte('\t')
+			default:
+				builder.WriteByte(src[i])
+			}
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,238 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SyntaxError 表达式的语法错误, Pos 为出错位置在源码中的字节偏移
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.Pos, e.Msg)
+}
+
+// node 语法树节点
+type node interface{}
+
+type (
+	// literalNode 字面量
+	literalNode struct{ val any }
+	// identNode 标识符, 从求值数据的根节点中读取
+	identNode struct{ name string }
+	// memberNode 成员访问 obj.key
+	memberNode struct {
+		obj node
+		key string
+	}
+	// indexNode 下标访问 obj[idx]
+	indexNode struct{ obj, idx node }
+	// unaryNode 一元运算
+	unaryNode struct {
+		op string
+		x  node
+	}
+	// binaryNode 二元运算
+	binaryNode struct {
+		op   string
+		l, r node
+	}
+	// callNode 内置函数调用
+	callNode struct {
+		name string
+		args []node
+	}
+)
+
+// precedence 二元运算符的优先级, 数值越大越优先结合
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// parser 以优先级爬升的方式将词法单元解析为语法树
+type parser struct {
+	tokens []token
+	cur    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.cur] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.cur]
+	if t.kind != tokenEOF {
+		p.cur++
+	}
+	return t
+}
+
+// expect 读取一个指定的运算符, 不匹配时返回语法错误
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != op {
+		return &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected %q", op)}
+	}
+	return nil
+}
+
+// parse 解析完整的表达式
+func (p *parser) parse() (node, error) {
+	n, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return n, nil
+}
+
+// parseBinary 解析优先级不低于 minPrec 的二元运算
+func (p *parser) parseBinary(minPrec int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := precedence[t.text]
+		if t.kind != tokenOperator || !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text, l: left, r: right}
+	}
+}
+
+// parseUnary 解析一元运算
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokenOperator && (t.text == "!" || t.text == "-") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: t.text, x: x}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix 解析基础表达式及其后的成员访问和下标访问
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator {
+			return n, nil
+		}
+		switch t.text {
+		case ".":
+			p.next()
+			key := p.next()
+			if key.kind != tokenIdent {
+				return nil, &SyntaxError{Pos: key.pos, Msg: "expected field name after '.'"}
+			}
+			n = &memberNode{obj: n, key: key.text}
+		case "[":
+			p.next()
+			idx, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{obj: n, idx: idx}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// parsePrimary 解析字面量、标识符、函数调用和括号表达式
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &literalNode{val: f}, nil
+	case tokenString:
+		return &literalNode{val: t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{val: true}, nil
+		case "false":
+			return &literalNode{val: false}, nil
+		case "null", "nil":
+			return &literalNode{val: nil}, nil
+		}
+		if next := p.peek(); next.kind == tokenOperator && next.text == "(" {
+			return p.parseCall(t)
+		}
+		return &identNode{name: t.text}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			n, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	case tokenEOF:
+		return nil, &SyntaxError{Pos: t.pos, Msg: "unexpected end of expression"}
+	}
+	return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+}
+
+// parseCall 解析内置函数调用, 函数名和参数数量在编译期检查
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := builtins[name.text]
+	if !ok {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", name.text)}
+	}
+	p.next() // (
+	call := &callNode{name: name.text}
+	if t := p.peek(); t.kind == tokenOperator && t.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if t := p.peek(); t.kind == tokenOperator && t.text == "," {
+				p.next()
+				continue
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if len(call.args) != fn.arity {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("function %q expects %d arguments, got %d", name.text, fn.arity, len(call.args))}
+	}
+	return call, nil
+}
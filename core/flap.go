@@ -3,8 +3,11 @@ package core
 import (
 	"context"
 	"errors"
-	"github.com/bagaking/wyvern/core/flaps"
+	"fmt"
 	"time"
+
+	"github.com/bagaking/wyvern/core/expr"
+	"github.com/bagaking/wyvern/core/flaps"
 )
 
 var (
@@ -21,6 +24,11 @@ var (
 
 	//	ErrFlapWaitForAware 表示 Flap 还未到达下次执行时间, Tick 方法不会执行
 	ErrFlapWaitForAware = errors.New("flap wait for next aware time")
+
+	// ErrFlapActionPanic 表示 Flap 的动作在执行过程中发生了 panic, 该 Flap 会被视为执行失败
+	ErrFlapActionPanic = errors.New("flap action panic")
+	// ErrFlapTimeout 表示 Flap 的单次执行超过了配置的 timeout
+	ErrFlapTimeout = errors.New("flap attempt timed out")
 )
 
 // FlapStatus 状态
@@ -35,20 +43,74 @@ const (
 	FlapStateFailed
 )
 
+// String 返回状态的名称
+func (s FlapStatus) String() string {
+	switch s {
+	case FlapStateWait:
+		return "wait"
+	case FlapStateStated:
+		return "started"
+	case FlapStateInProgress:
+		return "in_progress"
+	case FlapStatusErrorAndRetry:
+		return "retry"
+	case FlapStateSuccess:
+		return "success"
+	case FlapStateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("FlapStatus(%d)", int(s))
+}
+
+// MarshalText 实现 encoding.TextMarshaler, 持久化时以名称表示状态
+func (s FlapStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText 实现 encoding.TextUnmarshaler, 从名称解析状态
+func (s *FlapStatus) UnmarshalText(text []byte) error {
+	for v := FlapStatus(FlapStateWait); v <= FlapStateFailed; v++ {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown flap status %q", text)
+}
+
 // Flap 原子能力载体
 type Flap struct {
 	index IFlapIndex // index flap 在 wyvern 中的索引
 
 	ConfName string // Flap 配置名
 	ID       string // Flap 名称
+	SoarID   string // 所属 Soar 的 ID
+	revision uint64 // 最近一次写入 Store 后记录的 Revision
+
+	PrevFlaps         []ID               // 父节点
+	NextFlaps         []ID               // 子节点
+	State             FlapStatus         // Flap 状态，0 表示未完成，1 表示已完成
+	Start             time.Time          // Flap 开始时间，延迟任务从这个时间开始
+	NextAwakeTime     *time.Time         // Flap 重试时间
+	AttemptRetryCount int                // 记录 Retry 次数
+	Output            map[string]any     // Flap 最近一次成功执行的输出
+	Err               error              // Flap 最近一次执行失败的错误
+	Plugin            string             // Flap 插件名
+	PluginConfig      any                // Flap 插件的原始配置, 可以包含引用父节点输出的模板表达式
+	Action            flaps.FlapActionV2 // Flap 执行动作函数, 插件配置中还有未渲染的模板表达式时为 nil, 每次执行时以渲染后的配置重新实例化
+	Compensation      CompensationStatus // Flap 补偿动作的执行状态
+	CompensationErr   error              // Flap 补偿动作失败的错误
+
+	conditions []*expr.Program    // 编译后的启动条件
+	retry      *flaps.RetryPolicy // 重试策略
+	timeout    time.Duration      // 单次执行的超时时间, 为 0 表示不限制
+	inputs     map[string]any     // Soar 运行时传入的参数, 供启动条件和插件配置引用
+
+	compensate *flaps.CompensateConfig // 补偿动作的配置, 未配置时为 nil
+	next       flaps.FlapActionV2      // 下一次执行使用的动作, 检查启动条件时实例化, 派发时取出
+	inflight   <-chan struct{}         // Tick 中被放弃且尚未返回的执行, 返回后关闭
 
-	PrevFlaps         []ID             // 父节点
-	NextFlaps         []ID             // 子节点
-	State             FlapStatus       // Flap 状态，0 表示未完成，1 表示已完成
-	Start             time.Time        // Flap 开始时间，延迟任务从这个时间开始
-	NextAwakeTime     *time.Time       // Flap 重试时间
-	AttemptRetryCount int              // 记录 Retry 次数
-	Action            flaps.FlapAction // Flap 执行动作函数
+	onUpdate func(f *Flap, from FlapStatus) // 状态变化后的回调, 由所属 Soar 注入并在持有 soar.lock 时调用
 }
 
 // IsCompleted 判断 Flap 是否已经完成, 无论成功或失败都算完成
@@ -56,38 +118,151 @@ func (f *Flap) IsCompleted() bool {
 	return f.State == FlapStateSuccess || f.State == FlapStateFailed
 }
 
-// IsReady 判断 Flap 是否满足启动条件
-func (f *Flap) IsReady() bool {
+// IsReady 判断 Flap 是否满足启动条件, ctx 传递给插件的 Condition
+func (f *Flap) IsReady(ctx context.Context) bool {
 	if !f.CheckAllParentsSuccess() {
 		return false
 	}
 
 	// 判断自身的启动条件
-	if !f.Action.Condition() {
-		return false
+	ok, err := f.conditionMet(ctx)
+	return ok && err == nil
+}
+
+// conditionMet 判断 Flap 自身的启动条件是否满足, 不检查前驱节点
+// 先对配置中的 Conditions 求值, 全部满足后再检查下一次执行所用动作的 Condition
+func (f *Flap) conditionMet(ctx context.Context) (bool, error) {
+	if ok, err := f.evalConditions(); !ok || err != nil {
+		return false, err
 	}
+	action, err := f.nextAction()
+	if err != nil {
+		return false, err
+	}
+	return action.Condition(ctx, f.actionContext(f.AttemptRetryCount)), nil
+}
 
-	return true
+// nextAction 返回下一次执行使用的动作, 尚未准备时以渲染后的配置实例化, 调用方需保证对 Flap 的独占访问
+// 配置引用了父节点的输出时, 父节点全部成功后才能渲染; 启动条件不满足时动作保留到下一次检查, 不会重复实例化
+func (f *Flap) nextAction() (flaps.FlapActionV2, error) {
+	if f.next != nil {
+		return f.next, nil
+	}
+	config, err := f.renderConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = f.PluginConfig
+	}
+	if f.next, err = flaps.MakeFlapAction(f.Plugin, config); err != nil {
+		return nil, err
+	}
+	return f.next, nil
+}
+
+// takeAction 取出下一次执行使用的动作, 之后的执行会重新实例化, 调用方需保证对 Flap 的独占访问
+func (f *Flap) takeAction() (flaps.FlapActionV2, error) {
+	action, err := f.nextAction()
+	f.next = nil
+	return action, err
+}
+
+// actionContext 生成执行动作时使用的 ActionContext, 父节点的输出以其配置名为 key
+func (f *Flap) actionContext(attempt int) *flaps.ActionContext {
+	ac := &flaps.ActionContext{
+		SoarID:   f.SoarID,
+		FlapID:   f.ID,
+		FlapName: f.ConfName,
+		Attempt:  attempt,
+	}
+	if len(f.PrevFlaps) > 0 && f.index != nil {
+		ac.ParentOutputs = make(map[string]map[string]any, len(f.PrevFlaps))
+		for _, parentID := range f.PrevFlaps {
+			if parent := f.index.GetFlap(parentID); parent != nil {
+				ac.ParentOutputs[parent.ConfName] = parent.Output
+			}
+		}
+	}
+	return ac
 }
 
 // NewFlap 从插件名和 FlapConfig 创建 Flap
 func NewFlap(config flaps.FlapConfig, store Store) (*Flap, error) {
-	// 通过配置名实例化 FlapAction
-	action, err := flaps.MakeFlapAction(config.Plugin, config.PluginConfig)
+	// 编译启动条件, 表达式错误在加载时返回
+	conditions, err := compileConditions(config.Name, config.Conditions)
 	if err != nil {
 		return nil, err
 	}
+	if config.Retry != nil {
+		if err = config.Retry.Validate(); err != nil {
+			return nil, fmt.Errorf("flap %s: %w", config.Name, err)
+		}
+	}
 
 	// 创建 Flap
-	return &Flap{
+	flap := &Flap{
 		ConfName:          config.Name,
 		ID:                store.MakeFlapID(),
 		State:             FlapStateWait,
 		Start:             time.Now(),
 		NextAwakeTime:     nil,
 		AttemptRetryCount: 0,
-		Action:            action,
-	}, nil
+		Plugin:            config.Plugin,
+		PluginConfig:      config.PluginConfig,
+		conditions:        conditions,
+		retry:             config.Retry,
+		timeout:           config.Timeout.Std(),
+		compensate:        config.Compensate,
+	}
+	if flap.Action, err = flap.makeActions(nil); err != nil {
+		return nil, err
+	}
+	return flap, nil
+}
+
+// makeActions 通过插件名和插件的原始配置实例化 Action 并检查补偿动作的配置, 返回的 Action 由调用方设置, 创建、恢复 Flap 和绑定运行参数时使用
+// inputs 不为 nil 时, 先使用运行参数渲染配置中的 ${{ inputs.<name> }}, 引用父节点输出的表达式在执行时渲染
+// 渲染后仍包含模板表达式的配置无法由插件检查, 此时只检查插件已注册并返回 nil, 执行前以渲染后的配置实例化
+func (f *Flap) makeActions(inputs map[string]any) (flaps.FlapActionV2, error) {
+	config, err := renderInputs(f.PluginConfig, inputs)
+	if err != nil {
+		return nil, err
+	}
+	// 通过配置名实例化 FlapAction
+	action, err := makeRenderedAction(f.Plugin, config)
+	if err != nil {
+		return nil, err
+	}
+	// 检查补偿动作能否实例化, 补偿时以渲染后的配置重新实例化
+	if f.compensate != nil {
+		if config, err = renderInputs(f.compensate.PluginConfig, inputs); err != nil {
+			return nil, fmt.Errorf("flap %s compensate: %w", f.ConfName, err)
+		}
+		if _, err = makeRenderedAction(f.compensate.Plugin, config); err != nil {
+			return nil, fmt.Errorf("flap %s compensate: %w", f.ConfName, err)
+		}
+	}
+	return action, nil
+}
+
+// makeRenderedAction 配置中没有模板表达式时实例化动作, 否则只检查插件已注册并返回 nil
+func makeRenderedAction(plugin string, config any) (flaps.FlapActionV2, error) {
+	if !hasTemplate(config) {
+		return flaps.MakeFlapAction(plugin, config)
+	}
+	if flaps.GetFlapActionMaker(plugin) == nil {
+		return nil, flaps.ErrPluginNotFound
+	}
+	return nil, nil
+}
+
+// renderInputs 使用运行参数渲染配置, 运行参数为 nil 或配置中没有模板表达式时返回原配置
+func renderInputs(config any, inputs map[string]any) (any, error) {
+	if inputs == nil || !hasTemplate(config) {
+		return config, nil
+	}
+	return renderTemplate(config, map[string]any{"inputs": inputs}, false)
 }
 
 // HasPrevOfID 判断当前节点是否有指定父节点
@@ -156,6 +331,7 @@ func (f *Flap) CheckAllParentsSuccess() bool {
 
 // UpdateStatus 更新当前节点的执行状态
 func (f *Flap) UpdateStatus(status FlapStatus, nextAwakeTime *time.Time) FlapStatus {
+	from := f.State
 	// 更新当前节点的执行状态
 	switch f.State = status; status {
 	case FlapStateStated:
@@ -166,18 +342,55 @@ func (f *Flap) UpdateStatus(status FlapStatus, nextAwakeTime *time.Time) FlapSta
 	case FlapStateInProgress:
 		f.NextAwakeTime = nextAwakeTime
 	}
+	if f.onUpdate != nil {
+		f.onUpdate(f, from)
+	}
 	return f.State
 }
 
 // Tick 周期性执行 Flap, 该方法会被 Soar 方法调用
+// Tick 会在当前协程中同步完成检查、执行和状态更新, 调用方需保证对 Flap 的独占访问
 func (f *Flap) Tick(ctx context.Context) error {
-	// 如果当前节点正在 wait 状态,且所有前驱节点均已完成执行,则将当前节点状态更新为 in progress
-	if f.State == FlapStateWait {
-		// 检查父节点是否全部完成
-		if !f.CheckAllParentsSuccess() {
-			// 父节点未全部完成, 直接返回. Flap 方法会收到 ErrFlapParentsAreNotAllFinished 错误, 并不做处理,继续执行下一个 Flap
-			return ErrFlapParentsAreNotAllFinished
+	if err := f.prepare(ctx); err != nil {
+		return err
+	}
+	// 取出检查启动条件时实例化的动作并执行
+	action, err := f.takeAction()
+	var result *flaps.ActionResult
+	if err == nil {
+		result, f.inflight, err = f.execute(ctx, f.actionContext(f.AttemptRetryCount), action)
+	}
+	if f.settle(result, err) == FlapStateFailed {
+		return ErrFlapAlreadyFailed
+	}
+	return nil
+}
+
+// prepare 检查 Flap 是否可以执行, 并完成执行前的状态迁移
+// 返回 nil 表示 Flap 可以立即执行动作, 调用方需保证对 Flap 的独占访问
+func (f *Flap) prepare(ctx context.Context) error {
+	// 上一次被放弃的执行返回前不能再次执行
+	if f.inflight != nil {
+		select {
+		case <-f.inflight:
+			f.inflight = nil
+		default:
+			return ErrFlapIsNotReady
 		}
+	}
+	// 如果当前节点正在 wait 状态, 需要先检查父节点是否全部完成
+	if f.State == FlapStateWait && !f.CheckAllParentsSuccess() {
+		// 父节点未全部完成, 直接返回. Flap 方法会收到 ErrFlapParentsAreNotAllFinished 错误, 并不做处理,继续执行下一个 Flap
+		return ErrFlapParentsAreNotAllFinished
+	}
+	return f.arm(ctx)
+}
+
+// arm 在所有前驱节点均已成功的前提下, 完成执行前的状态迁移并检查自身启动条件和唤醒时间
+// 调度器通过前驱计数保证前驱节点已全部成功, 因此直接调用 arm 而不再逐个查找父节点
+func (f *Flap) arm(ctx context.Context) error {
+	// 如果当前节点正在 wait 状态, 则将当前节点状态更新为 in progress
+	if f.State == FlapStateWait {
 		// 蓄势: parent 全部完成开始记录 State 时间, 该时间可以用于 condition 判断
 		tNow := time.Now()
 		f.UpdateStatus(FlapStateInProgress, &tNow)
@@ -189,7 +402,11 @@ func (f *Flap) Tick(ctx context.Context) error {
 		return ErrFlapAlreadyFailed
 	}
 
-	if !f.IsReady() {
+	if ok, err := f.conditionMet(ctx); err != nil {
+		// 启动条件求值出错, 视为执行失败
+		f.settle(nil, err)
+		return ErrFlapAlreadyFailed
+	} else if !ok {
 		return ErrFlapIsNotReady
 	}
 
@@ -198,21 +415,138 @@ func (f *Flap) Tick(ctx context.Context) error {
 		f.UpdateStatus(FlapStateInProgress, &tNow)
 	}
 
-	if time.Now().Before(*f.NextAwakeTime) {
+	if f.NextAwakeTime != nil && time.Now().Before(*f.NextAwakeTime) {
 		return ErrFlapWaitForAware
 	}
+	return nil
+}
 
-	// 执行动作
-	nextTime, err := f.Action.Execute(f.AttemptRetryCount)
+// renderConfig 使用父节点的输出和运行参数渲染插件配置中的模板表达式, 配置中没有模板表达式时返回 nil
+// 模板表达式形如 ${{ flaps.<父节点配置名>.output.<key> }} 或 ${{ inputs.<name> }}, 引用的值不存在时返回 ErrTemplateRefNotFound
+func (f *Flap) renderConfig() (any, error) {
+	if !hasTemplate(f.PluginConfig) {
+		return nil, nil
+	}
+	return renderTemplate(f.PluginConfig, f.templateScope(), true)
+}
+
+// templateScope 生成渲染模板时使用的数据, 只包含父节点的状态和输出以及运行参数
+func (f *Flap) templateScope() map[string]any {
+	parents := make(map[string]any, len(f.PrevFlaps))
+	for _, parentID := range f.PrevFlaps {
+		if parent := f.index.GetFlap(parentID); parent != nil {
+			parents[parent.ConfName] = map[string]any{
+				"id":     parent.ID,
+				"state":  parent.State.String(),
+				"output": parent.Output,
+			}
+		}
+	}
+	return map[string]any{"flaps": parents, "inputs": f.inputs}
+}
+
+// execute 执行由 takeAction 取出的动作, 被放弃的执行见 executeAction
+// 每次执行使用新的动作实例, 不与之前的执行共享状态; 不修改 Flap 的状态, 可以在不持有 Soar 锁的情况下并发调用
+func (f *Flap) execute(ctx context.Context, ac *flaps.ActionContext, action flaps.FlapActionV2) (*flaps.ActionResult, <-chan struct{}, error) {
+	return executeAction(ctx, action, f.timeout, ac)
+}
+
+// executeAction 在新的协程中执行动作, ctx 结束或单次执行超时时动作通过 context 收到取消信号
+// 动作成功时保留其结果; 失败时 ctx 结束返回 ctx 的错误, 超时返回包装了 ErrFlapTimeout 的错误,
+// 其错误类别为 flaps.ErrorClassTimeout, 会交由重试策略处理
+// ctx 结束或超时后 ActionAbandonGrace 内仍未返回的动作 (例如适配的 v1 动作) 被放弃, 其之后返回的结果被丢弃;
+// 此时返回的 abandoned 在动作最终返回后关闭, 调用方在此之前不能再次执行同一个 Flap, 动作按时返回时 abandoned 为 nil
+func executeAction(ctx context.Context, action flaps.FlapActionV2, timeout time.Duration, ac *flaps.ActionContext) (result *flaps.ActionResult, abandoned <-chan struct{}, err error) {
+	attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	type outcome struct {
+		result *flaps.ActionResult
+		err    error
+	}
+	done, exited := make(chan outcome, 1), make(chan struct{})
+	go func() {
+		defer close(exited)
+		result, err := invokeAction(attemptCtx, action, ac)
+		done <- outcome{result, err}
+	}()
+
+	var o outcome
+	select {
+	case o = <-done:
+	case <-attemptCtx.Done():
+		// 给响应取消信号的动作留出返回的时间
+		grace := time.NewTimer(ActionAbandonGrace)
+		select {
+		case o = <-done:
+		case <-grace.C:
+			abandoned, o.err = exited, attemptCtx.Err()
+		}
+		grace.Stop()
+	}
+	switch {
+	case o.err == nil:
+		return o.result, nil, nil
+	case ctx.Err() != nil:
+		return nil, abandoned, ctx.Err()
+	case attemptCtx.Err() == context.DeadlineExceeded:
+		return nil, abandoned, timeoutError(timeout)
+	}
+	return o.result, abandoned, o.err
+}
+
+// timeoutError 生成单次执行超时的错误
+func timeoutError(timeout time.Duration) error {
+	return flaps.WithErrorClass(fmt.Errorf("%w: %s", ErrFlapTimeout, timeout), flaps.ErrorClassTimeout)
+}
+
+// invokeAction 调用动作, 动作中发生的 panic 会被转换为 ErrFlapActionPanic 错误
+func invokeAction(ctx context.Context, action flaps.FlapActionV2, ac *flaps.ActionContext) (result *flaps.ActionResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("%w: %v", ErrFlapActionPanic, r)
+		}
+	}()
+	return action.Execute(ctx, ac)
+}
+
+// nextRetryTime 根据重试策略计算下次重试的时间, 返回 nil 表示不再重试
+// 插件返回的重试时间优先于策略计算的等待时间, 但仍受 MaxAttempts 的限制
+func (f *Flap) nextRetryTime(pluginRetryAt *time.Time, err error) *time.Time {
+	if f.retry == nil {
+		return pluginRetryAt
+	}
+	if f.retry.Exhausted(f.AttemptRetryCount + 1) {
+		return nil
+	}
+	if pluginRetryAt != nil {
+		return pluginRetryAt
+	}
+	if !f.retry.ShouldRetry(err) {
+		return nil
+	}
+	retryAt := time.Now().Add(f.retry.NextDelay(f.AttemptRetryCount + 1))
+	return &retryAt
+}
+
+// settle 根据动作的执行结果更新 Flap 的状态, 并返回更新后的状态, 调用方需保证对 Flap 的独占访问
+func (f *Flap) settle(result *flaps.ActionResult, err error) FlapStatus {
+	if result == nil {
+		result = &flaps.ActionResult{}
+	}
+	f.Err = err
 	if err != nil {
 		// 出错并稍后重试
-		if nextTime != nil {
-			f.UpdateStatus(FlapStatusErrorAndRetry, nextTime)
+		if retryAt := f.nextRetryTime(result.RetryAt, err); retryAt != nil {
+			return f.UpdateStatus(FlapStatusErrorAndRetry, retryAt)
 		}
 		// 出错并退出
-		f.UpdateStatus(FlapStateFailed, nextTime)
+		return f.UpdateStatus(FlapStateFailed, nil)
 	}
 	// 成功
-	f.UpdateStatus(FlapStateSuccess, nextTime)
-	return nil
+	f.Output = result.Output
+	return f.UpdateStatus(FlapStateSuccess, nil)
 }
@@ -0,0 +1,189 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+func TestFlapTimeoutRetryDoesNotOverlap(t *testing.T) {
+	w, _ := newWyvern(t)
+	c := &counter{}
+	// 忽略 ctx 的动作在超时后仍会继续执行, 重试必须等待其返回
+	key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		defer c.enter()()
+		time.Sleep(60 * time.Millisecond)
+		return nil, errors.New("slow failure")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: slow
+    flaps:
+      - name: a
+        plugin: test
+        pluginConfig: {key: %q}
+        timeout: 10ms
+        retry: {maxAttempts: 3, delay: 1ms}
+`, key), "slow")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarFailed) {
+		t.Fatalf("expect ErrSoarFailed, got %v", err)
+	}
+	if !errors.Is(result.Err, core.ErrFlapTimeout) {
+		t.Errorf("expect ErrFlapTimeout, got %v", result.Err)
+	}
+	if calls := c.Calls(); calls != 3 {
+		t.Errorf("expect 3 attempts, got %d", calls)
+	}
+	if peak := c.Peak(); peak != 1 {
+		t.Errorf("expect attempts to run one at a time, got %d at once", peak)
+	}
+}
+
+func TestSoarTimeoutWaitsForRunningAction(t *testing.T) {
+	w, _ := newWyvern(t)
+	var returned int32
+	key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		time.Sleep(80 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		return nil, errors.New("too late")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: timeout
+    timeout: 10ms
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q}}
+`, key), "timeout")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarFailed) || !errors.Is(result.Err, core.ErrSoarTimeout) {
+		t.Fatalf("expect soar timeout, got %v", err)
+	}
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Error("run completed before the running action returned")
+	}
+}
+
+// hangAction 只实现 FlapAction 的旧插件, 无法感知取消, 在 release 关闭前一直阻塞
+type hangAction struct {
+	calls   *int32
+	release <-chan struct{}
+}
+
+func (a *hangAction) Execute(retryAttempt int) (*time.Time, error) {
+	atomic.AddInt32(a.calls, 1)
+	<-a.release
+	return nil, nil
+}
+
+func (a *hangAction) FromConfig(config any) error { return nil }
+func (a *hangAction) Condition() bool             { return true }
+func (a *hangAction) Plugin() string              { return "test-hang" }
+func (a *hangAction) PluginConfig() any           { return nil }
+
+func TestHungV1ActionTimesOut(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	flaps.RegisterFlapActionMaker("test-hang", func(config any) (flaps.FlapAction, error) {
+		return &hangAction{calls: &calls, release: release}, nil
+	})
+	w, s := newWyvern(t)
+	id := mustLoad(t, w, `
+soars:
+  - name: hang
+    flaps:
+      - {name: a, plugin: test-hang, timeout: 20ms, retry: {maxAttempts: 2, delay: 1ms}}
+`, "hang")
+	h := mustRun(t, w, id)
+
+	// 超时后 Flap 进入重试, 但在阻塞的执行返回前不会开始下一次执行
+	eventually(t, "a to time out", func() bool {
+		return storedFlap(t, s, id, "a").State == core.FlapStatusErrorAndRetry
+	})
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expect attempts not to overlap, got %d calls", n)
+	}
+	if err := w.Cancel(id); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	// 被放弃的执行不阻塞本次运行结束
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarCancelled) {
+		t.Fatalf("expect ErrSoarCancelled, got %v", err)
+	}
+	if !errors.Is(result.Flaps["a"].Err, core.ErrFlapTimeout) {
+		t.Errorf("expect ErrFlapTimeout, got %v", result.Flaps["a"].Err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		retry     string
+		class     string
+		wantCalls int64
+		wantErr   error
+	}{
+		{"exhausted", "{maxAttempts: 3, delay: 1ms}", flaps.ErrorClassError, 3, core.ErrSoarFailed},
+		{"permanent", "{maxAttempts: 3, delay: 1ms}", flaps.ErrorClassPermanent, 1, core.ErrSoarFailed},
+		{"retryOn match", "{maxAttempts: 3, delay: 1ms, retryOn: [transient]}", flaps.ErrorClassTransient, 3, core.ErrSoarFailed},
+		{"retryOn miss", "{maxAttempts: 3, delay: 1ms, retryOn: [transient]}", flaps.ErrorClassError, 1, core.ErrSoarFailed},
+		{"recovers", "{maxAttempts: 5, delay: 1ms}", "", 3, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w, _ := newWyvern(t)
+			cnt := &counter{}
+			key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+				cnt.enter()()
+				// class 为空时前两次失败, 之后成功
+				if c.class == "" {
+					if ac.Attempt < 2 {
+						return nil, errors.New("flaky")
+					}
+					return &flaps.ActionResult{}, nil
+				}
+				return nil, flaps.WithErrorClass(errors.New("boom"), c.class)
+			})
+			id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: retry
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q}, retry: %s}
+`, key, c.retry), "retry")
+
+			result, err := waitRun(t, mustRun(t, w, id))
+			if !errors.Is(err, c.wantErr) || c.wantErr == nil && err != nil {
+				t.Fatalf("expect %v, got %v", c.wantErr, err)
+			}
+			if calls := cnt.Calls(); calls != c.wantCalls {
+				t.Errorf("expect %d calls, got %d", c.wantCalls, calls)
+			}
+			if attempts := result.Flaps["a"].Attempts; int64(attempts) != c.wantCalls-1 {
+				t.Errorf("expect %d retries recorded, got %d", c.wantCalls-1, attempts)
+			}
+		})
+	}
+}
+
+func TestInvalidRetryPolicy(t *testing.T) {
+	w, _ := newWyvern(t)
+	_, err := w.LoadFromConfig(mustConfig(t, `
+soars:
+  - name: retry
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: none}, retry: {backoff: linear}}
+`), "retry")
+	if !errors.Is(err, flaps.ErrInvalidRetryPolicy) {
+		t.Errorf("expect ErrInvalidRetryPolicy, got %v", err)
+	}
+}
@@ -1,5 +1,10 @@
 package flaps
 
+import "time"
+
+// DefaultCompensateTimeout 未配置 Timeout 时补偿动作的超时时间, 避免无法返回的补偿动作一直阻塞 Soar 的收尾
+const DefaultCompensateTimeout = 5 * time.Minute
+
 // FlapConfig - Flap 的配置
 type FlapConfig struct {
 	// Flap 名称
@@ -14,4 +19,20 @@ type FlapConfig struct {
 	NextFlaps []string `yaml:"nextFlaps" json:"nextFlaps"`
 	// Flap 的启动条件
 	Conditions []string `yaml:"conditions" json:"conditions"`
+	// Flap 的重试策略, 为空时只在插件返回重试时间时重试
+	Retry *RetryPolicy `yaml:"retry" json:"retry"`
+	// Flap 单次执行的超时时间, 超时的执行会通过 context 取消并按重试策略处理, 为 0 表示不限制
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// Flap 的补偿动作, Soar 失败时对已成功的 Flap 按逆拓扑序执行, 用于回滚已完成的工作
+	Compensate *CompensateConfig `yaml:"compensate" json:"compensate"`
+}
+
+// CompensateConfig - Flap 补偿动作的配置
+type CompensateConfig struct {
+	// 补偿动作的插件名
+	Plugin string `yaml:"plugin" json:"plugin"`
+	// 补偿动作的插件配置, 可以通过 ${{ flaps.<name>.output.<key> }} 引用当前 Flap 及其父节点的输出
+	PluginConfig interface{} `yaml:"pluginConfig" json:"pluginConfig"`
+	// 补偿动作的超时时间, 为 0 时使用 DefaultCompensateTimeout
+	Timeout Duration `yaml:"timeout" json:"timeout"`
 }
@@ -1,40 +1,73 @@
 package flaps
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
 
 // PluginMaker 实例化方法接口
 type PluginMaker func(config interface{}) (FlapAction, error)
 
+// PluginMakerV2 FlapActionV2 的实例化方法接口
+type PluginMakerV2 func(config interface{}) (FlapActionV2, error)
+
 var (
 	// ErrPluginNotFound - 找不到 FlapAction 的实例化方法
 	ErrPluginNotFound = errors.New("plugin not found")
+	// ErrInvalidPluginConfig - 插件配置有误, 插件的 FromConfig 应当以此包装配置错误
+	ErrInvalidPluginConfig = errors.New("invalid plugin config")
 
-	// pluginRegistry - PluginMaker 的注册表, key 为 plugin 名称, value 为 PluginMaker
-	pluginRegistry = make(map[string]PluginMaker)
+	// pluginRegistry - PluginMakerV2 的注册表, key 为 plugin 名称, value 为 PluginMakerV2
+	pluginRegistry = make(map[string]PluginMakerV2)
+	// pluginRegistryLock - 保护 pluginRegistry, 插件可以在 Soar 运行时注册
+	pluginRegistryLock sync.RWMutex
 )
 
-// RegisterFlapActionMaker 根据 plugin name 注册 FlapAction 实例化方法
+// RegisterFlapActionMaker 根据 plugin name 注册 FlapAction 实例化方法, 生成的 FlapAction 会被适配为 FlapActionV2
 func RegisterFlapActionMaker(name string, maker PluginMaker) {
+	RegisterFlapActionMakerV2(name, func(config interface{}) (FlapActionV2, error) {
+		a, err := maker(config)
+		if err != nil {
+			return nil, err
+		}
+		return AdaptFlapAction(a), nil
+	})
+}
+
+// RegisterFlapActionMakerV2 根据 plugin name 注册 FlapActionV2 实例化方法
+func RegisterFlapActionMakerV2(name string, maker PluginMakerV2) {
 	// 注册 FlapAction 实例化方法
+	pluginRegistryLock.Lock()
+	defer pluginRegistryLock.Unlock()
 	pluginRegistry[name] = maker
 }
 
-// GetFlapActionMaker 根据 plugin name 获取 FlapAction 实例化方法
-func GetFlapActionMaker(name string) PluginMaker {
+// GetFlapActionMaker 根据 plugin name 获取 FlapActionV2 实例化方法
+func GetFlapActionMaker(name string) PluginMakerV2 {
 	// 获取 FlapAction 实例化方法
+	pluginRegistryLock.RLock()
+	defer pluginRegistryLock.RUnlock()
 	return pluginRegistry[name]
 }
 
-// MakeFlapAction 根据 plugin name 和配置生成 FlapAction
-func MakeFlapAction(plugin string, pluginConfig interface{}) (FlapAction, error) {
+// MakeFlapAction 根据 plugin name 和配置生成 FlapActionV2
+// 实例化方法或 FromConfig panic 时返回 ErrInvalidPluginConfig
+func MakeFlapAction(plugin string, pluginConfig interface{}) (a FlapActionV2, err error) {
 	// 根据 plugin name 获取 FlapAction 实例化方法
 	maker := GetFlapActionMaker(plugin)
 	if maker == nil {
 		// 找不到 FlapAction 实例化方法
 		return nil, ErrPluginNotFound
 	}
+	// 插件没有检查配置的类型时, 将 panic 作为配置错误返回
+	defer func() {
+		if r := recover(); r != nil {
+			a, err = nil, fmt.Errorf("%w: %s: %v", ErrInvalidPluginConfig, plugin, r)
+		}
+	}()
 	// 根据配置生成 FlapAction
-	a, err := maker(pluginConfig)
+	a, err = maker(pluginConfig)
 	if err != nil {
 		// 生成 FlapAction 失败
 		return nil, err
@@ -0,0 +1,46 @@
+package flaps
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("concurrent-%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			RegisterFlapActionMaker(name, func(config any) (FlapAction, error) {
+				return nil, errors.New("not used")
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = GetFlapActionMaker(name)
+			_, _ = MakeFlapAction(name, nil)
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		if GetFlapActionMaker(fmt.Sprintf("concurrent-%d", i)) == nil {
+			t.Errorf("expect concurrent-%d to be registered", i)
+		}
+	}
+}
+
+func TestMakeFlapAction(t *testing.T) {
+	if _, err := MakeFlapAction("missing", nil); !errors.Is(err, ErrPluginNotFound) {
+		t.Errorf("expect ErrPluginNotFound, got %v", err)
+	}
+	RegisterFlapActionMakerV2("panics", func(config any) (FlapActionV2, error) {
+		_ = config.(map[string]any)
+		return nil, nil
+	})
+	if _, err := MakeFlapAction("panics", "not a map"); !errors.Is(err, ErrInvalidPluginConfig) {
+		t.Errorf("expect panic to be reported as ErrInvalidPluginConfig, got %v", err)
+	}
+}
@@ -33,9 +33,14 @@ func (f *FlapPrint) Condition() bool {
 // FromConfig 从配置生成 FlapAction
 func (f *FlapPrint) FromConfig(config interface{}) error {
 	// 从配置生成 FlapPrint
-	conf := config.(map[string]any)
+	conf, ok := config.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %s: config must be a map, got %T", ErrInvalidPluginConfig, FlapPrintName, config)
+	}
 	// 设置日志内容
-	f.Msg = conf["msg"].(string)
+	if f.Msg, ok = conf["msg"].(string); !ok {
+		return fmt.Errorf("%w: %s: msg must be a string, got %T", ErrInvalidPluginConfig, FlapPrintName, conf["msg"])
+	}
 	// 返回 FlapPrint
 	return nil
 }
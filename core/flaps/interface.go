@@ -1,8 +1,12 @@
 package flaps
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // FlapAction 定义 Flap 执行动作的函数签名
+// 新插件推荐实现 FlapActionV2, 注册的 FlapAction 会通过 AdaptFlapAction 自动适配
 type FlapAction interface {
 	// Execute 执行 Flap
 	Execute(retryAttempt int) (*time.Time, error)
@@ -19,3 +23,72 @@ type FlapAction interface {
 	// PluginConfig 配置的复制
 	PluginConfig() any
 }
+
+// ActionContext Flap 动作执行时可以获取的信息
+type ActionContext struct {
+	// SoarID 所属 Soar 的 ID
+	SoarID string
+	// FlapID 当前 Flap 的 ID
+	FlapID string
+	// FlapName 当前 Flap 的配置名
+	FlapName string
+	// Attempt 当前是第几次重试, 首次执行为 0
+	Attempt int
+	// ParentOutputs 所有父节点的输出, key 为父节点的配置名
+	ParentOutputs map[string]map[string]any
+}
+
+// ActionResult Flap 动作的执行结果
+type ActionResult struct {
+	// Output 动作的输出, 会保存在 Flap 上供子节点使用
+	Output map[string]any
+	// RetryAt 与 error 一同返回时表示在该时间重试, 为 nil 表示不再重试
+	RetryAt *time.Time
+}
+
+// FlapActionV2 定义支持 context 的 Flap 执行动作
+// 动作应当在 ctx 结束时尽快返回, ctx 的取消和超时由引擎控制
+type FlapActionV2 interface {
+	// Execute 执行 Flap, 返回结构化的执行结果
+	Execute(ctx context.Context, ac *ActionContext) (*ActionResult, error)
+
+	// FromConfig 从配置生成 FlapAction
+	FromConfig(config any) error
+
+	// Condition 自身的启动条件
+	Condition(ctx context.Context, ac *ActionContext) bool
+
+	// Plugin 名称
+	Plugin() string
+
+	// PluginConfig 配置的复制
+	PluginConfig() any
+}
+
+// actionAdapter 将 FlapAction 适配为 FlapActionV2
+type actionAdapter struct {
+	FlapAction
+}
+
+// AdaptFlapAction 将 FlapAction 适配为 FlapActionV2, 适配后的动作忽略 ctx 中的取消信号
+func AdaptFlapAction(a FlapAction) FlapActionV2 {
+	return &actionAdapter{FlapAction: a}
+}
+
+// Execute 以 ac.Attempt 作为重试次数执行被适配的 FlapAction
+func (a *actionAdapter) Execute(ctx context.Context, ac *ActionContext) (*ActionResult, error) {
+	retryAt, err := a.FlapAction.Execute(ac.Attempt)
+	return &ActionResult{RetryAt: retryAt}, err
+}
+
+// Condition 返回被适配的 FlapAction 的启动条件
+func (a *actionAdapter) Condition(ctx context.Context, ac *ActionContext) bool {
+	return a.FlapAction.Condition()
+}
+
+// Unwrap 返回被适配的 FlapAction
+func (a *actionAdapter) Unwrap() FlapAction {
+	return a.FlapAction
+}
+
+var _ FlapActionV2 = (*actionAdapter)(nil)
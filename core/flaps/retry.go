@@ -0,0 +1,166 @@
+package flaps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// BackoffFixed 每次重试等待相同的时间
+	BackoffFixed = "fixed"
+	// BackoffExponential 每次重试的等待时间按 Multiplier 倍数递增
+	BackoffExponential = "exponential"
+
+	// DefaultRetryDelay 未配置 Delay 时首次重试的等待时间
+	DefaultRetryDelay = time.Second
+)
+
+const (
+	// ErrorClassError 未声明类别的错误
+	ErrorClassError = "error"
+	// ErrorClassTimeout 超时错误, 包括 context.DeadlineExceeded
+	ErrorClassTimeout = "timeout"
+	// ErrorClassTransient 临时错误, 通常可以通过重试恢复
+	ErrorClassTransient = "transient"
+	// ErrorClassPermanent 永久错误, 不会被重试
+	ErrorClassPermanent = "permanent"
+	// ErrorClassAny 在 RetryOn 中匹配除 permanent 以外的所有错误
+	ErrorClassAny = "any"
+)
+
+var (
+	// ErrInvalidRetryPolicy 表示重试策略配置有误
+	ErrInvalidRetryPolicy = errors.New("invalid retry policy")
+
+	// knownErrorClasses RetryOn 中可以使用的错误类别
+	knownErrorClasses = map[string]bool{
+		ErrorClassError: true, ErrorClassTimeout: true, ErrorClassTransient: true, ErrorClassAny: true,
+	}
+)
+
+// ClassifiedError 可以声明自身错误类别的错误, 插件通过返回此类错误影响重试策略
+type ClassifiedError interface {
+	error
+	ErrorClass() string
+}
+
+// classifiedError 带有错误类别的错误
+type classifiedError struct {
+	error
+	class string
+}
+
+func (e *classifiedError) ErrorClass() string { return e.class }
+func (e *classifiedError) Unwrap() error      { return e.error }
+
+// WithErrorClass 为错误标注类别, 例如 WithErrorClass(err, ErrorClassTransient)
+func WithErrorClass(err error, class string) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{error: err, class: class}
+}
+
+// ErrorClassOf 返回错误的类别, 未声明类别的错误返回 ErrorClassError
+func ErrorClassOf(err error) string {
+	var ce ClassifiedError
+	if errors.As(err, &ce) {
+		return ce.ErrorClass()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassError
+}
+
+// RetryPolicy Flap 的重试策略, 由引擎在插件执行失败后应用
+type RetryPolicy struct {
+	// 最大执行次数, 包含首次执行, 小于等于 0 表示不限制
+	MaxAttempts int `yaml:"maxAttempts" json:"maxAttempts"`
+	// 退避方式, fixed 或 exponential, 默认为 fixed
+	Backoff string `yaml:"backoff" json:"backoff"`
+	// 首次重试的等待时间, 默认为 DefaultRetryDelay
+	Delay Duration `yaml:"delay" json:"delay"`
+	// 等待时间的上限, 为 0 表示不限制
+	MaxDelay Duration `yaml:"maxDelay" json:"maxDelay"`
+	// exponential 退避时每次重试等待时间的倍数, 默认为 2
+	Multiplier float64 `yaml:"multiplier" json:"multiplier"`
+	// 等待时间随机浮动的比例, 取值 [0, 1], 例如 0.2 表示在 ±20% 内浮动
+	Jitter float64 `yaml:"jitter" json:"jitter"`
+	// 需要重试的错误类别, 为空表示重试除 permanent 以外的所有错误
+	RetryOn []string `yaml:"retryOn" json:"retryOn"`
+}
+
+// Validate 检查重试策略的配置
+func (p *RetryPolicy) Validate() error {
+	if p.Backoff != "" && p.Backoff != BackoffFixed && p.Backoff != BackoffExponential {
+		return fmt.Errorf("%w: unknown backoff %q", ErrInvalidRetryPolicy, p.Backoff)
+	}
+	if p.Delay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("%w: negative delay", ErrInvalidRetryPolicy)
+	}
+	if p.Multiplier < 0 {
+		return fmt.Errorf("%w: negative multiplier", ErrInvalidRetryPolicy)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("%w: jitter must be in [0, 1]", ErrInvalidRetryPolicy)
+	}
+	for _, class := range p.RetryOn {
+		if !knownErrorClasses[class] {
+			return fmt.Errorf("%w: unknown error class %q", ErrInvalidRetryPolicy, class)
+		}
+	}
+	return nil
+}
+
+// Exhausted 判断已执行 attempts 次后是否已达到最大执行次数
+func (p *RetryPolicy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// ShouldRetry 判断错误是否属于需要重试的类别
+func (p *RetryPolicy) ShouldRetry(err error) bool {
+	class := ErrorClassOf(err)
+	if class == ErrorClassPermanent {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, c := range p.RetryOn {
+		if c == ErrorClassAny || c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// NextDelay 计算第 retry 次重试 (从 1 开始) 前需要等待的时间
+func (p *RetryPolicy) NextDelay(retry int) time.Duration {
+	delay := float64(p.Delay)
+	if delay == 0 {
+		delay = float64(DefaultRetryDelay)
+	}
+	if p.Backoff == BackoffExponential && retry > 1 {
+		multiplier := p.Multiplier
+		if multiplier == 0 {
+			multiplier = 2
+		}
+		delay *= math.Pow(multiplier, float64(retry-1))
+	}
+	// 先加入随机抖动再限制上限, 保证等待时间不会超过 MaxDelay
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(rand.Float64()*2-1)
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
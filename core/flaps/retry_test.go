@@ -0,0 +1,122 @@
+package flaps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyValidate(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		p     RetryPolicy
+		valid bool
+	}{
+		{"zero", RetryPolicy{}, true},
+		{"full", RetryPolicy{MaxAttempts: 3, Backoff: BackoffExponential, Delay: Duration(time.Second), Multiplier: 3, Jitter: 0.5, RetryOn: []string{ErrorClassTransient, ErrorClassTimeout}}, true},
+		{"backoff", RetryPolicy{Backoff: "linear"}, false},
+		{"delay", RetryPolicy{Delay: Duration(-time.Second)}, false},
+		{"maxDelay", RetryPolicy{MaxDelay: Duration(-time.Second)}, false},
+		{"multiplier", RetryPolicy{Multiplier: -1}, false},
+		{"jitter", RetryPolicy{Jitter: 1.5}, false},
+		{"retryOn", RetryPolicy{RetryOn: []string{ErrorClassPermanent}}, false},
+	} {
+		err := c.p.Validate()
+		if c.valid && err != nil || !c.valid && !errors.Is(err, ErrInvalidRetryPolicy) {
+			t.Errorf("%s: expect valid=%v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestErrorClassOf(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{errors.New("x"), ErrorClassError},
+		{context.DeadlineExceeded, ErrorClassTimeout},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), ErrorClassTimeout},
+		{WithErrorClass(errors.New("x"), ErrorClassTransient), ErrorClassTransient},
+		{fmt.Errorf("wrapped: %w", WithErrorClass(errors.New("x"), ErrorClassPermanent)), ErrorClassPermanent},
+	} {
+		if got := ErrorClassOf(c.err); got != c.want {
+			t.Errorf("ErrorClassOf(%v) = %s, want %s", c.err, got, c.want)
+		}
+	}
+	if WithErrorClass(nil, ErrorClassTransient) != nil {
+		t.Errorf("WithErrorClass(nil) must be nil")
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	transient := WithErrorClass(errors.New("x"), ErrorClassTransient)
+	permanent := WithErrorClass(errors.New("x"), ErrorClassPermanent)
+	for _, c := range []struct {
+		retryOn []string
+		err     error
+		want    bool
+	}{
+		{nil, errors.New("x"), true},
+		{nil, transient, true},
+		{nil, permanent, false},
+		{[]string{ErrorClassAny}, permanent, false},
+		{[]string{ErrorClassAny}, transient, true},
+		{[]string{ErrorClassTransient}, transient, true},
+		{[]string{ErrorClassTransient}, errors.New("x"), false},
+		{[]string{ErrorClassTimeout}, context.DeadlineExceeded, true},
+	} {
+		p := RetryPolicy{RetryOn: c.retryOn}
+		if got := p.ShouldRetry(c.err); got != c.want {
+			t.Errorf("retryOn %v, err %v: expect %v, got %v", c.retryOn, c.err, c.want, got)
+		}
+	}
+}
+
+func TestNextDelay(t *testing.T) {
+	ms := func(n int) Duration { return Duration(time.Duration(n) * time.Millisecond) }
+	for _, c := range []struct {
+		name  string
+		p     RetryPolicy
+		retry int
+		want  time.Duration
+	}{
+		{"default", RetryPolicy{}, 1, DefaultRetryDelay},
+		{"fixed", RetryPolicy{Delay: ms(10)}, 3, 10 * time.Millisecond},
+		{"exponential first", RetryPolicy{Backoff: BackoffExponential, Delay: ms(10)}, 1, 10 * time.Millisecond},
+		{"exponential", RetryPolicy{Backoff: BackoffExponential, Delay: ms(10)}, 3, 40 * time.Millisecond},
+		{"multiplier", RetryPolicy{Backoff: BackoffExponential, Delay: ms(10), Multiplier: 3}, 3, 90 * time.Millisecond},
+		{"maxDelay", RetryPolicy{Backoff: BackoffExponential, Delay: ms(10), MaxDelay: ms(25)}, 3, 25 * time.Millisecond},
+		{"overflow", RetryPolicy{Backoff: BackoffExponential, Delay: ms(10)}, 200, time.Duration(1<<63 - 1)},
+	} {
+		if got := c.p.NextDelay(c.retry); got != c.want {
+			t.Errorf("%s: expect %s, got %s", c.name, c.want, got)
+		}
+	}
+
+	p := RetryPolicy{Delay: ms(100), Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if got := p.NextDelay(1); got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("jitter: expect delay in [80ms, 120ms], got %s", got)
+		}
+	}
+
+	// 抖动后的等待时间仍不超过 MaxDelay
+	p = RetryPolicy{Backoff: BackoffExponential, Delay: ms(100), MaxDelay: ms(150), Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := p.NextDelay(3); got > 150*time.Millisecond {
+			t.Fatalf("jitter with maxDelay: expect at most 150ms, got %s", got)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	if (&RetryPolicy{}).Exhausted(100) {
+		t.Errorf("zero MaxAttempts must not be exhausted")
+	}
+	p := &RetryPolicy{MaxAttempts: 2}
+	if p.Exhausted(1) || !p.Exhausted(2) {
+		t.Errorf("expect exhausted after 2 attempts")
+	}
+}
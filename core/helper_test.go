@@ -0,0 +1,212 @@
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+	"github.com/bagaking/wyvern/store/memory"
+)
+
+// testPlugin 测试插件的名称, 插件配置中的 key 指定执行时调用的 behaviour
+const testPlugin = "test"
+
+// runTimeout 等待一次运行结束的最长时间
+const runTimeout = 5 * time.Second
+
+// behaviour 测试插件执行时调用的函数, config 为渲染后的插件配置
+type behaviour func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error)
+
+var (
+	behavioursLock sync.Mutex
+	behaviours     = map[string]behaviour{}
+	behaviourSeq   int64
+)
+
+// testAction 执行配置中 key 对应的 behaviour, 没有注册 behaviour 时直接成功
+type testAction struct {
+	config map[string]any
+}
+
+func (a *testAction) Plugin() string {
+	return testPlugin
+}
+
+func (a *testAction) PluginConfig() any {
+	return a.config
+}
+
+func (a *testAction) FromConfig(config any) error {
+	conf, ok := config.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %s: config must be a map, got %T", flaps.ErrInvalidPluginConfig, testPlugin, config)
+	}
+	if _, ok = conf["key"].(string); !ok {
+		return fmt.Errorf("%w: %s: key must be a string", flaps.ErrInvalidPluginConfig, testPlugin)
+	}
+	a.config = conf
+	return nil
+}
+
+func (a *testAction) Condition(ctx context.Context, ac *flaps.ActionContext) bool {
+	return true
+}
+
+func (a *testAction) Execute(ctx context.Context, ac *flaps.ActionContext) (*flaps.ActionResult, error) {
+	behavioursLock.Lock()
+	fn := behaviours[a.config["key"].(string)]
+	behavioursLock.Unlock()
+	if fn == nil {
+		return &flaps.ActionResult{}, nil
+	}
+	return fn(ctx, ac, a.config)
+}
+
+func init() {
+	flaps.RegisterFlapActionMakerV2(testPlugin, func(config any) (flaps.FlapActionV2, error) {
+		return &testAction{}, nil
+	})
+}
+
+// behave 注册 behaviour 并返回其 key, 测试结束时注销
+func behave(t *testing.T, fn behaviour) string {
+	t.Helper()
+	key := fmt.Sprintf("%s#%d", t.Name(), atomic.AddInt64(&behaviourSeq, 1))
+	behavioursLock.Lock()
+	behaviours[key] = fn
+	behavioursLock.Unlock()
+	t.Cleanup(func() {
+		behavioursLock.Lock()
+		delete(behaviours, key)
+		behavioursLock.Unlock()
+	})
+	return key
+}
+
+// counter 记录 behaviour 的执行次数和同时执行的最大数量
+type counter struct {
+	calls   int64
+	running int64
+	peak    int64
+}
+
+// enter 记录一次开始执行, 返回的函数记录执行结束
+func (c *counter) enter() func() {
+	atomic.AddInt64(&c.calls, 1)
+	n := atomic.AddInt64(&c.running, 1)
+	for {
+		peak := atomic.LoadInt64(&c.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&c.peak, peak, n) {
+			break
+		}
+	}
+	return func() { atomic.AddInt64(&c.running, -1) }
+}
+
+func (c *counter) Calls() int64 {
+	return atomic.LoadInt64(&c.calls)
+}
+
+func (c *counter) Peak() int64 {
+	return atomic.LoadInt64(&c.peak)
+}
+
+// newWyvern 创建使用内存 Store 的 Wyvern
+func newWyvern(t *testing.T) (*core.Wyvern, *memory.Store) {
+	t.Helper()
+	s := memory.New()
+	return core.NewWyvern(s), s
+}
+
+// mustConfig 从 YAML 文本加载配置
+func mustConfig(t *testing.T, yml string) *core.WyvernConfig {
+	t.Helper()
+	conf, err := core.LoadWyvernConfig(yml)
+	if err != nil {
+		t.Fatalf("LoadWyvernConfig: %v", err)
+	}
+	return conf
+}
+
+// mustLoad 从 YAML 文本加载名为 name 的 Soar, 返回其 ID
+func mustLoad(t *testing.T, w *core.Wyvern, yml, name string) core.ID {
+	t.Helper()
+	id, err := w.LoadFromConfig(mustConfig(t, yml), name)
+	if err != nil {
+		t.Fatalf("LoadFromConfig: %v", err)
+	}
+	return id
+}
+
+// mustRun 运行 Soar 并返回其句柄
+func mustRun(t *testing.T, w *core.Wyvern, id core.ID) *core.RunHandle {
+	t.Helper()
+	h, err := w.Run(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return h
+}
+
+// waitRun 等待运行结束, 超过 runTimeout 视为失败
+func waitRun(t *testing.T, h *core.RunHandle) (core.RunResult, error) {
+	t.Helper()
+	select {
+	case <-h.Done():
+	case <-time.After(runTimeout):
+		t.Fatalf("soar %s did not finish in %s", h.SoarID(), runTimeout)
+	}
+	return h.Wait(context.Background())
+}
+
+// storedFlap 从 Store 中读取 Soar 中名为 name 的 Flap 的数据
+func storedFlap(t *testing.T, s core.Store, soarID core.ID, name string) core.FlapRecord {
+	t.Helper()
+	table, err := s.Rebuild(soarID)
+	if err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+	for _, flapID := range table.ListAllFlapID() {
+		if rec := table.GetFlap(flapID).Record(); rec.ConfName == name {
+			return rec
+		}
+	}
+	t.Fatalf("flap %s not found in store", name)
+	return core.FlapRecord{}
+}
+
+// eventually 在 runTimeout 内轮询 cond 直到其返回 true
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(runTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// chainYAML a -> b -> c, a 调用 first 对应的 behaviour, 其余调用 rest 对应的 behaviour
+const chainYAML = `
+soars:
+  - name: chain
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q}}
+      - {name: b, plugin: test, pluginConfig: {key: %[2]q}, prevFlaps: [a]}
+      - {name: c, plugin: test, pluginConfig: {key: %[2]q}, prevFlaps: [b]}
+`
+
+// gated 返回一个在 release 关闭前阻塞的 behaviour, 开始执行时向 started 发送信号
+func gated(started chan<- string, release <-chan struct{}) behaviour {
+	return func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		started <- ac.FlapName
+		<-release
+		return &flaps.ActionResult{}, nil
+	}
+}
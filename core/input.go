@@ -0,0 +1,257 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+const (
+	// InputTypeString 字符串参数, 未声明类型时的默认类型
+	InputTypeString = "string"
+	// InputTypeInt 整数参数, 可以传入整数、没有小数部分的浮点数或可以解析为整数的字符串
+	InputTypeInt = "int"
+	// InputTypeBool 布尔参数, 可以传入布尔值或可以解析为布尔值的字符串
+	InputTypeBool = "bool"
+	// InputTypeList 列表参数, 元素可以是任意类型
+	InputTypeList = "list"
+)
+
+var (
+	// ErrInvalidInput 表示运行参数不符合 Soar 的参数声明
+	ErrInvalidInput = errors.New("invalid soar input")
+	// ErrInputsBound 表示 Soar 已经绑定运行参数, 不能再传入新的参数
+	ErrInputsBound = errors.New("soar inputs are already bound")
+
+	// knownInputTypes 参数声明中可以使用的类型
+	knownInputTypes = map[string]bool{
+		InputTypeString: true,
+		InputTypeInt:    true,
+		InputTypeBool:   true,
+		InputTypeList:   true,
+	}
+)
+
+// InputConfig - Soar 运行参数的声明
+type InputConfig struct {
+	// 参数名, 在插件配置中通过 ${{ inputs.<name> }} 引用, 在启动条件中通过 inputs.<name> 引用
+	Name string `yaml:"name" json:"name"`
+	// 参数类型, 为 string int bool list 之一, 为空时为 string
+	Type string `yaml:"type" json:"type,omitempty"`
+	// 是否必须传入, 必须传入的参数不使用默认值
+	Required bool `yaml:"required" json:"required,omitempty"`
+	// 未传入参数时使用的默认值, 没有默认值的可选参数为 nil
+	Default any `yaml:"default" json:"default,omitempty"`
+	// 参数可以取的值, 为空时不限制
+	Enum []any `yaml:"enum" json:"enum,omitempty"`
+}
+
+// inputType 返回参数的类型
+func (conf InputConfig) inputType() string {
+	if conf.Type == "" {
+		return InputTypeString
+	}
+	return conf.Type
+}
+
+// Validate 检查参数声明的类型、默认值和可选值
+func (conf InputConfig) Validate() error {
+	if !knownInputTypes[conf.inputType()] {
+		return fmt.Errorf("%w: input %s: unknown type %q", ErrInvalidInput, conf.Name, conf.Type)
+	}
+	for _, v := range conf.Enum {
+		if _, err := conf.coerce(v); err != nil {
+			return fmt.Errorf("%w: input %s: enum value %v: %v", ErrInvalidInput, conf.Name, v, err)
+		}
+	}
+	if conf.Default != nil {
+		if _, err := conf.check(conf.Default); err != nil {
+			return fmt.Errorf("%w: input %s: default: %v", ErrInvalidInput, conf.Name, err)
+		}
+	}
+	return nil
+}
+
+// check 将参数值转换为声明的类型, 并检查是否为可选值之一
+func (conf InputConfig) check(v any) (any, error) {
+	val, err := conf.coerce(v)
+	if err != nil || len(conf.Enum) == 0 {
+		return val, err
+	}
+	for _, option := range conf.Enum {
+		if opt, err := conf.coerce(option); err == nil && reflect.DeepEqual(opt, val) {
+			return val, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not one of %v", v, conf.Enum)
+}
+
+// coerce 将参数值转换为声明的类型, 列表统一转换为 []any
+func (conf InputConfig) coerce(v any) (any, error) {
+	switch conf.inputType() {
+	case InputTypeString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case InputTypeInt:
+		switch val := v.(type) {
+		case int:
+			return val, nil
+		case int64:
+			return int(val), nil
+		case int32:
+			return int(val), nil
+		case float64:
+			// JSON 中的整数解码为浮点数, 只接受可以精确表示的整数
+			if val == math.Trunc(val) && math.Abs(val) <= 1<<53 {
+				return int(val), nil
+			}
+		case string:
+			if n, err := strconv.Atoi(strings.TrimSpace(val)); err == nil {
+				return n, nil
+			}
+		}
+	case InputTypeBool:
+		switch val := v.(type) {
+		case bool:
+			return val, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(val)); err == nil {
+				return b, nil
+			}
+		}
+	case InputTypeList:
+		if v == nil {
+			break
+		}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			list := make([]any, rv.Len())
+			for i := range list {
+				list[i] = rv.Index(i).Interface()
+			}
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("expect %s, got %T", conf.inputType(), v)
+}
+
+// resolveInputs 按参数声明检查并转换运行参数, 返回所有声明的参数的值
+// 未传入的可选参数使用默认值, 没有默认值时为 nil; 未声明的参数和所有不符合声明的参数一起以 ErrInvalidInput 返回
+func resolveInputs(decls []InputConfig, values map[string]any) (map[string]any, error) {
+	bound := make(map[string]any, len(decls))
+	var problems []string
+	declared := make(map[string]bool, len(decls))
+	for _, decl := range decls {
+		declared[decl.Name] = true
+		v, ok := values[decl.Name]
+		if !ok || v == nil {
+			if decl.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", decl.Name))
+				continue
+			}
+			v = cloneValue(decl.Default)
+			if v == nil {
+				bound[decl.Name] = nil
+				continue
+			}
+		}
+		val, err := decl.check(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", decl.Name, err))
+			continue
+		}
+		bound[decl.Name] = val
+	}
+	undeclared := make([]string, 0)
+	for name := range values {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, name := range undeclared {
+		problems = append(problems, fmt.Sprintf("%s is not declared", name))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidInput, strings.Join(problems, "; "))
+	}
+	return bound, nil
+}
+
+// normalizeInputs 按参数声明转换从 Store 加载的参数值, 例如 JSON 中的整数会被解码为浮点数
+// 无法转换的值保持原样
+func normalizeInputs(decls []InputConfig, values map[string]any) map[string]any {
+	if values == nil {
+		return nil
+	}
+	ret := cloneMap(values)
+	for _, decl := range decls {
+		if v, ok := ret[decl.Name]; ok && v != nil {
+			if val, err := decl.coerce(v); err == nil {
+				ret[decl.Name] = val
+			}
+		}
+	}
+	return ret
+}
+
+// bindInputs 第一次运行时设置运行参数, 并使用参数重新实例化所有 Flap 的动作
+// 已经绑定运行参数时, values 为 nil 则保持已有的参数, 否则返回 ErrInputsBound
+// 所有 Flap 的动作都能以运行参数实例化后才一起生效, 任意一个失败时 Soar 和所有 Flap 保持不变, 之后可以换用其他参数运行
+// 本次调用完成绑定时返回的 unbind 将 Soar 和所有 Flap 恢复到绑定前的状态, 供绑定后启动失败时撤销; 未发生绑定时 unbind 为 nil
+func (soar *Soar) bindInputs(values map[string]any) (unbind func(), err error) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	if soar.inputsBound {
+		if values != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInputsBound, soar.id)
+		}
+		return nil, nil
+	}
+	inputs, err := resolveInputs(soar.inputDecls, values)
+	if err != nil {
+		return nil, err
+	}
+	flapIDs := soar.IFlapIndex.ListAllFlapID()
+	sort.Strings(flapIDs)
+	actions := make(map[ID]flaps.FlapActionV2, len(flapIDs))
+	for _, flapID := range flapIDs {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		if actions[flapID], err = flap.makeActions(inputs); err != nil {
+			return nil, fmt.Errorf("flap %s: %w", flap.ConfName, err)
+		}
+	}
+	prevActions := make(map[ID]flaps.FlapActionV2, len(flapIDs))
+	prevInputs := make(map[ID]map[string]any, len(flapIDs))
+	prevDirty := soar.soarDirty
+	for _, flapID := range flapIDs {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		prevInputs[flapID], prevActions[flapID] = flap.inputs, flap.Action
+		flap.inputs, flap.Action = inputs, actions[flapID]
+	}
+	soar.inputs, soar.inputsBound = inputs, true
+	soar.soarDirty = true
+	return func() {
+		soar.lock.Lock()
+		defer soar.lock.Unlock()
+		for _, flapID := range flapIDs {
+			flap := soar.IFlapIndex.GetFlap(flapID)
+			flap.inputs, flap.Action = prevInputs[flapID], prevActions[flapID]
+		}
+		soar.inputs, soar.inputsBound = nil, false
+		soar.soarDirty = prevDirty
+	}, nil
+}
+
+// Inputs 返回 Soar 绑定的运行参数, 尚未绑定时返回 nil
+func (soar *Soar) Inputs() map[string]any {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	return cloneMap(soar.inputs)
+}
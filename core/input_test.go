@@ -0,0 +1,146 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+	"github.com/bagaking/wyvern/store/memory"
+)
+
+// inputsYAML a 的配置引用 inputs.name, b 的 n 引用 inputs.n
+const inputsYAML = `
+soars:
+  - name: inputs
+    inputs:
+      - {name: name}
+      - {name: n, type: int}
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q, name: "${{ inputs.name }}"}}
+      - {name: b, plugin: test-strict, prevFlaps: [a], pluginConfig: {n: "${{ inputs.n }}"}}
+`
+
+func TestBindInputsAfterPause(t *testing.T) {
+	var seen []int
+	flaps.RegisterFlapActionMakerV2("test-strict", func(config any) (flaps.FlapActionV2, error) {
+		return &strictAction{seen: &seen}, nil
+	})
+	w, _ := newWyvern(t)
+	var name any
+	a := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		name = config["name"]
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(inputsYAML, a), "inputs")
+
+	// 运行前暂停的 Soar 仍未绑定运行参数
+	if err := w.Pause(id); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	h, err := w.RunWithInputs(context.Background(), id, map[string]any{"name": "x", "n": 2})
+	if err != nil {
+		t.Fatalf("RunWithInputs: %v", err)
+	}
+	if err = w.Resume(id); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if _, err = waitRun(t, h); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if name != "x" || len(seen) != 1 || seen[0] != 2 {
+		t.Errorf("expect rendered inputs, got name %v and n %v", name, seen)
+	}
+	if _, err = w.RunWithInputs(context.Background(), id, map[string]any{"name": "y", "n": 3}); !errors.Is(err, core.ErrInputsBound) {
+		t.Errorf("expect ErrInputsBound, got %v", err)
+	}
+}
+
+func TestFailedBindKeepsSoarUnbound(t *testing.T) {
+	var seen []int
+	flaps.RegisterFlapActionMakerV2("test-strict", func(config any) (flaps.FlapActionV2, error) {
+		return &strictAction{seen: &seen}, nil
+	})
+	w, s := newWyvern(t)
+	var name any
+	a := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		name = config["name"]
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(inputsYAML, a), "inputs")
+	soar, _ := w.GetSoar(id)
+
+	// 未传入 n 时 b 的配置渲染为 nil, 插件拒绝该配置, a 已经渲染成功的动作也不能生效
+	_, err := w.RunWithInputs(context.Background(), id, map[string]any{"name": "bad"})
+	if !errors.Is(err, flaps.ErrInvalidPluginConfig) {
+		t.Fatalf("expect ErrInvalidPluginConfig, got %v", err)
+	}
+	if soar.Inputs() != nil {
+		t.Fatalf("failed bind must not set inputs, got %v", soar.Inputs())
+	}
+	for _, flapID := range soar.ListAllFlapID() {
+		if flap := soar.GetFlap(flapID); flap.Action != nil {
+			t.Fatalf("failed bind must not set the action of %s, got %v", flap.ConfName, flap.Action.PluginConfig())
+		}
+	}
+
+	h, err := w.RunWithInputs(context.Background(), id, map[string]any{"name": "good", "n": 1})
+	if err != nil {
+		t.Fatalf("RunWithInputs after failed bind: %v", err)
+	}
+	if _, err = waitRun(t, h); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if name != "good" || len(seen) != 1 || seen[0] != 1 {
+		t.Errorf("expect inputs of the second bind, got name %v and n %v", name, seen)
+	}
+	rec := &core.Soar{}
+	if err = s.LoadSoar(rec, id); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	if !rec.Record().InputsBound || rec.Inputs()["name"] != "good" {
+		t.Errorf("expect bound inputs in store, got %+v", rec.Record())
+	}
+}
+
+func TestLeasedRunKeepsSoarUnbound(t *testing.T) {
+	var seen []int
+	flaps.RegisterFlapActionMakerV2("test-strict", func(config any) (flaps.FlapActionV2, error) {
+		return &strictAction{seen: &seen}, nil
+	})
+	w, _ := newWyvern(t)
+	lease := memory.NewLease()
+	w.SetLease(lease, core.LeaseOptions{TTL: time.Minute})
+	a := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(inputsYAML, a), "inputs")
+	soar, _ := w.GetSoar(id)
+
+	// 租约由其他实例持有时不绑定运行参数, 租约释放后可以重新传入参数运行
+	if ok, err := lease.Acquire(id, "other", time.Minute); !ok || err != nil {
+		t.Fatalf("Acquire: %v %v", ok, err)
+	}
+	if _, err := w.RunWithInputs(context.Background(), id, map[string]any{"name": "x", "n": 1}); !errors.Is(err, core.ErrSoarLeased) {
+		t.Fatalf("expect ErrSoarLeased, got %v", err)
+	}
+	if soar.Inputs() != nil {
+		t.Fatalf("leased run must not bind inputs, got %v", soar.Inputs())
+	}
+	if err := lease.Release(id, "other"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	h, err := w.RunWithInputs(context.Background(), id, map[string]any{"name": "y", "n": 2})
+	if err != nil {
+		t.Fatalf("RunWithInputs after release: %v", err)
+	}
+	if _, err = waitRun(t, h); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if soar.Inputs()["name"] != "y" || len(seen) != 1 || seen[0] != 2 {
+		t.Errorf("expect inputs of the second run, got %v and n %v", soar.Inputs(), seen)
+	}
+}
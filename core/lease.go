@@ -0,0 +1,222 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultLeaseTTL 默认的租约有效期
+	DefaultLeaseTTL = 15 * time.Second
+)
+
+var (
+	// ErrSoarLeased 表示 Soar 的租约由其他实例持有, 不能在当前实例上运行
+	ErrSoarLeased = errors.New("soar is leased by another instance")
+	// ErrLeaseNotSet 表示没有为 Wyvern 设置租约
+	ErrLeaseNotSet = errors.New("lease is not set")
+)
+
+// Lease 多实例共享的租约, 保证每个 Soar 同一时刻只由一个 Wyvern 实例运行
+// key 为 Soar ID, owner 为 Wyvern 实例的 ID
+type Lease interface {
+	// Acquire 为 owner 获取或续期 key 的租约, 有效期为 ttl
+	// 租约未被持有、已过期或已由 owner 持有时成功并返回 true, 由其他 owner 持有且未过期时返回 false
+	Acquire(key ID, owner string, ttl time.Duration) (bool, error)
+	// Release 释放 owner 持有的租约, 租约不由 owner 持有时不做任何操作
+	Release(key ID, owner string) error
+}
+
+// LeaseOptions 租约的续期设置
+type LeaseOptions struct {
+	// TTL 租约的有效期, 为 0 时使用 DefaultLeaseTTL
+	TTL time.Duration
+	// RenewInterval Serve 续期租约和接管孤儿 Soar 的间隔, 为 0 时使用 TTL 的三分之一
+	RenewInterval time.Duration
+	// OnError 不为 nil 时接收 Serve 中续期和接管失败的错误
+	OnError func(err error)
+}
+
+// ttl 返回租约的有效期
+func (opts LeaseOptions) ttl() time.Duration {
+	if opts.TTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return opts.TTL
+}
+
+// renewInterval 返回续期的间隔
+func (opts LeaseOptions) renewInterval() time.Duration {
+	if opts.RenewInterval <= 0 {
+		return opts.ttl() / 3
+	}
+	return opts.RenewInterval
+}
+
+// SetLease 设置租约, 设置后 Run 和 Recover 只运行当前实例持有租约的 Soar
+// 需要在运行 Soar 前调用, 并通过 Serve 定期续期
+func (w *Wyvern) SetLease(lease Lease, opts LeaseOptions) {
+	w.lease, w.leaseOpts = lease, opts
+}
+
+// Serve 每隔 RenewInterval 续期当前实例上运行中的 Soar 的租约, 并通过 Recover 接管租约已过期的孤儿 Soar, 直到 ctx 结束或 Wyvern 关闭
+// 续期失败超过 TTL 或租约已被其他实例获取的 Soar 会在当前实例上停止运行, 且不再写入 Store
+// 接管的 Soar 以 ctx 运行, ctx 结束时与 Stop 一样中断执行中的 Flap
+func (w *Wyvern) Serve(ctx context.Context) error {
+	if w.lease == nil {
+		return ErrLeaseNotSet
+	}
+	ticker := time.NewTicker(w.leaseOpts.renewInterval())
+	defer ticker.Stop()
+	for {
+		w.renewLeases()
+		if _, err := w.Recover(ctx); err != nil {
+			w.leaseError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.done:
+			return ErrWyvernClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquireLease 为当前实例获取 Soar 的租约, 没有设置租约时直接返回 true
+func (w *Wyvern) acquireLease(soarID ID) (bool, error) {
+	if w.lease == nil {
+		return true, nil
+	}
+	return w.lease.Acquire(soarID, w.id, w.leaseOpts.ttl())
+}
+
+// releaseLease 释放当前实例持有的 Soar 的租约, 没有设置租约时不做任何操作
+func (w *Wyvern) releaseLease(soarID ID) {
+	if w.lease == nil {
+		return
+	}
+	if err := w.lease.Release(soarID, w.id); err != nil {
+		w.leaseError(err)
+	}
+}
+
+// start 运行 Soar, 本次运行结束后释放租约, 因写入冲突停止时从 Store 重新加载 Soar
+// Wyvern 已经关闭时返回 ErrWyvernClosed; 启动的协程由 running 跟踪, Close 时等待其退出
+func (w *Wyvern) start(ctx context.Context, soar *Soar) (*RunHandle, error) {
+	// 在 closeLock 内启动调度循环, Close 之后能看到并停止所有已启动的 Soar
+	w.closeLock.Lock()
+	if w.closed {
+		w.closeLock.Unlock()
+		return nil, ErrWyvernClosed
+	}
+	w.running.Add(1)
+	soar.renewed(time.Now())
+	handle := soar.Soar(ctx)
+	w.closeLock.Unlock()
+	go func() {
+		defer w.running.Done()
+		<-handle.Done()
+		// 再次运行时由新的运行持有租约
+		if soar.isRunning() {
+			return
+		}
+		w.releaseLease(soar.id)
+		// 关闭后不再重新加载, 由之后的 Recover 从 Store 恢复
+		if errors.Is(soar.fenceError(), ErrRevisionConflict) && !w.isClosed() {
+			w.reload(soar)
+		}
+	}()
+	return handle, nil
+}
+
+// renewLeases 续期当前实例上运行中的 Soar 的租约, 失去租约的 Soar 被停止并从 Soar 清单中移除
+func (w *Wyvern) renewLeases() {
+	ttl := w.leaseOpts.ttl()
+	for _, soar := range w.listSoars() {
+		if !soar.isRunning() {
+			continue
+		}
+		now := time.Now()
+		ok, err := w.lease.Acquire(soar.id, w.id, ttl)
+		switch {
+		case err == nil && ok:
+			soar.renewed(now)
+			continue
+		case err != nil:
+			w.leaseError(fmt.Errorf("renew lease of soar %s: %w", soar.id, err))
+			// 续期失败但租约尚未过期, 下次继续续期
+			if now.Sub(soar.leaseRenewedAt()) < ttl {
+				continue
+			}
+		}
+		soar.fence(fmt.Errorf("%w: %s", ErrSoarLeased, soar.id))
+		w.soarsLock.Lock()
+		if w.Soars[soar.id] == soar {
+			delete(w.Soars, soar.id)
+		}
+		w.soarsLock.Unlock()
+	}
+}
+
+// leaseError 将 Serve 中的错误交给 OnError
+func (w *Wyvern) leaseError(err error) {
+	if w.leaseOpts.OnError != nil {
+		w.leaseOpts.OnError(err)
+	}
+}
+
+// isRunning 判断 Soar 的调度循环是否在当前实例上运行
+func (soar *Soar) isRunning() bool {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	return soar.cancel != nil
+}
+
+// interrupt 通过 context 中断本次运行中执行的 Flap, 与运行的 ctx 结束时一样等待执行中的 Flap 结束后退出调度循环
+func (soar *Soar) interrupt() {
+	soar.lock.Lock()
+	cancel := soar.cancel
+	soar.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// renewed 记录最近一次成功获取租约的时间
+func (soar *Soar) renewed(at time.Time) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	soar.leaseRenewed = at
+}
+
+// leaseRenewedAt 返回最近一次成功获取租约的时间
+func (soar *Soar) leaseRenewedAt() time.Time {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	return soar.leaseRenewed
+}
+
+// fence 在失去租约或写入冲突后停止 Soar: 之后的状态变化不再写入 Store, 并通过 context 中断执行中的 Flap
+// Soar 的状态保持不变, 由持有租约或写入成功的实例继续运行, err 作为本次运行结果的 Err
+func (soar *Soar) fence(err error) {
+	soar.lock.Lock()
+	if !soar.fenced {
+		soar.fenced, soar.fenceErr = true, err
+	}
+	soar.stopping = true
+	cancel := soar.cancel
+	soar.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// fenceError 返回 Soar 停止运行的原因, 未停止时返回 nil
+func (soar *Soar) fenceError() error {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	return soar.fenceErr
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrSoarNotRunning 表示 Soar 没有在当前实例上运行
+	ErrSoarNotRunning = errors.New("soar is not running")
+	// ErrSoarFinished 表示 Soar 已经结束 (成功、失败或被取消), 不能再改变其状态
+	ErrSoarFinished = errors.New("soar is already finished")
+	// ErrSoarCompensating 表示 Soar 已经失败, 正在执行补偿, 不能再暂停或取消
+	ErrSoarCompensating = errors.New("soar is compensating")
+)
+
+// SoarStatus Soar 的运行状态
+type SoarStatus int
+
+const (
+	// SoarStatusPending 已创建, 尚未开始运行
+	SoarStatusPending SoarStatus = iota
+	// SoarStatusRunning 正在运行
+	SoarStatusRunning
+	// SoarStatusPaused 已暂停, 不再派发新的 Flap, 执行中的 Flap 会继续执行完毕
+	SoarStatusPaused
+	// SoarStatusCancelled 已取消, 执行中的 Flap 通过 context 收到取消信号
+	SoarStatusCancelled
+	// SoarStatusSucceeded 所有 Flap 均已成功
+	SoarStatusSucceeded
+	// SoarStatusFailed 存在失败的 Flap
+	SoarStatusFailed
+	// SoarStatusCompensating 已经失败, 正在执行已成功 Flap 的补偿动作, 补偿全部结束后变为 SoarStatusFailed
+	// 补偿中途退出的 Soar 不是终态, Recover 时会继续执行尚未完成的补偿
+	SoarStatusCompensating
+)
+
+// String 返回状态的名称
+func (s SoarStatus) String() string {
+	switch s {
+	case SoarStatusPending:
+		return "pending"
+	case SoarStatusRunning:
+		return "running"
+	case SoarStatusPaused:
+		return "paused"
+	case SoarStatusCancelled:
+		return "cancelled"
+	case SoarStatusSucceeded:
+		return "succeeded"
+	case SoarStatusFailed:
+		return "failed"
+	case SoarStatusCompensating:
+		return "compensating"
+	}
+	return fmt.Sprintf("SoarStatus(%d)", int(s))
+}
+
+// MarshalText 实现 encoding.TextMarshaler, 持久化时以名称表示状态
+func (s SoarStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText 实现 encoding.TextUnmarshaler, 从名称解析状态
+func (s *SoarStatus) UnmarshalText(text []byte) error {
+	for v := SoarStatus(SoarStatusPending); v <= SoarStatusCompensating; v++ {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown soar status %q", text)
+}
+
+// IsFinished 判断状态是否为终态, 终态的 Soar 不会再被执行
+func (s SoarStatus) IsFinished() bool {
+	return s == SoarStatusCancelled || s == SoarStatusSucceeded || s == SoarStatusFailed
+}
+
+// ID 返回 Soar 的 ID
+func (soar *Soar) ID() ID {
+	return soar.id
+}
+
+// Name 返回 Soar 的配置名
+func (soar *Soar) Name() string {
+	return soar.name
+}
+
+// Status 返回 Soar 当前的运行状态
+func (soar *Soar) Status() SoarStatus {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	return soar.status
+}
+
+// Pause 暂停 Soar, 暂停后不再派发新的 Flap, 已在执行的 Flap 不受影响
+// 暂停状态会被持久化, 重启后恢复的 Soar 仍保持暂停, 直到调用 Resume
+func (soar *Soar) Pause() error {
+	soar.lock.Lock()
+	if err := soar.checkControllable(); err != nil {
+		soar.lock.Unlock()
+		return err
+	}
+	soar.setStatus(SoarStatusPaused)
+	soar.lock.Unlock()
+	// 唤醒调度循环写入暂停状态
+	soar.notify()
+	return nil
+}
+
+// Resume 恢复被暂停的 Soar
+func (soar *Soar) Resume() error {
+	soar.lock.Lock()
+	if soar.status.IsFinished() {
+		soar.lock.Unlock()
+		return ErrSoarFinished
+	}
+	if soar.status == SoarStatusPaused {
+		soar.setStatus(SoarStatusRunning)
+	}
+	soar.lock.Unlock()
+	soar.notify()
+	return nil
+}
+
+// Stop 停止在当前实例上运行 Soar: 不再派发新的 Flap, 等待执行中的 Flap 结束后退出调度循环
+// Stop 不改变 Soar 的状态, 被停止的 Soar 可以再次运行或在其他实例上恢复
+func (soar *Soar) Stop() error {
+	soar.lock.Lock()
+	if soar.cancel == nil {
+		soar.lock.Unlock()
+		return ErrSoarNotRunning
+	}
+	soar.stopping = true
+	soar.lock.Unlock()
+	soar.notify()
+	return nil
+}
+
+// Cancel 取消 Soar: 不再派发新的 Flap, 并通过 context 取消所有执行中的 Flap, 等待它们结束后退出调度循环, Soar 的状态变为 SoarStatusCancelled
+func (soar *Soar) Cancel() error {
+	soar.lock.Lock()
+	if err := soar.checkControllable(); err != nil {
+		soar.lock.Unlock()
+		return err
+	}
+	soar.setStatus(SoarStatusCancelled)
+	cancel := soar.cancel
+	soar.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// checkControllable 检查 Soar 是否还能暂停或取消, 调用方需持有 soar.lock
+func (soar *Soar) checkControllable() error {
+	if soar.status.IsFinished() {
+		return ErrSoarFinished
+	}
+	if soar.status == SoarStatusCompensating {
+		return ErrSoarCompensating
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+func TestPauseResume(t *testing.T) {
+	w, s := newWyvern(t)
+	started, release := make(chan string, 1), make(chan struct{})
+	rec := &recorder{}
+	first := behave(t, gated(started, release))
+	rest := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		rec.record(ac.FlapName)
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, rest), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	if err := w.Pause(id); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	close(release)
+	// 暂停后执行中的 a 继续执行完毕, 但不再派发 b
+	eventually(t, "a to succeed", func() bool {
+		return storedFlap(t, s, id, "a").State == core.FlapStateSuccess
+	})
+	time.Sleep(30 * time.Millisecond)
+	if order := rec.Order(); len(order) != 0 {
+		t.Fatalf("paused soar dispatched %v", order)
+	}
+	probe := &core.Soar{}
+	eventually(t, "paused status in store", func() bool {
+		return s.LoadSoar(probe, id) == nil && probe.Status() == core.SoarStatusPaused
+	})
+
+	if err := w.Resume(id); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if _, err := waitRun(t, h); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if order := rec.Order(); len(order) != 2 {
+		t.Errorf("expect b and c after resume, got %v", order)
+	}
+}
+
+func TestStopAndRunAgain(t *testing.T) {
+	w, _ := newWyvern(t)
+	started, release := make(chan string, 1), make(chan struct{})
+	cnt := &counter{}
+	first := behave(t, gated(started, release))
+	rest := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		defer cnt.enter()()
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, rest), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	if err := w.Stop(id); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	close(release)
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarStopped) || result.Status != core.SoarStatusRunning {
+		t.Fatalf("expect stopped run with running status, got %v (%s)", err, result.Status)
+	}
+	if result.Flaps["a"].State != core.FlapStateSuccess || cnt.Calls() != 0 {
+		t.Fatalf("expect a to finish and b not to start, got %s and %d calls", result.Flaps["a"].State, cnt.Calls())
+	}
+	if err = w.Stop(id); !errors.Is(err, core.ErrSoarNotRunning) {
+		t.Errorf("Stop on stopped soar: expect ErrSoarNotRunning, got %v", err)
+	}
+
+	if _, err = waitRun(t, mustRun(t, w, id)); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+	if cnt.Calls() != 2 {
+		t.Errorf("expect b and c to run once, got %d calls", cnt.Calls())
+	}
+}
+
+func TestContextEndStopsRun(t *testing.T) {
+	w, _ := newWyvern(t)
+	started := make(chan string, 1)
+	var sawCancel bool
+	first := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		started <- ac.FlapName
+		<-ctx.Done()
+		sawCancel = true
+		return nil, ctx.Err()
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, "none"), "chain")
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := w.Run(ctx, id)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	<-started
+	cancel()
+
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarStopped) {
+		t.Fatalf("expect ErrSoarStopped, got %v", err)
+	}
+	// 被中断的 a 放回就绪队列, 再次运行时重新执行
+	if !sawCancel || result.Flaps["a"].State == core.FlapStateFailed {
+		t.Errorf("expect a to be interrupted without failing, got %s", result.Flaps["a"].State)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	w, _ := newWyvern(t)
+	started := make(chan string, 1)
+	first := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		started <- ac.FlapName
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, "none"), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	if err := w.Cancel(id); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarCancelled) || result.Status != core.SoarStatusCancelled {
+		t.Fatalf("expect cancelled, got %v (%s)", err, result.Status)
+	}
+	for _, op := range []func(string) error{w.Pause, w.Resume, w.Cancel} {
+		if err = op(id); !errors.Is(err, core.ErrSoarFinished) {
+			t.Errorf("expect ErrSoarFinished after cancel, got %v", err)
+		}
+	}
+	if err = w.Pause("nope"); !errors.Is(err, core.ErrSoarNotFound) {
+		t.Errorf("expect ErrSoarNotFound, got %v", err)
+	}
+}
+
+func TestCancelWaitsForRunningFlaps(t *testing.T) {
+	w, s := newWyvern(t)
+	started, release := make(chan string, 1), make(chan struct{})
+	// a 忽略取消信号, 在取消之后才成功返回
+	first := behave(t, gated(started, release))
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, "none"), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	if err := w.Cancel(id); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	select {
+	case <-h.Done():
+		t.Fatal("run finished while a was still running")
+	case <-time.After(30 * time.Millisecond):
+	}
+	close(release)
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarCancelled) {
+		t.Fatalf("expect ErrSoarCancelled, got %v", err)
+	}
+	if state := result.Flaps["a"].State; state != core.FlapStateSuccess {
+		t.Fatalf("expect a to finish after cancel, got %s", state)
+	}
+
+	// 取消后结束的 Flap 也写入了 Store
+	if got := storedFlap(t, s, id, "a").State; got != core.FlapStateSuccess {
+		t.Errorf("expect a to be stored as succeeded, got %s", got)
+	}
+	if got := storedFlap(t, s, id, "b").State; got == core.FlapStateSuccess || got == core.FlapStateInProgress {
+		t.Errorf("b must not be dispatched after cancel, got %s", got)
+	}
+	probe := &core.Soar{}
+	if err = s.LoadSoar(probe, id); err != nil || probe.Status() != core.SoarStatusCancelled {
+		t.Errorf("expect cancelled soar in store, got %s (%v)", probe.Status(), err)
+	}
+}
+
+func TestRunResult(t *testing.T) {
+	w, _ := newWyvern(t)
+	fail := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return &flaps.ActionResult{Output: map[string]any{"partial": true}}, errors.New("boom")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: result
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: ok}}
+      - {name: b, plugin: test, pluginConfig: {key: %q}, prevFlaps: [a]}
+      - {name: c, plugin: test, pluginConfig: {key: ok}, prevFlaps: [b]}
+`, fail), "result")
+	h := mustRun(t, w, id)
+
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrSoarFailed) {
+		t.Fatalf("expect ErrSoarFailed, got %v", err)
+	}
+	if result.SoarID != id || result.Status != core.SoarStatusFailed || result.FailedFlap != "b" || result.Err == nil {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(result.Flaps) != 3 {
+		t.Fatalf("expect 3 flaps in result, got %d", len(result.Flaps))
+	}
+	if a := result.Flaps["a"]; a.State != core.FlapStateSuccess || a.Name != "a" || a.ID == "" {
+		t.Errorf("unexpected result of a %+v", a)
+	}
+	if c := result.Flaps["c"]; c.State == core.FlapStateSuccess || c.State == core.FlapStateFailed {
+		t.Errorf("c must not run, got %s", c.State)
+	}
+}
@@ -0,0 +1,376 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// IncludeKey 配置中引用其他文件的字段, 值为相对当前文件的路径或路径列表
+	// 映射中的 include 将引用文件中的映射合并到当前映射, 当前映射中的字段优先
+	// 列表中只包含 include 的元素会被替换为引用文件中的列表的所有元素
+	// include 只在配置的结构位置生效: 文档的根节点、Soar 和 Flap 的配置, 以及 soars 和 flaps 列表的元素;
+	// 插件配置等其他位置中的 include 是普通的字段, 原样交给插件
+	IncludeKey = "include"
+)
+
+// includeScope 可以 include 的结构位置, 决定映射中哪些列表字段的元素还可以 include
+type includeScope int
+
+const (
+	// includeRoot 文档的根节点, 可以是 Wyvern 配置或单个 Soar 的配置
+	includeRoot includeScope = iota
+	// includeSoar Soar 的配置
+	includeSoar
+	// includeFlap Flap 的配置
+	includeFlap
+)
+
+// includeLists 各结构位置中元素可以 include 的列表字段, value 为列表元素的结构位置
+var includeLists = map[includeScope]map[string]includeScope{
+	includeRoot: {"soars": includeSoar, "flaps": includeFlap},
+	includeSoar: {"flaps": includeFlap},
+}
+
+var (
+	// ErrIncludeCycle 表示配置文件之间循环 include
+	ErrIncludeCycle = errors.New("include cycle")
+	// ErrInvalidInclude 表示 include 的值或引用文件的内容无法合并到当前位置
+	ErrInvalidInclude = errors.New("invalid include")
+	// ErrEnvNotSet 表示配置中引用的环境变量未设置且没有默认值
+	ErrEnvNotSet = errors.New("environment variable not set")
+
+	// envPattern 匹配 ${NAME} 和 ${NAME:-default}, 以 $$ 开头时表示转义, 不会与 ${{ }} 模板表达式冲突
+	envPattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+	// configExts 从目录中加载的配置文件扩展名
+	configExts = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+)
+
+// LoadWyvernConfigFile - 从 YAML 或 JSON 文件中加载 Wyvern 配置, .json 结尾的文件按 JSON 解析
+// 文件可以是包含 soars 的 Wyvern 配置, 也可以是单个 Soar 的配置
+// 加载时处理 include, 并将字符串中的 ${NAME} 和 ${NAME:-default} 替换为环境变量
+func LoadWyvernConfigFile(path string) (*WyvernConfig, error) {
+	conf := WyvernConfig{}
+	if err := newConfigLoader().loadInto(path, &conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// LoadWyvernConfigDir - 加载目录下所有 .yaml .yml .json 文件并合并为一个 Wyvern 配置
+// 文件按文件名顺序加载, 以 . 开头的文件和子目录会被跳过, 可以将 include 的片段放在子目录中
+func LoadWyvernConfigDir(dir string) (*WyvernConfig, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !configExts[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conf := WyvernConfig{}
+	for _, name := range names {
+		if err = newConfigLoader().loadInto(filepath.Join(dir, name), &conf); err != nil {
+			return nil, err
+		}
+	}
+	return &conf, nil
+}
+
+// configLoader 从文件加载配置, 处理 include 和环境变量
+type configLoader struct {
+	// files 每个节点所在的文件, 用于在 ConfigError 中报告位置
+	files map[*yaml.Node]string
+	// stack 正在加载的文件, 用于检测循环 include
+	stack []string
+}
+
+// newConfigLoader 创建 configLoader
+func newConfigLoader() *configLoader {
+	return &configLoader{files: make(map[*yaml.Node]string)}
+}
+
+// loadInto 加载文件并将其中的 Soar 追加到 conf, 空文件不包含任何 Soar
+func (l *configLoader) loadInto(path string, conf *WyvernConfig) error {
+	root, err := l.load(path, includeRoot)
+	if err != nil || root == nil {
+		return err
+	}
+	if err = l.expandEnv(root); err != nil {
+		return err
+	}
+	// 不包含 soars 的文件为单个 Soar 的配置
+	if mappingValue(root, "soars") == nil {
+		soarConf := SoarConfig{}
+		if err = root.Decode(&soarConf); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		soarConf.positions = collectPositions(root, l.files)
+		conf.Soars = append(conf.Soars, soarConf)
+		return nil
+	}
+	fileConf := WyvernConfig{}
+	if err = decodeWyvernConfig(root, l.files, &fileConf); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	conf.Soars = append(conf.Soars, fileConf.Soars...)
+	return nil
+}
+
+// load 解析文件并处理其中的 include, 返回文档的根节点, 空文件返回 nil
+// scope 为文件内容所在的结构位置, 文件内容为列表时是其元素的结构位置
+func (l *configLoader) load(path string, scope includeScope) (*yaml.Node, error) {
+	path = filepath.Clean(path)
+	for i, loading := range l.stack {
+		if loading == path {
+			chain := append(append([]string{}, l.stack[i:]...), path)
+			return nil, fmt.Errorf("%w: %s", ErrIncludeCycle, strings.Join(chain, " -> "))
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err = checkJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	doc := yaml.Node{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	l.mark(root, path)
+
+	l.stack = append(l.stack, path)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+	if err = l.resolve(root, filepath.Dir(path), scope); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// mark 记录 node 及其所有子节点所在的文件
+func (l *configLoader) mark(node *yaml.Node, path string) {
+	l.files[node] = path
+	for _, child := range node.Content {
+		l.mark(child, path)
+	}
+}
+
+// resolve 处理 scope 位置上的 node 及其结构字段中的 include, 引用路径相对 dir
+// node 为列表时, scope 为其元素的结构位置
+func (l *configLoader) resolve(node *yaml.Node, dir string, scope includeScope) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		// 不包含 include 的字段
+		content := make([]*yaml.Node, 0, len(node.Content))
+		var include *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == IncludeKey {
+				include = node.Content[i+1]
+				continue
+			}
+			// 只有结构位置的列表字段继续处理, 其他字段中的 include 保持原样
+			if itemScope, ok := includeLists[scope][node.Content[i].Value]; ok && node.Content[i+1].Kind == yaml.SequenceNode {
+				if err := l.resolve(node.Content[i+1], dir, itemScope); err != nil {
+					return err
+				}
+			}
+			content = append(content, node.Content[i], node.Content[i+1])
+		}
+		if include == nil {
+			return nil
+		}
+		included, err := l.include(include, dir, scope)
+		if err != nil {
+			return err
+		}
+		merged := make([]*yaml.Node, 0, len(content))
+		for _, fragment := range included {
+			if fragment.Kind != yaml.MappingNode {
+				return l.includeError(include, "a mapping can only include mappings")
+			}
+			merged = mergeMapping(merged, fragment.Content)
+		}
+		node.Content = mergeMapping(merged, content)
+	case yaml.SequenceNode:
+		content := make([]*yaml.Node, 0, len(node.Content))
+		for _, item := range node.Content {
+			// 只包含 include 的元素展开为引用文件中的元素
+			if item.Kind == yaml.MappingNode && len(item.Content) == 2 && item.Content[0].Value == IncludeKey {
+				included, err := l.include(item.Content[1], dir, scope)
+				if err != nil {
+					return err
+				}
+				for _, fragment := range included {
+					if fragment.Kind == yaml.SequenceNode {
+						content = append(content, fragment.Content...)
+					} else {
+						content = append(content, fragment)
+					}
+				}
+				continue
+			}
+			if err := l.resolve(item, dir, scope); err != nil {
+				return err
+			}
+			content = append(content, item)
+		}
+		node.Content = content
+	}
+	return nil
+}
+
+// include 加载 include 的值引用的所有文件, 值为字符串或字符串列表, 空文件会被忽略
+// 引用文件的内容位于 scope 所在的结构位置
+func (l *configLoader) include(value *yaml.Node, dir string, scope includeScope) ([]*yaml.Node, error) {
+	paths := make([]*yaml.Node, 0, 1)
+	switch value.Kind {
+	case yaml.ScalarNode:
+		paths = append(paths, value)
+	case yaml.SequenceNode:
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, l.includeError(item, "path must be a string")
+			}
+			paths = append(paths, item)
+		}
+	default:
+		return nil, l.includeError(value, "value must be a path or a list of paths")
+	}
+
+	included := make([]*yaml.Node, 0, len(paths))
+	for _, pathNode := range paths {
+		path, err := l.expandString(pathNode)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		root, err := l.load(path, scope)
+		if err != nil {
+			return nil, err
+		}
+		if root != nil {
+			included = append(included, root)
+		}
+	}
+	return included, nil
+}
+
+// includeError 创建带有 node 位置的 ErrInvalidInclude
+func (l *configLoader) includeError(node *yaml.Node, msg string) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidInclude, l.position(node), msg)
+}
+
+// position 返回 node 的位置
+func (l *configLoader) position(node *yaml.Node) position {
+	return position{file: l.files[node], line: node.Line, column: node.Column}
+}
+
+// expandEnv 替换 node 下所有字符串值中的环境变量, 映射的字段名保持不变
+func (l *configLoader) expandEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := l.expandString(node)
+		if err != nil {
+			return err
+		}
+		if value != node.Value {
+			node.Value = value
+			// 未加引号的值按替换后的内容重新判断类型, 例如 ${PARALLELISM:-4} 替换为整数
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := l.expandEnv(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := l.expandEnv(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandString 返回标量节点替换环境变量后的值
+// ${NAME} 替换为环境变量 NAME 的值, ${NAME:-default} 在 NAME 未设置或为空时替换为 default, $${NAME} 替换为 ${NAME}
+func (l *configLoader) expandString(node *yaml.Node) (string, error) {
+	var err error
+	value := envPattern.ReplaceAllStringFunc(node.Value, func(match string) string {
+		sub := envPattern.FindStringSubmatch(match)
+		if sub[1] != "" {
+			return match[1:]
+		}
+		name, hasDefault := sub[2], strings.Contains(match, ":-")
+		if v, ok := os.LookupEnv(name); ok && (v != "" || !hasDefault) {
+			return v
+		}
+		if hasDefault {
+			return sub[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: %s: %s", ErrEnvNotSet, l.position(node), name)
+		}
+		return match
+	})
+	return value, err
+}
+
+// mergeMapping 将映射的字段 override 合并到 base, 同名字段使用 override 中的值
+func mergeMapping(base, override []*yaml.Node) []*yaml.Node {
+	merged := append([]*yaml.Node{}, base...)
+	for i := 0; i+1 < len(override); i += 2 {
+		replaced := false
+		for j := 0; j+1 < len(merged); j += 2 {
+			if merged[j].Value == override[i].Value {
+				merged[j+1] = override[i+1]
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, override[i], override[i+1])
+		}
+	}
+	return merged
+}
+
+// checkJSON 检查文本是否为合法的 JSON, 返回带有行号的错误
+func checkJSON(data []byte) error {
+	err := json.Unmarshal(data, new(any))
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+		return fmt.Errorf("invalid json at line %d: %w", line, err)
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package core_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// writeFiles 在临时目录中写入文件, key 为相对路径, 返回目录
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": `
+soars:
+  - include: soars/a.yaml
+  - include: [soars/more.yaml]
+`,
+		"soars/a.yaml": `
+include: ../common/soar.yaml
+name: a
+flaps:
+  - include: ../common/flaps.yaml
+  - include: ../common/flap.yaml
+    name: own
+  - name: plain
+    plugin: test
+    pluginConfig:
+      key: none
+      include: kept/as/is.yaml
+      nested: [{include: also/kept.yaml}]
+`,
+		"soars/more.yaml": `
+- {name: b, flaps: [{name: x, plugin: test, pluginConfig: {key: none}}]}
+- {name: c, flaps: [{name: y, plugin: test, pluginConfig: {key: none}}]}
+`,
+		"common/soar.yaml": `
+name: overridden
+maxParallelism: 2
+`,
+		"common/flaps.yaml": `
+- {name: f1, plugin: test, pluginConfig: {key: none}}
+- {name: f2, plugin: test, pluginConfig: {key: none}, prevFlaps: [f1]}
+`,
+		"common/flap.yaml": `
+name: template
+plugin: test
+pluginConfig: {key: shared}
+`,
+	})
+
+	conf, err := core.LoadWyvernConfigFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("LoadWyvernConfigFile: %v", err)
+	}
+	var names []string
+	for _, soar := range conf.Soars {
+		names = append(names, soar.Name)
+	}
+	if strings.Join(names, ",") != "a,b,c" {
+		t.Fatalf("expect soars a,b,c, got %v", names)
+	}
+	a := conf.Soars[0]
+	if a.MaxParallelism != 2 {
+		t.Errorf("expect maxParallelism from included soar fragment, got %d", a.MaxParallelism)
+	}
+	names = nil
+	for _, flap := range a.Flaps {
+		names = append(names, flap.Name)
+	}
+	if strings.Join(names, ",") != "f1,f2,own,plain" {
+		t.Fatalf("expect flaps f1,f2,own,plain, got %v", names)
+	}
+	if own := a.Flaps[2]; own.Plugin != "test" || own.PluginConfig.(map[string]any)["key"] != "shared" {
+		t.Errorf("expect own to merge the included flap, got %+v", own)
+	}
+	// 插件配置中的 include 不是结构位置, 原样保留
+	plain := a.Flaps[3].PluginConfig.(map[string]any)
+	if plain["include"] != "kept/as/is.yaml" {
+		t.Errorf("expect include in pluginConfig to be kept, got %v", plain)
+	}
+	if nested := plain["nested"].([]any)[0].(map[string]any); nested["include"] != "also/kept.yaml" {
+		t.Errorf("expect include in pluginConfig list to be kept, got %v", nested)
+	}
+}
+
+func TestLoadSingleSoarWithInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"soar.yaml": `
+name: single
+flaps:
+  - include: flaps.yaml
+`,
+		"flaps.yaml": `
+- {name: a, plugin: test, pluginConfig: {key: none}}
+`,
+	})
+	conf, err := core.LoadWyvernConfigFile(filepath.Join(dir, "soar.yaml"))
+	if err != nil {
+		t.Fatalf("LoadWyvernConfigFile: %v", err)
+	}
+	if len(conf.Soars) != 1 || conf.Soars[0].Name != "single" || len(conf.Soars[0].Flaps) != 1 {
+		t.Fatalf("unexpected config %+v", conf.Soars)
+	}
+}
+
+func TestLoadIncludeErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		files map[string]string
+		want  error
+	}{
+		{"cycle", map[string]string{
+			"main.yaml": "soars: [{include: a.yaml}]",
+			"a.yaml":    "include: b.yaml\nname: a",
+			"b.yaml":    "include: a.yaml",
+		}, core.ErrIncludeCycle},
+		{"mapping includes list", map[string]string{
+			"main.yaml": "soars: [{include: a.yaml, name: a}]",
+			"a.yaml":    "- x",
+		}, core.ErrInvalidInclude},
+		{"bad value", map[string]string{
+			"main.yaml": "soars: [{include: {a: b}}]",
+		}, core.ErrInvalidInclude},
+		{"missing file", map[string]string{
+			"main.yaml": "soars: [{include: nope.yaml}]",
+		}, os.ErrNotExist},
+	} {
+		dir := writeFiles(t, c.files)
+		if _, err := core.LoadWyvernConfigFile(filepath.Join(dir, "main.yaml")); !errors.Is(err, c.want) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("WYVERN_TEST_PARALLELISM", "3")
+	t.Setenv("WYVERN_TEST_EMPTY", "")
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": `
+soars:
+  - name: ${WYVERN_TEST_NAME:-env}
+    maxParallelism: ${WYVERN_TEST_PARALLELISM}
+    flaps:
+      - name: a
+        plugin: test
+        pluginConfig: {key: none, empty: "${WYVERN_TEST_EMPTY:-fallback}", escaped: "$${HOME}", tmpl: "${{ inputs.x }}"}
+`,
+		"unset.yaml": "soars:\n  - name: ${WYVERN_TEST_UNSET}\n",
+	})
+	conf, err := core.LoadWyvernConfigFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("LoadWyvernConfigFile: %v", err)
+	}
+	soar := conf.Soars[0]
+	if soar.Name != "env" || soar.MaxParallelism != 3 {
+		t.Errorf("unexpected soar %s with parallelism %d", soar.Name, soar.MaxParallelism)
+	}
+	pc := soar.Flaps[0].PluginConfig.(map[string]any)
+	if pc["empty"] != "fallback" || pc["escaped"] != "${HOME}" || pc["tmpl"] != "${{ inputs.x }}" {
+		t.Errorf("unexpected plugin config %v", pc)
+	}
+	if _, err = core.LoadWyvernConfigFile(filepath.Join(dir, "unset.yaml")); !errors.Is(err, core.ErrEnvNotSet) {
+		t.Errorf("expect ErrEnvNotSet, got %v", err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"b.yaml":          "name: b\nflaps: [{name: x, plugin: test, pluginConfig: {key: none}}]",
+		"a.json":          `{"soars": [{"name": "a", "flaps": [{"name": "x", "plugin": "test", "pluginConfig": {"key": "none"}}]}]}`,
+		".hidden.yaml":    "name: hidden",
+		"README.md":       "not a config",
+		"parts/frag.yaml": "name: fragment",
+	})
+	conf, err := core.LoadWyvernConfigDir(dir)
+	if err != nil {
+		t.Fatalf("LoadWyvernConfigDir: %v", err)
+	}
+	if len(conf.Soars) != 2 || conf.Soars[0].Name != "a" || conf.Soars[1].Name != "b" {
+		t.Fatalf("expect soars a and b in file name order, got %+v", conf.Soars)
+	}
+
+	bad := writeFiles(t, map[string]string{"bad.json": "{\n  \"soars\": [\n}"})
+	if _, err = core.LoadWyvernConfigDir(bad); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expect json error at line 3, got %v", err)
+	}
+}
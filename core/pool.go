@@ -0,0 +1,38 @@
+package core
+
+import "context"
+
+// WorkerPool 限制同时执行 Flap 动作的数量, 由同一个 Wyvern 下的所有 Soar 共享
+type WorkerPool struct {
+	// slots 空闲的执行槽位, 为 nil 时表示不限制并行度
+	slots chan struct{}
+}
+
+// NewWorkerPool 创建一个容量为 size 的 WorkerPool, size 小于等于 0 时不限制并行度
+func NewWorkerPool(size int) *WorkerPool {
+	if size <= 0 {
+		return &WorkerPool{}
+	}
+	return &WorkerPool{slots: make(chan struct{}, size)}
+}
+
+// Acquire 获取一个执行槽位, 槽位用尽时阻塞直到有槽位释放或 ctx 结束
+func (p *WorkerPool) Acquire(ctx context.Context) error {
+	if p == nil || p.slots == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release 释放一个通过 Acquire 获取的执行槽位
+func (p *WorkerPool) Release() {
+	if p == nil || p.slots == nil {
+		return
+	}
+	<-p.slots
+}
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+var (
+	// ErrFlapNotFound - Flap 不存在
+	ErrFlapNotFound = errors.New("flap not found")
+	// ErrRevisionConflict - 写入的记录已被其他写入者修改, 具体信息见 ConflictError
+	ErrRevisionConflict = errors.New("revision conflict")
+)
+
+// ConflictError 写入时记录的 Revision 与 Store 中的不一致, 说明记录在读取后已被其他写入者修改, 本次写入没有生效
+// errors.Is(err, ErrRevisionConflict) 对 ConflictError 成立
+type ConflictError struct {
+	// Kind 记录的类型, 为 "soar" 或 "flap"
+	Kind string
+	ID   ID
+	// Revision 写入时记录携带的 Revision
+	Revision uint64
+	// Current Store 中记录当前的 Revision, 记录不存在时为 0
+	Current uint64
+}
+
+// Error 实现 error
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s %s has revision %d, write is based on %d", ErrRevisionConflict, e.Kind, e.ID, e.Current, e.Revision)
+}
+
+// Is 使 errors.Is(err, ErrRevisionConflict) 成立
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrRevisionConflict
+}
+
+// SoarRecord Soar 的可持久化数据, 只包含纯数据, 可以安全地复制和序列化
+// Revision 是记录在 Store 中被写入的次数, 用于比较并写入, 见 Store
+type SoarRecord struct {
+	ID             ID             `json:"id"`
+	Revision       uint64         `json:"revision,omitempty"`
+	Name           string         `json:"name"`
+	RootFlaps      []ID           `json:"rootFlaps"`
+	FlapIDs        []ID           `json:"flapIDs"`
+	Status         SoarStatus     `json:"status"`
+	Count          int            `json:"count"`
+	Err            string         `json:"err,omitempty"`
+	MaxParallelism int            `json:"maxParallelism,omitempty"`
+	Timeout        flaps.Duration `json:"timeout,omitempty"`
+	ParentID       ID             `json:"parentID,omitempty"`
+	ParentFlapID   ID             `json:"parentFlapID,omitempty"`
+	InputDecls     []InputConfig  `json:"inputDecls,omitempty"`
+	Inputs         map[string]any `json:"inputs,omitempty"`
+	InputsBound    bool           `json:"inputsBound,omitempty"`
+}
+
+// FlapRecord Flap 的可持久化数据, 只包含纯数据, 可以安全地复制和序列化
+// 插件名和原始配置用于在恢复时重新实例化 Action
+type FlapRecord struct {
+	ID                ID                      `json:"id"`
+	Revision          uint64                  `json:"revision,omitempty"`
+	SoarID            ID                      `json:"soarID"`
+	ConfName          string                  `json:"confName"`
+	PrevFlaps         []ID                    `json:"prevFlaps"`
+	NextFlaps         []ID                    `json:"nextFlaps"`
+	State             FlapStatus              `json:"state"`
+	Start             time.Time               `json:"start"`
+	NextAwakeTime     *time.Time              `json:"nextAwakeTime,omitempty"`
+	AttemptRetryCount int                     `json:"attemptRetryCount"`
+	Output            map[string]any          `json:"output,omitempty"`
+	Err               string                  `json:"err,omitempty"`
+	Plugin            string                  `json:"plugin"`
+	PluginConfig      any                     `json:"pluginConfig,omitempty"`
+	Conditions        []string                `json:"conditions,omitempty"`
+	Retry             *flaps.RetryPolicy      `json:"retry,omitempty"`
+	Timeout           flaps.Duration          `json:"timeout,omitempty"`
+	Compensate        *flaps.CompensateConfig `json:"compensate,omitempty"`
+	Compensation      CompensationStatus      `json:"compensation,omitempty"`
+	CompensationErr   string                  `json:"compensationErr,omitempty"`
+}
+
+// Record 生成 Soar 的可持久化数据
+func (soar *Soar) Record() SoarRecord {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	rec := SoarRecord{
+		ID:             soar.id,
+		Revision:       soar.revision,
+		Name:           soar.name,
+		RootFlaps:      append([]ID(nil), soar.RootFlaps...),
+		Status:         soar.status,
+		Count:          soar.count,
+		Err:            errString(soar.err),
+		MaxParallelism: soar.maxParallelism,
+		Timeout:        flaps.Duration(soar.timeout),
+		ParentID:       soar.parentID,
+		ParentFlapID:   soar.parentFlap,
+		InputDecls:     cloneInputDecls(soar.inputDecls),
+		Inputs:         cloneMap(soar.inputs),
+		InputsBound:    soar.inputsBound,
+	}
+	if soar.IFlapIndex != nil {
+		rec.FlapIDs = soar.IFlapIndex.ListAllFlapID()
+	}
+	return rec
+}
+
+// ApplyRecord 使用持久化数据覆盖 Soar 的数据, 不会创建 Flap, 也不会改变 Soar 的索引
+func (soar *Soar) ApplyRecord(rec SoarRecord) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	soar.init()
+	soar.id = rec.ID
+	soar.revision = rec.Revision
+	soar.name = rec.Name
+	soar.RootFlaps = append([]ID(nil), rec.RootFlaps...)
+	soar.status = rec.Status
+	soar.count = rec.Count
+	soar.err = stringError(rec.Err)
+	soar.maxParallelism = rec.MaxParallelism
+	soar.timeout = rec.Timeout.Std()
+	soar.parentID, soar.parentFlap = rec.ParentID, rec.ParentFlapID
+	soar.inputDecls = cloneInputDecls(rec.InputDecls)
+	soar.inputs = normalizeInputs(rec.InputDecls, rec.Inputs)
+	// 没有 InputsBound 的旧记录中, 保存了运行参数的 Soar 已经绑定
+	soar.inputsBound = rec.InputsBound || len(rec.Inputs) > 0
+}
+
+// Record 生成 Flap 的可持久化数据, 调用方需保证 Flap 没有被并发修改
+func (f *Flap) Record() FlapRecord {
+	rec := FlapRecord{
+		ID:                f.ID,
+		Revision:          f.revision,
+		SoarID:            f.SoarID,
+		ConfName:          f.ConfName,
+		PrevFlaps:         append([]ID(nil), f.PrevFlaps...),
+		NextFlaps:         append([]ID(nil), f.NextFlaps...),
+		State:             f.State,
+		Start:             f.Start,
+		AttemptRetryCount: f.AttemptRetryCount,
+		Output:            cloneMap(f.Output),
+		Err:               errString(f.Err),
+		Plugin:            f.Plugin,
+		PluginConfig:      cloneValue(f.PluginConfig),
+		Retry:             f.retry,
+		Timeout:           flaps.Duration(f.timeout),
+		Compensate:        f.compensate,
+		Compensation:      f.Compensation,
+		CompensationErr:   errString(f.CompensationErr),
+	}
+	if f.NextAwakeTime != nil {
+		t := *f.NextAwakeTime
+		rec.NextAwakeTime = &t
+	}
+	for _, p := range f.conditions {
+		rec.Conditions = append(rec.Conditions, p.String())
+	}
+	return rec
+}
+
+// ApplyRecord 使用持久化数据覆盖 Flap 的数据, 并重新编译启动条件
+// 不会实例化 Action 和补偿动作, 需要时由调用方根据 Plugin 和 PluginConfig 重新创建
+func (f *Flap) ApplyRecord(rec FlapRecord) error {
+	conditions, err := compileConditions(rec.ConfName, rec.Conditions)
+	if err != nil {
+		return err
+	}
+	f.ID = rec.ID
+	f.revision = rec.Revision
+	f.SoarID = rec.SoarID
+	f.ConfName = rec.ConfName
+	f.PrevFlaps = append([]ID(nil), rec.PrevFlaps...)
+	f.NextFlaps = append([]ID(nil), rec.NextFlaps...)
+	f.State = rec.State
+	f.Start = rec.Start
+	f.NextAwakeTime = nil
+	if rec.NextAwakeTime != nil {
+		t := *rec.NextAwakeTime
+		f.NextAwakeTime = &t
+	}
+	f.AttemptRetryCount = rec.AttemptRetryCount
+	f.Output = cloneMap(rec.Output)
+	f.Err = stringError(rec.Err)
+	f.Plugin = rec.Plugin
+	f.PluginConfig = cloneValue(rec.PluginConfig)
+	f.conditions = conditions
+	f.retry = rec.Retry
+	f.timeout = rec.Timeout.Std()
+	f.compensate = rec.Compensate
+	f.Compensation = rec.Compensation
+	f.CompensationErr = stringError(rec.CompensationErr)
+	return nil
+}
+
+// NewFlapFromRecord 从持久化数据创建 Flap, 创建的 Flap 没有 Action, 需要通过 NewFlapIDTable 建立索引
+func NewFlapFromRecord(rec FlapRecord) (*Flap, error) {
+	f := &Flap{}
+	if err := f.ApplyRecord(rec); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewFlapIDTable 使用 flaps 创建索引, 并将每个 Flap 的索引指向该表
+func NewFlapIDTable(flaps ...*Flap) *FlapIDTable {
+	table := make(FlapIDTable, len(flaps))
+	for _, f := range flaps {
+		table[f.ID] = f
+		f.index = &table
+	}
+	return &table
+}
+
+// Clone 深拷贝 SoarRecord
+func (rec SoarRecord) Clone() SoarRecord {
+	rec.RootFlaps = append([]ID(nil), rec.RootFlaps...)
+	rec.FlapIDs = append([]ID(nil), rec.FlapIDs...)
+	rec.InputDecls = cloneInputDecls(rec.InputDecls)
+	rec.Inputs = cloneMap(rec.Inputs)
+	return rec
+}
+
+// Clone 深拷贝 FlapRecord
+func (rec FlapRecord) Clone() FlapRecord {
+	rec.PrevFlaps = append([]ID(nil), rec.PrevFlaps...)
+	rec.NextFlaps = append([]ID(nil), rec.NextFlaps...)
+	if rec.NextAwakeTime != nil {
+		t := *rec.NextAwakeTime
+		rec.NextAwakeTime = &t
+	}
+	rec.Output = cloneMap(rec.Output)
+	rec.PluginConfig = cloneValue(rec.PluginConfig)
+	rec.Conditions = append([]string(nil), rec.Conditions...)
+	return rec
+}
+
+// cloneInputDecls 深拷贝运行参数的声明
+func cloneInputDecls(decls []InputConfig) []InputConfig {
+	if decls == nil {
+		return nil
+	}
+	ret := make([]InputConfig, len(decls))
+	for i, decl := range decls {
+		decl.Default = cloneValue(decl.Default)
+		decl.Enum = cloneValue(decl.Enum).([]any)
+		ret[i] = decl
+	}
+	return ret
+}
+
+// errString 将错误转换为字符串, nil 转换为空字符串
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// stringError 将字符串转换为错误, 空字符串转换为 nil
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+// cloneMap 深拷贝 map[string]any
+func cloneMap(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	return cloneValue(m).(map[string]any)
+}
+
+// cloneValue 深拷贝由 map[string]any 和 []any 组成的配置或输出
+func cloneValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(val))
+		for k, item := range val {
+			ret[k] = cloneValue(item)
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(val))
+		for i, item := range val {
+			ret[i] = cloneValue(item)
+		}
+		return ret
+	}
+	return v
+}
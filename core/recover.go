@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrFlapInterrupted 表示 Flap 执行时所在的实例退出, 按 RecoverFail 策略恢复时被置为失败
+	ErrFlapInterrupted = errors.New("flap is interrupted")
+	// ErrSoarRecover 表示 Recover 时有 Soar 未能恢复
+	ErrSoarRecover = errors.New("failed to recover soar")
+)
+
+// RecoverPolicy 恢复 Soar 时处理中断前可能正在执行的 Flap (状态为执行中或等待重试) 的策略
+type RecoverPolicy int
+
+const (
+	// RecoverRetry 保留 Flap 的状态和重试次数, 重新执行被中断的尝试, 适用于幂等的动作
+	RecoverRetry RecoverPolicy = iota
+	// RecoverRestart 将 Flap 重置为等待状态并清空重试次数和错误, 从头开始执行
+	RecoverRestart
+	// RecoverFail 将 Flap 置为失败, Soar 随之失败并执行补偿, 适用于不能重复执行的动作
+	RecoverFail
+)
+
+// RestoreSoar 从 Store 恢复指定 ID 的 Soar: 加载 Soar 的数据, 重建 Flap 的索引,
+// 并通过插件注册表使用每个 Flap 持久化的插件名和原始配置重新实例化 Action 和补偿动作
+// 恢复的 Soar 保持持久化时的状态, 之后的状态变化会继续写入 store
+func RestoreSoar(id ID, store Store) (*Soar, error) {
+	soar := &Soar{store: store}
+	if err := store.LoadSoar(soar, id); err != nil {
+		return nil, err
+	}
+	table, err := store.Rebuild(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, flapID := range table.ListAllFlapID() {
+		flap := table.GetFlap(flapID)
+		flap.inputs = soar.inputs
+		if flap.Action, err = flap.makeActions(flap.inputs); err != nil {
+			return nil, fmt.Errorf("restore flap %s: %w", flap.ConfName, err)
+		}
+		flap.onUpdate = soar.onFlapUpdate
+	}
+	soar.IFlapIndex = table
+	soar.init()
+	return soar, nil
+}
+
+// resetInterrupted 按策略处理中断前可能正在执行的 Flap, 只能在 Soar 运行前调用
+func (soar *Soar) resetInterrupted(policy RecoverPolicy) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	for _, flapID := range soar.IFlapIndex.ListAllFlapID() {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		if flap.State != FlapStateInProgress && flap.State != FlapStatusErrorAndRetry {
+			continue
+		}
+		switch policy {
+		case RecoverRestart:
+			flap.AttemptRetryCount, flap.NextAwakeTime, flap.Err, flap.Output = 0, nil, nil, nil
+			flap.UpdateStatus(FlapStateWait, nil)
+		case RecoverFail:
+			flap.Err = ErrFlapInterrupted
+			flap.UpdateStatus(FlapStateFailed, nil)
+		}
+	}
+}
+
+// SetRecoverPolicy 设置 Recover 时处理中断 Flap 的策略, 默认为 RecoverRetry
+func (w *Wyvern) SetRecoverPolicy(policy RecoverPolicy) {
+	w.recoverPolicy = policy
+}
+
+// Recover 从 Store 恢复所有未结束且未在当前实例上加载的 Soar, 并继续运行, 返回恢复运行的 Soar 的句柄
+// 暂停的 Soar 恢复后保持暂停; 尚未开始运行的 Soar 只加载不运行
+// 设置了租约时只恢复能获取到租约的 Soar, 当前实例上尚未运行但已在其他实例上开始运行的 Soar 会被重新加载
+// 没有设置租约时无法判断 Soar 是否仍在其他实例上运行, 按 RecoverRetry 恢复时被中断的尝试可能与原实例重复执行,
+// 此后两个实例的写入会发生冲突, 写入冲突的一方停止运行
+// 父 Soar 在当前实例上未结束的子 Soar 只加载不运行, 由父 Soar 的子 Soar 插件继续运行
+// 某个 Soar 恢复失败时继续恢复其他 Soar, 最后返回包装了所有失败原因的 ErrSoarRecover; Wyvern 已经关闭时返回 ErrWyvernClosed
+func (w *Wyvern) Recover(ctx context.Context) ([]*RunHandle, error) {
+	if w.isClosed() {
+		return nil, ErrWyvernClosed
+	}
+	soarIDs, err := w.Store.ListSoars()
+	if err != nil {
+		return nil, err
+	}
+	var handles []*RunHandle
+	var runnable []*Soar
+	var failures []string
+	for _, soarID := range soarIDs {
+		local, loaded := w.GetSoar(soarID)
+		if loaded && (w.lease == nil || local.Status() != SoarStatusPending) {
+			continue
+		}
+		// 先只加载 Soar 的数据, 跳过已结束的 Soar, 避免重建其所有 Flap
+		probe := &Soar{}
+		if err = w.Store.LoadSoar(probe, soarID); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", soarID, err))
+			continue
+		}
+		// 当前实例上尚未运行的 Soar 在其他实例上结束时也重新加载, 避免再次运行
+		if status := probe.Status(); !loaded && status.IsFinished() || loaded && status == SoarStatusPending {
+			continue
+		}
+		// 尚未开始运行的 Soar 在 Run 时获取租约
+		if probe.Status() != SoarStatusPending {
+			ok, err := w.acquireLease(soarID)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", soarID, err))
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		soar, err := RestoreSoar(soarID, w.Store)
+		if err != nil {
+			w.releaseLease(soarID)
+			failures = append(failures, fmt.Sprintf("%s: %s", soarID, err))
+			continue
+		}
+		soar.resetInterrupted(w.recoverPolicy)
+		w.addSoar(soar)
+		switch soar.Status() {
+		case SoarStatusPending:
+			continue
+		case SoarStatusCancelled, SoarStatusSucceeded, SoarStatusFailed:
+			// 已在其他实例上结束
+			w.releaseLease(soarID)
+			continue
+		}
+		runnable = append(runnable, soar)
+	}
+	// 全部加载后再运行, 使父 Soar 重新执行的子 Soar 插件能找到已恢复的子 Soar
+	for _, soar := range runnable {
+		// 父 Soar 在当前实例上运行时, 子 Soar 由父 Soar 的 Flap 继续运行
+		if parent, ok := w.GetSoar(soar.parentID); ok && soar.parentID != "" && !parent.Status().IsFinished() {
+			continue
+		}
+		handle, err := w.start(ctx, soar)
+		if err != nil {
+			// Recover 期间 Wyvern 被关闭, 未运行的 Soar 留给之后的 Recover
+			w.releaseLease(soar.id)
+			return handles, err
+		}
+		handles = append(handles, handle)
+	}
+	if len(failures) > 0 {
+		return handles, fmt.Errorf("%w: %s", ErrSoarRecover, strings.Join(failures, "; "))
+	}
+	return handles, nil
+}
@@ -0,0 +1,166 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+func TestRecover(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy core.RecoverPolicy
+		// wantErr 为 nil 时 b 在恢复后重新执行并成功
+		wantErr     error
+		wantAttempt int
+	}{
+		{"retry", core.RecoverRetry, nil, 1},
+		{"restart", core.RecoverRestart, nil, 0},
+		{"fail", core.RecoverFail, core.ErrFlapInterrupted, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w, s := newWyvern(t)
+			crashed := make(chan struct{})
+			t.Cleanup(func() { close(crashed) })
+			entered := make(chan struct{}, 1)
+			var calls, attempt int32
+			b := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+				// 第一次执行失败, 重试时停在执行中, 模拟实例在执行中途退出
+				switch atomic.AddInt32(&calls, 1) {
+				case 1:
+					return nil, errors.New("flaky")
+				case 2:
+					entered <- struct{}{}
+					<-crashed
+					return nil, errors.New("crashed")
+				}
+				atomic.StoreInt32(&attempt, int32(ac.Attempt))
+				return &flaps.ActionResult{}, nil
+			})
+			id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: crash
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: none}}
+      - name: b
+        plugin: test
+        pluginConfig: {key: %q}
+        prevFlaps: [a]
+        retry: {maxAttempts: 3, delay: 1ms}
+`, b), "crash")
+			mustRun(t, w, id)
+			<-entered
+			// 重试派发前写入了执行中的状态
+			if b := storedFlap(t, s, id, "b"); b.State != core.FlapStateInProgress || b.AttemptRetryCount != 1 {
+				t.Fatalf("expect b in progress with 1 retry in store, got %s with %d", b.State, b.AttemptRetryCount)
+			}
+
+			w2 := core.NewWyvern(s)
+			w2.SetRecoverPolicy(c.policy)
+			handles, err := w2.Recover(context.Background())
+			if err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+			if len(handles) != 1 {
+				t.Fatalf("expect 1 recovered soar, got %d", len(handles))
+			}
+			result, err := waitRun(t, handles[0])
+			if c.wantErr != nil {
+				if !errors.Is(err, core.ErrSoarFailed) || !errors.Is(result.Err, c.wantErr) {
+					t.Fatalf("expect %v, got %v (%v)", c.wantErr, err, result.Err)
+				}
+				if n := atomic.LoadInt32(&calls); n != 2 {
+					t.Errorf("expect interrupted flap not to run again, got %d calls", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("recovered run: %v", err)
+			}
+			if n := atomic.LoadInt32(&calls); n != 3 {
+				t.Errorf("expect b to run again after recover, got %d calls", n)
+			}
+			if got := atomic.LoadInt32(&attempt); int(got) != c.wantAttempt {
+				t.Errorf("expect attempt %d after recover, got %d", c.wantAttempt, got)
+			}
+			if result.Flaps["a"].State != core.FlapStateSuccess {
+				t.Errorf("expect a to keep its state, got %s", result.Flaps["a"].State)
+			}
+		})
+	}
+}
+
+func TestRecoverSkipsFinishedAndPending(t *testing.T) {
+	w, s := newWyvern(t)
+	done := mustLoad(t, w, fmt.Sprintf(chainYAML, "none", "none"), "chain")
+	if _, err := waitRun(t, mustRun(t, w, done)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	pending := mustLoad(t, w, fmt.Sprintf(chainYAML, "none", "none"), "chain")
+
+	w2 := core.NewWyvern(s)
+	handles, err := w2.Recover(context.Background())
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if len(handles) != 0 {
+		t.Errorf("expect nothing to run, got %d handles", len(handles))
+	}
+	// 尚未开始运行的 Soar 只加载不运行
+	if _, ok := w2.GetSoar(pending); !ok {
+		t.Errorf("expect pending soar to be loaded")
+	}
+	if _, ok := w2.GetSoar(done); ok {
+		t.Errorf("expect finished soar not to be loaded")
+	}
+}
+
+func TestRecoveredDispatchFencesStaleInstance(t *testing.T) {
+	w, s := newWyvern(t)
+	started := make(chan string, 2)
+	release1, release2 := make(chan struct{}), make(chan struct{})
+	var calls int32
+	a := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		started <- ac.FlapName
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release1
+		} else {
+			<-release2
+		}
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, a, "none"), "chain")
+	h := mustRun(t, w, id)
+	<-started
+	revision := storedFlap(t, s, id, "a").Revision
+
+	// 没有租约时另一个实例按 RecoverRetry 重新执行 a, 派发前的认领增加了 Revision
+	w2 := core.NewWyvern(s)
+	handles, err := w2.Recover(context.Background())
+	if err != nil || len(handles) != 1 {
+		t.Fatalf("Recover: expect 1 handle, got %d (%v)", len(handles), err)
+	}
+	<-started
+	if got := storedFlap(t, s, id, "a").Revision; got != revision+1 {
+		t.Fatalf("expect claim to bump revision to %d, got %d", revision+1, got)
+	}
+
+	// 原实例的执行结束后写入冲突, 在原实例上停止运行
+	close(release1)
+	result, err := waitRun(t, h)
+	if !errors.Is(err, core.ErrRevisionConflict) && !errors.Is(result.Err, core.ErrRevisionConflict) {
+		t.Fatalf("expect stale instance to be fenced, got %v (%v)", err, result.Err)
+	}
+	close(release2)
+	if _, err = waitRun(t, handles[0]); err != nil {
+		t.Fatalf("recovered run: %v", err)
+	}
+	if state := storedFlap(t, s, id, "c").State; state != core.FlapStateSuccess {
+		t.Errorf("expect recovered instance to finish, got c %s", state)
+	}
+}
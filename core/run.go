@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrSoarCancelled 表示 Soar 被取消
+	ErrSoarCancelled = errors.New("soar is cancelled")
+	// ErrSoarStopped 表示 Soar 在结束前被停止, 可以再次运行或在其他实例上恢复
+	ErrSoarStopped = errors.New("soar is stopped before finished")
+	// ErrSoarFailed 表示 Soar 中存在失败的 Flap, 或因 Soar 级别的错误失败
+	ErrSoarFailed = errors.New("soar is failed")
+	// ErrSoarTimeout 表示 Soar 的一次运行超过了配置的 timeout
+	ErrSoarTimeout = errors.New("soar run timed out")
+)
+
+// FlapResult 一次运行结束时单个 Flap 的最终状态
+type FlapResult struct {
+	// Flap ID
+	ID ID
+	// Flap 配置名
+	Name string
+	// 最终状态
+	State FlapStatus
+	// 重试次数
+	Attempts int
+	// Flap 的输出
+	Output map[string]any
+	// 最近一次执行失败的错误
+	Err error
+	// 补偿动作的执行状态
+	Compensation CompensationStatus
+	// 补偿动作失败的错误
+	CompensationErr error
+}
+
+// RunResult 一次运行的结果
+type RunResult struct {
+	// Soar ID
+	SoarID ID
+	// 运行结束时 Soar 的状态
+	Status SoarStatus
+	// 所有 Flap 的最终状态, key 为 Flap 配置名
+	Flaps map[string]FlapResult
+	// 导致 Soar 失败的 Flap 配置名, Soar 未失败或因 Soar 级别的错误失败时为空
+	FailedFlap string
+	// 导致 Soar 失败的错误, 或导致 Soar 在当前实例上停止运行的原因 (失去租约或写入冲突)
+	Err error
+}
+
+// RunHandle 一次运行的句柄, 用于等待运行结束并获取结果
+type RunHandle struct {
+	soarID ID
+	done   chan struct{}
+	result RunResult
+}
+
+// newRunHandle 创建一个尚未结束的 RunHandle
+func newRunHandle(soarID ID) *RunHandle {
+	return &RunHandle{soarID: soarID, done: make(chan struct{})}
+}
+
+// SoarID 返回运行的 Soar 的 ID
+func (h *RunHandle) SoarID() ID {
+	return h.soarID
+}
+
+// Done 返回一个在运行结束时关闭的 channel
+func (h *RunHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait 等待运行结束并返回结果, ctx 先结束时返回 ctx 的错误
+// Soar 成功时 error 为 nil; 失败时返回包装了失败 Flap 错误的 ErrSoarFailed;
+// 被取消或停止时分别返回 ErrSoarCancelled 和 ErrSoarStopped; 因失去租约或写入冲突停止时, 结果的 Err 记录了原因
+func (h *RunHandle) Wait(ctx context.Context) (RunResult, error) {
+	select {
+	case <-ctx.Done():
+		return RunResult{}, ctx.Err()
+	case <-h.done:
+	}
+	switch h.result.Status {
+	case SoarStatusSucceeded:
+		return h.result, nil
+	case SoarStatusFailed:
+		if h.result.FailedFlap == "" {
+			return h.result, fmt.Errorf("%w: %v", ErrSoarFailed, h.result.Err)
+		}
+		return h.result, fmt.Errorf("%w: flap %s: %v", ErrSoarFailed, h.result.FailedFlap, h.result.Err)
+	case SoarStatusCancelled:
+		return h.result, ErrSoarCancelled
+	}
+	return h.result, ErrSoarStopped
+}
+
+// complete 记录运行结果并关闭 done
+func (h *RunHandle) complete(result RunResult) {
+	h.result = result
+	close(h.done)
+}
+
+// result 汇总当前所有 Flap 的状态, 调用方需持有 soar.lock
+func (soar *Soar) result() RunResult {
+	flapIDs := soar.IFlapIndex.ListAllFlapID()
+	result := RunResult{
+		SoarID: soar.id,
+		Status: soar.status,
+		Flaps:  make(map[string]FlapResult, len(flapIDs)),
+		Err:    soar.err,
+	}
+	for _, flapID := range flapIDs {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		result.Flaps[flap.ConfName] = FlapResult{
+			ID:              flap.ID,
+			Name:            flap.ConfName,
+			State:           flap.State,
+			Attempts:        flap.AttemptRetryCount,
+			Output:          flap.Output,
+			Err:             flap.Err,
+			Compensation:    flap.Compensation,
+			CompensationErr: flap.CompensationErr,
+		}
+		if flapID == soar.failedFlap {
+			result.FailedFlap, result.Err = flap.ConfName, flap.Err
+		}
+	}
+	return result
+}
@@ -0,0 +1,421 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+// Soar 启动一个协程，按就绪队列和定时唤醒将 Flap 派发到 worker 池中并行执行, 返回本次运行的句柄
+// 所有 Flap 结束、Soar 被取消或停止时调度循环退出; ctx 结束等同于 Stop, 执行中的 Flap 会收到取消信号
+// 已暂停的 Soar 启动后保持暂停, 直到调用 Resume; 调度循环已在运行时直接返回当前的句柄
+func (soar *Soar) Soar(ctx context.Context) *RunHandle {
+	soar.lock.Lock()
+	if soar.cancel != nil {
+		handle := soar.handle
+		soar.lock.Unlock()
+		return handle
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	if soar.timeout > 0 {
+		// 超时的 context 派生自可以取消的 context, 取消本次运行时两者一同结束
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeout(runCtx, soar.timeout)
+		cancelRun := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelRun()
+		}
+	}
+	handle := newRunHandle(soar.id)
+	soar.cancel, soar.stopping, soar.handle = cancel, false, handle
+	if soar.status == SoarStatusPending {
+		soar.setStatus(SoarStatusRunning)
+	}
+	soar.lock.Unlock()
+
+	// 创建一个 goroutine
+	go func() {
+		defer func() {
+			// Soar 失败后回滚已成功的 Flap, 补偿不受本次运行的取消和超时影响, 只在 Wyvern 被强制关闭时中断
+			// 补偿前先写入补偿中的状态, 中途退出时由 Recover 继续补偿; 已由其他实例接管时不再补偿
+			if soar.Status() == SoarStatusCompensating {
+				_ = soar.checkpoint(true)
+				if soar.fenceError() == nil && soar.compensate(soar.compensateContext(ctx)) {
+					soar.lock.Lock()
+					soar.setStatus(SoarStatusFailed)
+					soar.lock.Unlock()
+				}
+			}
+			// 写入本次运行最终的状态, 失败时即使 Soar 已处于终态也置为失败, 避免调用方误以为状态已保存
+			if err := soar.checkpoint(true); err != nil && !errors.Is(err, ErrRevisionConflict) {
+				soar.lock.Lock()
+				if soar.err == nil {
+					soar.err = err
+				}
+				soar.setStatus(SoarStatusFailed)
+				soar.lock.Unlock()
+			}
+			soar.lock.Lock()
+			soar.cancel = nil
+			result := soar.result()
+			if soar.fenceErr != nil {
+				result.Err = soar.fenceErr
+			}
+			soar.lock.Unlock()
+			cancel()
+			handle.complete(result)
+		}()
+		// 补偿中途退出的 Soar 不再派发 Flap, 找到失败的 Flap 后直接继续补偿
+		soar.lock.Lock()
+		compensating := soar.status == SoarStatusCompensating
+		if compensating && soar.remaining == nil {
+			soar.initSchedule()
+		}
+		soar.lock.Unlock()
+		if compensating {
+			return
+		}
+		// 循环派发 Flap, 并记录执行次数和时间到context中
+		for {
+			//记录 id 执行次数 和 时间 到context中
+			soar.lock.Lock()
+			count := soar.count
+			soar.lock.Unlock()
+			c := context.WithValue(runCtx, "soar_id", soar.id)
+			c = context.WithValue(c, "soar_count", count)
+			c = context.WithValue(c, "soar_time", time.Now())
+			c = context.WithValue(c, soarContextKey{}, soar)
+
+			// 派发所有就绪的 Flap
+			_ = soar.Flap(c)
+			// 持久化本轮发生的状态变化, 写入失败时 Soar 置为失败, 写入冲突时 Soar 已停止
+			if err := soar.checkpoint(false); err != nil && !errors.Is(err, ErrRevisionConflict) {
+				soar.fail(err)
+			}
+			// 本次运行已经结束, 退出调度循环
+			if soar.finish() {
+				return
+			}
+			// 执行次数加一, Record 会在其他协程中读取
+			soar.lock.Lock()
+			soar.count++
+			soar.lock.Unlock()
+			// 等待定时器到期或 Flap 状态变化
+			if !soar.wait(c) {
+				// 超过 Soar 的总超时时间, 执行中的 Flap 已通过 runCtx 收到取消信号
+				if ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded {
+					soar.fail(fmt.Errorf("%w: %s", ErrSoarTimeout, soar.timeout))
+				}
+				// 与 Stop 一样不再派发新的 Flap, 等待执行中的 Flap 结束后再退出
+				soar.lock.Lock()
+				soar.stopping = true
+				soar.lock.Unlock()
+			}
+		}
+	}()
+	return handle
+}
+
+// fail 因 Soar 级别的错误 (而非某个 Flap 失败) 将 Soar 置为失败
+func (soar *Soar) fail(err error) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	if soar.status.IsFinished() || soar.status == SoarStatusCompensating {
+		return
+	}
+	soar.err = err
+	soar.setStatus(soar.failedStatus())
+}
+
+// failedStatus 返回 Soar 失败时应处于的状态, 存在尚未补偿的已成功 Flap 时为补偿中, 调用方需持有 soar.lock
+func (soar *Soar) failedStatus() SoarStatus {
+	for _, flapID := range soar.IFlapIndex.ListAllFlapID() {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		if flap.State == FlapStateSuccess && flap.compensate != nil && flap.Compensation == CompensationNone {
+			return SoarStatusCompensating
+		}
+	}
+	return SoarStatusFailed
+}
+
+// finish 判断本次运行是否已经结束, 需要时将 Soar 更新为终态
+// 有 Flap 失败、正在停止或已被取消时, 会等待所有执行中的 Flap 结束后再退出, 保证其结果在最终的 checkpoint 中写入
+func (soar *Soar) finish() bool {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	// 被放弃的执行可能永远不会返回, 不等待它们
+	if len(soar.running) > len(soar.abandoned) {
+		return false
+	}
+	switch {
+	case soar.status == SoarStatusCancelled:
+		return true
+	case soar.err != nil || soar.failedFlap != "":
+		soar.setStatus(soar.failedStatus())
+		return true
+	case soar.unfinished == 0:
+		soar.setStatus(SoarStatusSucceeded)
+		return true
+	}
+	return soar.stopping
+}
+
+// wait 阻塞直到有 Flap 到达唤醒时间、Flap 状态发生变化或 ctx 结束, ctx 已经结束时返回 false
+// ctx 已经结束时只等待执行中的 Flap 的状态变化, 不会因 ctx 立即返回
+func (soar *Soar) wait(ctx context.Context) bool {
+	done := ctx.Done()
+	if ctx.Err() != nil {
+		done = nil
+	}
+	soar.lock.Lock()
+	now := time.Now()
+	if due := soar.popDue(now); len(due) > 0 {
+		soar.readyQueue = append(soar.readyQueue, due...)
+		soar.lock.Unlock()
+		return ctx.Err() == nil
+	}
+	d, ok := soar.nextAwake(now)
+	if len(soar.blocked) > 0 && (!ok || d > ConditionPollInterval) {
+		d, ok = ConditionPollInterval, true
+	}
+	// 累积的状态变化到期时需要写入 Store
+	if fd, flush := soar.flushDelay(now); flush && (!ok || fd < d) {
+		d, ok = fd, true
+	}
+	soar.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if ok {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+	case <-soar.wake:
+	case <-timeout:
+	}
+	return ctx.Err() == nil
+}
+
+// Flap 将就绪队列中的 Flap 派发到 worker 池中执行, 不等待其执行完成
+// 派发前先将 Flap 执行中的状态写入 Store 作为认领, 写入失败或冲突时本轮不派发任何 Flap, 冲突时 Soar 在当前实例上停止运行
+// 就绪队列由前驱节点计数增量维护, 每次调用的开销只与本次状态发生变化的 Flap 数量相关
+// 如果已有 Flap 的状态为 FlapStateFailed，则不再派发并返回 ErrFlapAlreadyFailed
+func (soar *Soar) Flap(ctx context.Context) error {
+	soar.lock.Lock()
+	if soar.remaining == nil {
+		soar.initSchedule()
+	}
+	if soar.failedFlap != "" {
+		soar.lock.Unlock()
+		return ErrFlapAlreadyFailed
+	}
+	// 暂停、停止或取消时不再派发新的 Flap
+	if soar.status != SoarStatusRunning || soar.stopping {
+		soar.lock.Unlock()
+		return nil
+	}
+
+	// 到期的定时唤醒和等待启动条件的 Flap 重新进入就绪队列
+	soar.readyQueue = append(soar.readyQueue, soar.popDue(time.Now())...)
+	for flapID := range soar.blocked {
+		soar.readyQueue = append(soar.readyQueue, flapID)
+		delete(soar.blocked, flapID)
+	}
+
+	var ready []dispatchTask
+	for len(soar.readyQueue) > 0 && soar.hasIdleSlot() {
+		flapID := soar.readyQueue[0]
+		soar.readyQueue = soar.readyQueue[1:]
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		// 正在执行中或已完成的 Flap 不重复派发
+		if flap == nil || soar.running[flapID] || flap.IsCompleted() {
+			continue
+		}
+		switch flap.arm(ctx) {
+		case nil:
+			// 每次派发前都写入一次认领并增加 Revision, 包括重试和恢复后重新执行的尝试
+			// 其他实例基于旧 Revision 的派发或写入会发生冲突
+			if flap.State != FlapStateInProgress {
+				flap.UpdateStatus(FlapStateInProgress, nil)
+			} else {
+				soar.markDirty(flap)
+			}
+			soar.running[flapID] = true
+			ready = append(ready, newDispatchTask(flap))
+		case ErrFlapWaitForAware:
+			// 还未到达重试时间, 登记定时唤醒
+			soar.schedule(flapID, *flap.NextAwakeTime)
+		case ErrFlapIsNotReady:
+			soar.blocked[flapID] = true
+		case ErrFlapAlreadyFailed:
+			// 启动条件求值出错
+			soar.onSettled(flap)
+		}
+	}
+	soar.lock.Unlock()
+	if len(ready) == 0 {
+		return nil
+	}
+
+	// 执行前先写入执行中的状态, 写入冲突说明 Flap 可能已在其他实例上执行, 此时不再派发
+	if err := soar.checkpoint(true); err != nil {
+		soar.undispatch(ready)
+		if !errors.Is(err, ErrRevisionConflict) {
+			soar.fail(err)
+		}
+		return err
+	}
+	// 写入期间失去租约
+	if err := ctx.Err(); err != nil {
+		soar.undispatch(ready)
+		return err
+	}
+	for _, task := range ready {
+		soar.dispatch(ctx, task)
+	}
+	return nil
+}
+
+// dispatchTask 已认领、等待派发的 Flap, 以及在 soar.lock 内根据父节点输出准备好的动作和 ActionContext
+type dispatchTask struct {
+	flap   *Flap
+	ac     *flaps.ActionContext
+	action flaps.FlapActionV2
+	err    error // 准备动作失败时不执行, 直接以该错误结束本次执行
+}
+
+// newDispatchTask 取出检查启动条件时实例化的动作并生成执行参数, 调用方需持有 soar.lock
+func newDispatchTask(flap *Flap) dispatchTask {
+	task := dispatchTask{flap: flap, ac: flap.actionContext(flap.AttemptRetryCount)}
+	task.action, task.err = flap.takeAction()
+	return task
+}
+
+// undispatch 将未能派发的 Flap 放回就绪队列
+func (soar *Soar) undispatch(ready []dispatchTask) {
+	soar.lock.Lock()
+	defer soar.lock.Unlock()
+	for _, task := range ready {
+		delete(soar.running, task.flap.ID)
+		// 动作尚未执行, 留给下一次派发
+		task.flap.next = task.action
+		soar.readyQueue = append(soar.readyQueue, task.flap.ID)
+	}
+}
+
+// initSchedule 根据当前的 Flap 状态初始化前驱节点计数和就绪队列, 调用方需持有 soar.lock
+func (soar *Soar) initSchedule() {
+	flapIDs := soar.IFlapIndex.ListAllFlapID()
+	sort.Strings(flapIDs)
+
+	soar.remaining = make(map[ID]int, len(flapIDs))
+	for _, flapID := range flapIDs {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		if flap.State == FlapStateFailed {
+			soar.failedFlap = flapID
+		}
+		if flap.IsCompleted() {
+			continue
+		}
+		soar.unfinished++
+		count := 0
+		for _, parentID := range flap.PrevFlaps {
+			if parent := soar.IFlapIndex.GetFlap(parentID); parent.State != FlapStateSuccess {
+				count++
+			}
+		}
+		soar.remaining[flapID] = count
+		if count == 0 {
+			soar.readyQueue = append(soar.readyQueue, flapID)
+		}
+	}
+}
+
+// onSettled 在 Flap 执行结束后增量更新调度信息, 调用方需持有 soar.lock
+func (soar *Soar) onSettled(flap *Flap) {
+	switch flap.State {
+	case FlapStateSuccess:
+		soar.unfinished--
+		// 子节点的前驱计数减一, 归零后进入就绪队列
+		for _, childID := range flap.NextFlaps {
+			soar.remaining[childID]--
+			if soar.remaining[childID] == 0 {
+				soar.readyQueue = append(soar.readyQueue, childID)
+			}
+		}
+	case FlapStatusErrorAndRetry:
+		soar.schedule(flap.ID, *flap.NextAwakeTime)
+	case FlapStateFailed:
+		if soar.failedFlap == "" {
+			soar.failedFlap = flap.ID
+		}
+	}
+}
+
+// hasIdleSlot 判断当前 Soar 是否还能派发新的 Flap, 调用方需持有 soar.lock
+func (soar *Soar) hasIdleSlot() bool {
+	return soar.maxParallelism <= 0 || len(soar.running) < soar.maxParallelism
+}
+
+// dispatch 在新的协程中执行 Flap 的动作, 动作执行时不持有 soar.lock, 执行结束后在锁内更新状态
+// 动作和 ActionContext 已在认领时于锁内生成, 执行期间不再读取其他 Flap 的数据
+func (soar *Soar) dispatch(ctx context.Context, task dispatchTask) {
+	pool, flap := soar.pool, task.flap
+	go func() {
+		defer func() {
+			// 状态发生变化或空出了执行槽位, 唤醒调度循环
+			soar.notify()
+		}()
+		if err := pool.Acquire(ctx); err != nil {
+			// 未能执行, 重新放回就绪队列
+			soar.lock.Lock()
+			delete(soar.running, flap.ID)
+			flap.next = task.action
+			soar.readyQueue = append(soar.readyQueue, flap.ID)
+			soar.lock.Unlock()
+			return
+		}
+		var result *flaps.ActionResult
+		var abandoned <-chan struct{}
+		err := task.err
+		if err == nil {
+			result, abandoned, err = flap.execute(ctx, task.ac, task.action)
+		}
+
+		soar.lock.Lock()
+		if err != nil && ctx.Err() != nil {
+			// Soar 被取消或停止导致的中断不计入 Flap 的执行结果, Flap 保持执行中, 重新运行时再次执行
+			soar.readyQueue = append(soar.readyQueue, flap.ID)
+		} else {
+			flap.settle(result, err)
+			soar.onSettled(flap)
+		}
+		if abandoned == nil {
+			delete(soar.running, flap.ID)
+			soar.lock.Unlock()
+			pool.Release()
+			return
+		}
+		// 动作没有响应取消信号, 其结果已被丢弃; 在它返回前 Flap 留在 running 中, 不会被再次派发
+		soar.abandoned[flap.ID] = true
+		soar.lock.Unlock()
+		soar.notify()
+		<-abandoned
+		pool.Release()
+		soar.lock.Lock()
+		delete(soar.running, flap.ID)
+		delete(soar.abandoned, flap.ID)
+		// 等待期间到期的重试被跳过, 重新放回就绪队列
+		if flap.State == FlapStatusErrorAndRetry {
+			soar.readyQueue = append(soar.readyQueue, flap.ID)
+		}
+		soar.lock.Unlock()
+	}()
+}
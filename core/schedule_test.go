@@ -0,0 +1,433 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+// recorder 记录 Flap 开始执行的顺序
+type recorder struct {
+	lock  sync.Mutex
+	order []string
+}
+
+func (r *recorder) record(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.order = append(r.order, name)
+}
+
+func (r *recorder) Order() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.order...)
+}
+
+func TestParallelism(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		soar     int
+		wyvern   int
+		wantPeak int64
+	}{
+		{"unbounded", 0, 0, 4},
+		{"soar", 2, 0, 2},
+		{"wyvern", 0, 3, 3},
+		{"both", 3, 1, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w, _ := newWyvern(t)
+			w.SetMaxParallelism(c.wyvern)
+			cnt := &counter{}
+			key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+				defer cnt.enter()()
+				time.Sleep(30 * time.Millisecond)
+				return &flaps.ActionResult{}, nil
+			})
+			id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: wide
+    maxParallelism: %d
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %[2]q}}
+      - {name: b, plugin: test, pluginConfig: {key: %[2]q}}
+      - {name: c, plugin: test, pluginConfig: {key: %[2]q}}
+      - {name: d, plugin: test, pluginConfig: {key: %[2]q}}
+`, c.soar, key), "wide")
+
+			if _, err := waitRun(t, mustRun(t, w, id)); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if cnt.Calls() != 4 || cnt.Peak() != c.wantPeak {
+				t.Errorf("expect 4 calls with %d at once, got %d calls with %d at once", c.wantPeak, cnt.Calls(), cnt.Peak())
+			}
+		})
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	w, _ := newWyvern(t)
+	rec := &recorder{}
+	key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		rec.record(ac.FlapName)
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: diamond
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %[1]q}, nextFlaps: [b, c]}
+      - {name: b, plugin: test, pluginConfig: {key: %[1]q}}
+      - {name: c, plugin: test, pluginConfig: {key: %[1]q}}
+      - {name: d, plugin: test, pluginConfig: {key: %[1]q}, prevFlaps: [b, c]}
+`, key), "diamond")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	order := rec.Order()
+	if len(order) != 4 || order[0] != "a" || order[3] != "d" {
+		t.Fatalf("expect a first and d last, each once, got %v", order)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if state := result.Flaps[name].State; state != core.FlapStateSuccess {
+			t.Errorf("flap %s: expect success, got %s", name, state)
+		}
+	}
+}
+
+func TestRetryAtWakesLoop(t *testing.T) {
+	w, _ := newWyvern(t)
+	var first time.Time
+	var gap time.Duration
+	key := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		if ac.Attempt == 0 {
+			first = time.Now()
+			retryAt := first.Add(40 * time.Millisecond)
+			return &flaps.ActionResult{RetryAt: &retryAt}, errors.New("not yet")
+		}
+		gap = time.Since(first)
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: later
+    flaps:
+      - {name: a, plugin: test, pluginConfig: {key: %q}}
+`, key), "later")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Flaps["a"].Attempts != 1 {
+		t.Errorf("expect 1 retry, got %d", result.Flaps["a"].Attempts)
+	}
+	// 由定时器唤醒, 不依赖固定间隔的轮询
+	if gap < 40*time.Millisecond || gap > 300*time.Millisecond {
+		t.Errorf("expect retry about 40ms later, got %s", gap)
+	}
+}
+
+func TestParentOutputs(t *testing.T) {
+	w, _ := newWyvern(t)
+	produce := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return &flaps.ActionResult{Output: map[string]any{"url": "http://x/" + ac.FlapName, "n": 3}}, nil
+	})
+	var got map[string]any
+	var parents map[string]map[string]any
+	consume := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		got, parents = config, ac.ParentOutputs
+		return &flaps.ActionResult{}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: pipe
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: %q}}
+      - name: use
+        plugin: test
+        prevFlaps: [fetch]
+        pluginConfig:
+          key: %q
+          url: "${{ flaps.fetch.output.url }}"
+          n: "${{flaps.fetch.output.n}}"
+          msg: "n=${{ flaps.fetch.output.n }} state=${{ flaps.fetch.state }}"
+`, produce, consume), "pipe")
+
+	if _, err := waitRun(t, mustRun(t, w, id)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got["url"] != "http://x/fetch" || got["n"] != 3 || got["msg"] != "n=3 state=success" {
+		t.Errorf("unexpected rendered config %v", got)
+	}
+	if parents["fetch"]["url"] != "http://x/fetch" {
+		t.Errorf("unexpected parent outputs %v", parents)
+	}
+}
+
+func TestMissingTemplateRefFailsFlap(t *testing.T) {
+	w, _ := newWyvern(t)
+	id := mustLoad(t, w, `
+soars:
+  - name: pipe
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: none}}
+      - {name: use, plugin: test, prevFlaps: [fetch], pluginConfig: {key: "${{ flaps.fetch.output.nope }}"}}
+`, "pipe")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarFailed) || !errors.Is(result.Err, core.ErrTemplateRefNotFound) {
+		t.Fatalf("expect ErrTemplateRefNotFound, got %v", err)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	w, _ := newWyvern(t)
+	produce := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return &flaps.ActionResult{Output: map[string]any{"code": 200, "url": "x"}}, nil
+	})
+	id := mustLoad(t, w, fmt.Sprintf(`
+soars:
+  - name: cond
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: %q}}
+      - name: ok
+        plugin: test
+        pluginConfig: {key: none}
+        prevFlaps: [fetch]
+        conditions: ['flaps.fetch.output.code == 200 && flaps.fetch.state == "success"', 'flap.attempt == 0']
+      - name: broken
+        plugin: test
+        pluginConfig: {key: none}
+        prevFlaps: [fetch]
+        conditions: ['flaps.fetch.output.url > 1']
+`, produce), "cond")
+
+	result, err := waitRun(t, mustRun(t, w, id))
+	if !errors.Is(err, core.ErrSoarFailed) || result.FailedFlap != "broken" {
+		t.Fatalf("expect broken to fail, got %v (failed flap %q)", err, result.FailedFlap)
+	}
+	if !errors.Is(result.Err, core.ErrConditionEval) {
+		t.Errorf("expect ErrConditionEval, got %v", result.Err)
+	}
+	if state := result.Flaps["ok"].State; state != core.FlapStateSuccess {
+		t.Errorf("expect ok to run, got %s", state)
+	}
+}
+
+func TestInvalidCondition(t *testing.T) {
+	for _, cond := range []string{
+		`flaps.other.state == "success"`,
+		`foo > 1`,
+		`flaps.fetch.output.n >`,
+		`bar(1)`,
+	} {
+		w, _ := newWyvern(t)
+		_, err := w.LoadFromConfig(mustConfig(t, fmt.Sprintf(`
+soars:
+  - name: cond
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: none}}
+      - {name: other, plugin: test, pluginConfig: {key: none}}
+      - {name: use, plugin: test, pluginConfig: {key: none}, prevFlaps: [fetch], conditions: ['%s']}
+`, cond)), "cond")
+		if !errors.Is(err, core.ErrInvalidCondition) {
+			t.Errorf("%s: expect ErrInvalidCondition, got %v", cond, err)
+		}
+	}
+}
+
+// pollAction 检查 ready 次数达到要求后启动条件才满足的插件, 启动条件在 ctx 结束后不满足
+type pollAction struct {
+	checks, ready, runs *int32
+}
+
+func (a *pollAction) Plugin() string              { return "test-poll" }
+func (a *pollAction) PluginConfig() any           { return nil }
+func (a *pollAction) FromConfig(config any) error { return nil }
+
+func (a *pollAction) Condition(ctx context.Context, ac *flaps.ActionContext) bool {
+	return ctx.Err() == nil && atomic.AddInt32(a.checks, 1) >= atomic.LoadInt32(a.ready)
+}
+
+func (a *pollAction) Execute(ctx context.Context, ac *flaps.ActionContext) (*flaps.ActionResult, error) {
+	atomic.AddInt32(a.runs, 1)
+	return &flaps.ActionResult{}, nil
+}
+
+func TestConditionReusesAction(t *testing.T) {
+	var makes, checks, runs int32
+	ready := int32(2)
+	flaps.RegisterFlapActionMakerV2("test-poll", func(config any) (flaps.FlapActionV2, error) {
+		atomic.AddInt32(&makes, 1)
+		return &pollAction{checks: &checks, ready: &ready, runs: &runs}, nil
+	})
+	w, s := newWyvern(t)
+	id := mustLoad(t, w, `
+soars:
+  - name: poll
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: none}}
+      - {name: use, plugin: test-poll, prevFlaps: [fetch], pluginConfig: {n: "${{ flaps.fetch.state }}"}}
+`, "poll")
+	if _, err := waitRun(t, mustRun(t, w, id)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// 引用父节点输出的配置在加载时不实例化, 多次检查启动条件和执行共用同一个动作
+	if makes != 1 || checks != 2 || runs != 1 {
+		t.Errorf("expect 1 action for 2 checks and 1 run, got %d actions, %d checks, %d runs", makes, checks, runs)
+	}
+
+	// IsReady 将调用方的 ctx 传给插件的 Condition
+	ready = 0
+	flap, err := core.NewFlap(flaps.FlapConfig{Name: "probe", Plugin: "test-poll"}, s)
+	if err != nil {
+		t.Fatalf("NewFlap: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if !flap.IsReady(ctx) {
+		t.Error("expect flap to be ready")
+	}
+	cancel()
+	if flap.IsReady(ctx) {
+		t.Error("expect cancelled ctx to reach Condition")
+	}
+}
+
+// v1Action 只实现 FlapAction 的旧插件, 第一次执行时要求立即重试
+type v1Action struct {
+	attempts *[]int
+}
+
+func (a *v1Action) Execute(retryAttempt int) (*time.Time, error) {
+	*a.attempts = append(*a.attempts, retryAttempt)
+	if retryAttempt == 0 {
+		now := time.Now()
+		return &now, errors.New("again")
+	}
+	return nil, nil
+}
+
+func (a *v1Action) FromConfig(config any) error { return nil }
+func (a *v1Action) Condition() bool             { return true }
+func (a *v1Action) Plugin() string              { return "test-v1" }
+func (a *v1Action) PluginConfig() any           { return nil }
+
+func TestFlapActionV1(t *testing.T) {
+	var attempts []int
+	flaps.RegisterFlapActionMaker("test-v1", func(config any) (flaps.FlapAction, error) {
+		return &v1Action{attempts: &attempts}, nil
+	})
+	w, _ := newWyvern(t)
+	id := mustLoad(t, w, `
+soars:
+  - name: legacy
+    flaps:
+      - {name: a, plugin: test-v1}
+`, "legacy")
+
+	if _, err := waitRun(t, mustRun(t, w, id)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(attempts) != 2 || attempts[0] != 0 || attempts[1] != 1 {
+		t.Errorf("expect attempts [0 1], got %v", attempts)
+	}
+}
+
+// strictAction 要求配置中的 n 为整数的插件, 启动条件为 n > 0
+type strictAction struct {
+	n    int
+	seen *[]int
+}
+
+func (a *strictAction) Plugin() string    { return "test-strict" }
+func (a *strictAction) PluginConfig() any { return map[string]any{"n": a.n} }
+
+func (a *strictAction) FromConfig(config any) error {
+	n, ok := config.(map[string]any)["n"].(int)
+	if !ok {
+		return fmt.Errorf("%w: n must be an int", flaps.ErrInvalidPluginConfig)
+	}
+	a.n = n
+	return nil
+}
+
+func (a *strictAction) Condition(ctx context.Context, ac *flaps.ActionContext) bool {
+	return a.n > 0
+}
+
+func (a *strictAction) Execute(ctx context.Context, ac *flaps.ActionContext) (*flaps.ActionResult, error) {
+	*a.seen = append(*a.seen, a.n)
+	return &flaps.ActionResult{}, nil
+}
+
+func TestTemplatedConfigIsCheckedAfterRender(t *testing.T) {
+	var seen []int
+	flaps.RegisterFlapActionMakerV2("test-strict", func(config any) (flaps.FlapActionV2, error) {
+		return &strictAction{seen: &seen}, nil
+	})
+	const yml = `
+soars:
+  - name: strict
+    flaps:
+      - {name: fetch, plugin: test, pluginConfig: {key: %q}}
+      - {name: use, plugin: test-strict, prevFlaps: [fetch], pluginConfig: {n: %s}}
+`
+	for _, c := range []struct {
+		name    string
+		output  any
+		n       string
+		loadErr bool
+		runErr  error
+		want    []int
+	}{
+		{"rendered", 3, `"${{ flaps.fetch.output.n }}"`, false, nil, []int{3}},
+		{"condition uses rendered config", 0, `"${{ flaps.fetch.output.n }}"`, false, nil, nil},
+		{"invalid after render", "x", `"${{ flaps.fetch.output.n }}"`, false, flaps.ErrInvalidPluginConfig, nil},
+		{"invalid without template", 3, `"x"`, true, nil, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			seen = nil
+			w, _ := newWyvern(t)
+			fetch := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+				return &flaps.ActionResult{Output: map[string]any{"n": c.output}}, nil
+			})
+			id, err := w.LoadFromConfig(mustConfig(t, fmt.Sprintf(yml, fetch, c.n)), "strict")
+			if c.loadErr {
+				if !errors.Is(err, flaps.ErrInvalidPluginConfig) {
+					t.Fatalf("expect ErrInvalidPluginConfig on load, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadFromConfig: %v", err)
+			}
+			if c.want == nil && c.runErr == nil {
+				// 启动条件不满足时一直等待, 在超时前停止
+				h := mustRun(t, w, id)
+				time.Sleep(30 * time.Millisecond)
+				if err = w.Stop(id); err != nil {
+					t.Fatalf("Stop: %v", err)
+				}
+				if _, err = waitRun(t, h); !errors.Is(err, core.ErrSoarStopped) {
+					t.Fatalf("expect ErrSoarStopped, got %v", err)
+				}
+			} else if result, err := waitRun(t, mustRun(t, w, id)); !errors.Is(err, c.runErr) && !errors.Is(result.Err, c.runErr) {
+				t.Fatalf("expect %v, got %v (%v)", c.runErr, err, result.Err)
+			}
+			if fmt.Sprint(seen) != fmt.Sprint(c.want) {
+				t.Errorf("expect executions with %v, got %v", c.want, seen)
+			}
+		})
+	}
+}
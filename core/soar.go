@@ -3,12 +3,20 @@ package core
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
 var (
 	ErrDuplicateFlapName = fmt.Errorf("duplicate flap name")
+
+	// ConditionPollInterval 存在因自身启动条件不满足而等待的 Flap 时, 重新检查条件的间隔
+	// 插件的启动条件无法主动通知调度循环, 只能以该间隔轮询; 没有这类 Flap 时调度循环不会空转
+	ConditionPollInterval = 500 * time.Millisecond
+	// ActionAbandonGrace Flap 的动作在取消或超时后继续等待其返回的时间
+	// 超过后放弃本次执行并丢弃其结果, 不响应 context 的动作不会阻塞调度循环
+	ActionAbandonGrace = 100 * time.Millisecond
 )
 
 // Soar 结构体表示 Wyvern 中的原子能力
@@ -17,12 +25,96 @@ type Soar struct {
 	IFlapIndex
 	// 根 Flap 列表
 	RootFlaps []ID
-	// 执行锁
+	// 执行锁, 同时保护所有 Flap 的状态和调度信息
 	lock sync.Mutex
-	// 执行次数
+	// 执行次数, 由 lock 保护
 	count int
 	// 创建时随机生成的独立uuid
 	id string
+	// Soar 的配置名
+	name string
+	// 最近一次写入 Store 后记录的 Revision
+	revision uint64
+	// 父 Soar 的 ID, 不是子 Soar 时为空
+	parentID ID
+	// 运行当前 Soar 的父 Soar 中的 Flap 的 ID
+	parentFlap ID
+	// 加载时使用的配置, 子 Soar 插件从中查找子 Soar 的配置, 从 Store 恢复时为 nil
+	config *WyvernConfig
+	// 加载 Soar 的 Wyvern, 子 Soar 插件通过它创建和运行子 Soar
+	wyvern *Wyvern
+
+	// 运行参数的声明
+	inputDecls []InputConfig
+	// 第一次运行时绑定的运行参数, 尚未绑定时为 nil
+	inputs map[string]any
+	// 运行参数是否已经绑定, 与 Soar 的状态无关, 例如运行前暂停的 Soar 仍未绑定
+	inputsBound bool
+
+	// 最大并行度, 小于等于 0 表示不限制
+	maxParallelism int
+	// 全局 worker 池, 由 Wyvern 注入, 为 nil 时不限制
+	pool *WorkerPool
+	// 已派发且尚未结束的 Flap, 包括超时或被取消后仍未返回的执行
+	running map[ID]bool
+	// running 中已被放弃的执行, 其结果会被丢弃, 本次运行结束时不再等待
+	abandoned map[ID]bool
+	// 按 NextAwakeTime 排序的定时唤醒队列
+	timers awakeQueue
+	// 每个 Flap 当前有效的唤醒时间, 用于去重和丢弃过期的唤醒项
+	scheduled map[ID]time.Time
+	// 每个 Flap 尚未成功的前驱节点数量, 为 nil 表示调度信息尚未初始化
+	remaining map[ID]int
+	// 前驱节点已全部成功, 等待派发的 Flap
+	readyQueue []ID
+	// 因自身启动条件不满足而等待的 Flap
+	blocked map[ID]bool
+	// 尚未成功的 Flap 数量, 归零时 Soar 成功
+	unfinished int
+	// 导致 Soar 失败的 Flap
+	failedFlap ID
+	// 导致 Soar 失败的 Soar 级别错误, 例如超时
+	err error
+	// 一次运行的总超时时间, 为 0 表示不限制
+	timeout time.Duration
+	// 状态变化时唤醒调度循环
+	wake chan struct{}
+
+	// Soar 的运行状态
+	status SoarStatus
+	// 是否正在停止, 停止时不再派发新的 Flap
+	stopping bool
+	// 取消本次运行, 为 nil 表示调度循环没有在运行
+	cancel context.CancelFunc
+	// 最近一次运行的句柄
+	handle *RunHandle
+
+	// 持久化 Soar 和 Flap 状态的 Store
+	store Store
+	// 写入 Store 的批量设置
+	checkpointOpts CheckpointOptions
+	// 保证多次 checkpoint 串行执行
+	checkpointLock sync.Mutex
+	// 状态发生变化且尚未写入 Store 的 Flap 副本
+	dirty map[ID]*Flap
+	// dirty 中最早一次变化的时间
+	dirtySince time.Time
+	// Soar 自身的状态是否发生变化且尚未写入 Store
+	soarDirty bool
+
+	// 记录状态变化的审计日志, 为 nil 时不记录
+	events EventLog
+	// 尚未追加到 events 的事件
+	pendingEvents []Event
+	// 运行 Soar 的 Wyvern 实例 ID, 记录为事件的 Actor
+	actor string
+
+	// 最近一次成功获取租约的时间
+	leaseRenewed time.Time
+	// 是否已失去租约或写入冲突, 之后的状态变化不再写入 Store 和 EventLog
+	fenced bool
+	// 失去租约或写入冲突的错误
+	fenceErr error
 }
 
 // HasRootFlap 判断是否存在指定 ID 的根 Flap
@@ -123,73 +215,45 @@ func (soar *Soar) FindFlapByID(ID string) *Flap {
 	return f
 }
 
-// Soar 启动一个协程，不断遍历 Flap DAG 并尝试执行最近未执行的项
-func (soar *Soar) Soar(ctx context.Context) {
-	// 创建一个 goroutine
-	go func(c context.Context) {
-		// 发生异常时, 优雅退出
-		defer func() {
-			if r := recover(); r != nil {
-				return
-			}
-		}()
-		// 无限循环, 并记录执行次数和时间到context中
-		for {
-			//记录 id 执行次数 和 时间 到context中
-			c = context.WithValue(c, "soar_id", soar.id)
-			c = context.WithValue(c, "soar_count", soar.count)
-			c = context.WithValue(c, "soar_time", time.Now())
-
-			// 遍历 Flap DAG 并尝试执行最近未执行的项
-			err := soar.Flap(c)
-			// 如果遇到错误, 则直接返回
-			if err != nil {
-				return
-			}
-			// 执行次数加一
-			soar.count++
-			// 等待 500 毫秒
-			time.Sleep(500 * time.Millisecond)
-		}
-	}(ctx)
-}
-
-// Flap 遍历 Flap DAG 并尝试执行最近未执行的项
-// 每次遍历时，如果遇到一个未完成的 Flap，则执行该 Flap 的 Tick 方法， 否则将其子节点加入到 BFS 列表中
-// 如果某个 Tick 方法返回的错误为 ErrFlapAlreadyFailed，则终止遍历
-func (soar *Soar) Flap(ctx context.Context) error {
-	// 使用 DFSUntil 遍历 Flap DAG
-	_, err := soar.DFSUntil(ctx, func(ctx context.Context, flap *Flap) (bool, error) {
-		// 如果这个 Flap 已经完成, 则直接跳过, 并继续遍历其子节点
-		if flap.IsCompleted() {
-			return true, nil
-		}
-		// 如果这个 Flap 未完成, 则执行 Tick 方法
-		err := flap.Tick(ctx)
-		// 如果 Tick 方法返回的错误为 ErrFlapAlreadyFailed，则终止遍历
-		if err == ErrFlapAlreadyFailed {
-			return false, err
-		}
-		// 不再遍历其子节点
-		return false, nil
-	}, func(flap *Flap) bool {
-		// 不会被调用
-		return false
-	})
-
-	// 返回错误
-	return err
+// init 初始化调度所需的内部数据结构, 已初始化的字段保持不变
+func (soar *Soar) init() {
+	if soar.running == nil {
+		soar.running = make(map[ID]bool)
+	}
+	if soar.abandoned == nil {
+		soar.abandoned = make(map[ID]bool)
+	}
+	if soar.scheduled == nil {
+		soar.scheduled = make(map[ID]time.Time)
+	}
+	if soar.blocked == nil {
+		soar.blocked = make(map[ID]bool)
+	}
+	if soar.wake == nil {
+		soar.wake = make(chan struct{}, 1)
+	}
 }
 
 // NewSoar 从配置创建一个 Soar, 从配置文件中加载所有 Flap,并建立 Flap 之间的关系
+// 配置有误时返回包含所有问题的 ConfigErrors
 func NewSoar(conf SoarConfig, store Store) (*Soar, error) {
+	// 检查引用、环和插件配置, 避免创建出无法执行的 Soar
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	// 创建 Soar
 	soar := &Soar{
-		RootFlaps: make([]string, 0),
-		lock:      sync.Mutex{},
-		count:     0,
-		id:        store.MakeSoarID(),
+		RootFlaps:      make([]string, 0),
+		lock:           sync.Mutex{},
+		count:          0,
+		id:             store.MakeSoarID(),
+		name:           conf.Name,
+		maxParallelism: conf.MaxParallelism,
+		timeout:        conf.Timeout.Std(),
+		inputDecls:     conf.Inputs,
+		store:          store,
 	}
+	soar.init()
 	idTable := &FlapIDTable{}
 	// 创建 Flap
 	flaps := make(map[string]*Flap)
@@ -205,6 +269,9 @@ func NewSoar(conf SoarConfig, store Store) (*Soar, error) {
 			return nil, err
 		}
 		// 将 Flap 加入到 flaps 中
+		flap.index = idTable
+		flap.SoarID = soar.id
+		flap.onUpdate = soar.onFlapUpdate
 		flaps[flapConf.Name] = flap
 		(*idTable)[flap.ID] = flap
 	}
@@ -223,6 +290,12 @@ func NewSoar(conf SoarConfig, store Store) (*Soar, error) {
 			flap.AddPrev(flaps[prevFlapName])
 		}
 	}
+	// 检查启动条件引用的父节点是否存在
+	for _, flapConf := range conf.Flaps {
+		if err := flaps[flapConf.Name].checkConditionRefs(); err != nil {
+			return nil, err
+		}
+	}
 	// 将所有的根节点加入到 RootFlaps 中
 	for _, flap := range flaps {
 		// 找到入度为 0 的 Flap
@@ -230,5 +303,27 @@ func NewSoar(conf SoarConfig, store Store) (*Soar, error) {
 			soar.RootFlaps = append(soar.RootFlaps, flap.ID)
 		}
 	}
+	// 创建后立即持久化 Soar 和所有 Flap
+	if err := soar.save(); err != nil {
+		return nil, err
+	}
 	return soar, nil
 }
+
+// save 将 Soar 和所有 Flap 的当前数据写入 Store, 用于创建时建立初始的 checkpoint
+func (soar *Soar) save() error {
+	if err := soar.store.SaveSoar(soar); err != nil {
+		return checkpointError("soar", soar.id, err)
+	}
+	soar.revision++
+	flapIDs := soar.IFlapIndex.ListAllFlapID()
+	sort.Strings(flapIDs)
+	for _, flapID := range flapIDs {
+		flap := soar.IFlapIndex.GetFlap(flapID)
+		if err := soar.store.SaveFlap(flap); err != nil {
+			return checkpointError("flap", flapID, err)
+		}
+		flap.revision++
+	}
+	return nil
+}
@@ -4,21 +4,28 @@ package core
 // Store 用于序列化和存储 soar 和 flap 的数据
 // Store 不创建 soar 和 flap, 只负责把数据保存到持久化存储中和从持久化存储中加载数据
 // 只能从配置创建 soar 和 flap
+//
+// SaveSoar 和 SaveFlap 是比较并写入的操作: 记录 (见 Soar.Record 和 Flap.Record) 的 Revision 必须等于 Store 中该记录当前的 Revision
+// (记录不存在时为 0), 否则不写入并返回 *ConflictError; 写入成功后 Store 中记录的 Revision 为传入的 Revision 加一
+// Store 不修改传入的 soar 和 flap, 由引擎在写入成功后更新内存中的 Revision
 type Store interface {
 
 	// Rebuild 重建索引, 从持久化存储中加载 soar 和 flap 的数据, 并创建索引
-	// Store 接口中只有这一个方法会创建 soar 和 flap, 当计算发生迁移, 重新选举 leader 后, 会调用这个方法从持久化存储中恢复数据
+	// Store 接口中只有这一个方法会创建 soar 和 flap, 当 soar 的租约过期被其他实例接管后, 会调用这个方法从持久化存储中恢复数据, 见 Lease
 	Rebuild(soarID ID) (*FlapIDTable, error)
 
-	// SaveSoar 保存 soar 的数据
+	// SaveSoar 保存 soar 的数据, 引擎在 soar 创建和状态变化后调用
 	SaveSoar(soar *Soar) error
-	// SaveFlap 保存 flap 的数据
+	// SaveFlap 保存 flap 的数据, 包括状态、输出和插件的原始配置
+	// 引擎在 flap 创建和每次状态变化后调用, 运行中传入的是 flap 的副本, 可以在调用返回后继续持有
 	SaveFlap(flap *Flap) error
 
 	// LoadSoar 加载 soar 的数据, 只会根据 soar 的 ID 加载 soar 的数据, 不会创建 soar 和 flap
 	LoadSoar(soar *Soar, id ID) error
 	// LoadFlap 加载 flap 的数据, 只会根据 flap 的 ID 加载 flap 的数据, 不会创建 flap
 	LoadFlap(index IFlapIndex, id ID) error
+	// ListSoars 列出所有已保存的 soar 的 ID, 恢复时据此加载未结束的 soar
+	ListSoars() ([]ID, error)
 
 	// MakeSoarID 创建 Soar 的 ID
 	MakeSoarID() ID
@@ -29,3 +36,4 @@ type Store interface {
 // Store 恢复流程
 // 1. 从持久化存储中加载 soar 的数据, 其中包含 root flap 的 ID
 // 2. 从持久化存储中加载 flap 的数据, 包含每个 flap 的状态和 flap 之间的关系
+// 3. 通过插件注册表, 使用 flap 持久化的插件名和原始配置重新实例化 Action, 见 RestoreSoar 和 Wyvern.Recover
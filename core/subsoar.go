@@ -0,0 +1,213 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+const (
+	// SubSoarPluginName 子 Soar 插件的名称
+	SubSoarPluginName = "soar"
+)
+
+var (
+	// ErrSubSoarFailed 表示子 Soar 没有成功结束
+	ErrSubSoarFailed = errors.New("sub soar is not succeeded")
+	// ErrSubSoarCycle 表示子 Soar 直接或间接地运行了自身
+	ErrSubSoarCycle = errors.New("sub soar cycle")
+	// ErrNoWyvern 表示 Soar 没有由 Wyvern 加载, 无法运行子 Soar
+	ErrNoWyvern = errors.New("soar is not loaded by wyvern")
+)
+
+// soarContextKey 在 context 中保存正在运行的 Soar 的 key
+type soarContextKey struct{}
+
+// soarFromContext 返回 ctx 所属的 Soar, 不在 Soar 的调度循环中时返回 nil
+func soarFromContext(ctx context.Context) *Soar {
+	soar, _ := ctx.Value(soarContextKey{}).(*Soar)
+	return soar
+}
+
+// SubSoar 运行同一个 WyvernConfig 中的另一个 Soar 作为子 Soar, 实现 flaps.FlapActionV2 接口
+// 插件配置为 {soar: <Soar 配置名>, inputs: {...}}, inputs 作为子 Soar 的运行参数, 可以使用模板表达式
+// 子 Soar 成功后, 输出为 {soarID: <子 Soar ID>, flaps: {<Flap 配置名>: <输出>}}
+// 父 Soar 被取消、超时或本次执行超时时子 Soar 被取消; 父 Soar 停止或失去租约时子 Soar 随之停止, 之后由父 Soar 的 Flap 重新执行时继续运行
+type SubSoar struct {
+	// 子 Soar 的配置名
+	Soar string
+	// 子 Soar 的运行参数
+	Inputs map[string]any
+}
+
+// Plugin 插件名
+func (s *SubSoar) Plugin() string {
+	return SubSoarPluginName
+}
+
+// PluginConfig 配置的复制
+func (s *SubSoar) PluginConfig() any {
+	return map[string]any{"soar": s.Soar, "inputs": cloneMap(s.Inputs)}
+}
+
+// FromConfig 从配置生成 SubSoar
+func (s *SubSoar) FromConfig(config any) error {
+	conf, ok := config.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %s: config must be a map, got %T", flaps.ErrInvalidPluginConfig, SubSoarPluginName, config)
+	}
+	if s.Soar, ok = conf["soar"].(string); !ok || s.Soar == "" {
+		return fmt.Errorf("%w: %s: soar must be a non-empty string", flaps.ErrInvalidPluginConfig, SubSoarPluginName)
+	}
+	s.Inputs = nil
+	if inputs, exist := conf["inputs"]; exist && inputs != nil {
+		if s.Inputs, ok = inputs.(map[string]any); !ok {
+			return fmt.Errorf("%w: %s: inputs must be a map, got %T", flaps.ErrInvalidPluginConfig, SubSoarPluginName, inputs)
+		}
+	}
+	return nil
+}
+
+// Condition 自身的启动条件
+func (s *SubSoar) Condition(ctx context.Context, ac *flaps.ActionContext) bool {
+	return true
+}
+
+// Execute 运行子 Soar 并等待其结束, 重新执行时继续运行同一个 Flap 尚未失败的子 Soar
+func (s *SubSoar) Execute(ctx context.Context, ac *flaps.ActionContext) (*flaps.ActionResult, error) {
+	parent := soarFromContext(ctx)
+	if parent == nil || parent.wyvern == nil {
+		return nil, ErrNoWyvern
+	}
+	w := parent.wyvern
+	child, err := w.subSoar(parent, ac.FlapID, s.Soar)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.run(ctx, w, parent, child)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]any, len(result.Flaps))
+	for name, flap := range result.Flaps {
+		outputs[name] = cloneMap(flap.Output)
+	}
+	return &flaps.ActionResult{Output: map[string]any{"soarID": child.id, "flaps": outputs}}, nil
+}
+
+// run 运行子 Soar 并等待其结束, 已经成功的子 Soar 直接返回其结果
+func (s *SubSoar) run(ctx context.Context, w *Wyvern, parent, child *Soar) (RunResult, error) {
+	child.lock.Lock()
+	status, bound, result := child.status, child.inputsBound, child.result()
+	child.lock.Unlock()
+	if status == SoarStatusSucceeded {
+		return result, nil
+	}
+	// 已经绑定参数的子 Soar 沿用第一次运行时的参数
+	inputs := s.Inputs
+	if bound {
+		inputs = nil
+	} else if inputs == nil {
+		inputs = map[string]any{}
+	}
+	handle, err := w.RunWithInputs(ctx, child.id, inputs)
+	if err != nil {
+		return RunResult{}, err
+	}
+	result, err = handle.Wait(ctx)
+	// 子 Soar 以 ctx 运行, ctx 结束时子 Soar 随之停止, 可能先于 ctx 返回停止的结果
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// 父 Soar 被取消或超时, 或本次执行超时时取消子 Soar
+		if parent.Status().IsFinished() || errors.Is(ctxErr, context.DeadlineExceeded) {
+			_ = w.Cancel(child.id)
+		}
+		return RunResult{}, ctxErr
+	}
+	if err != nil {
+		return RunResult{}, fmt.Errorf("%w: %s %s: %v", ErrSubSoarFailed, s.Soar, child.id, err)
+	}
+	return result, nil
+}
+
+var _ flaps.FlapActionV2 = (*SubSoar)(nil)
+
+// init 注册 SubSoar
+func init() {
+	flaps.RegisterFlapActionMakerV2(SubSoarPluginName, func(config any) (flaps.FlapActionV2, error) {
+		return &SubSoar{}, nil
+	})
+}
+
+// ParentID 返回父 Soar 的 ID, 不是子 Soar 时返回空字符串
+func (soar *Soar) ParentID() ID {
+	return soar.parentID
+}
+
+// ParentFlapID 返回运行当前 Soar 的父 Soar 中的 Flap 的 ID, 不是子 Soar 时返回空字符串
+func (soar *Soar) ParentFlapID() ID {
+	return soar.parentFlap
+}
+
+// SetConfig 设置子 Soar 插件查找 Soar 配置时使用的 WyvernConfig
+// 通过 LoadFromConfig 加载的 Soar 使用加载时的配置, 从 Store 恢复的 Soar 使用此处设置的配置
+func (w *Wyvern) SetConfig(conf *WyvernConfig) {
+	w.config = conf
+}
+
+// Children 从 Store 中查找指定 Soar 的所有子 Soar 的 ID, 按 ID 排序
+func (w *Wyvern) Children(soarID ID) ([]ID, error) {
+	soarIDs, err := w.Store.ListSoars()
+	if err != nil {
+		return nil, err
+	}
+	children := make([]ID, 0)
+	for _, id := range soarIDs {
+		probe := &Soar{}
+		if err = w.Store.LoadSoar(probe, id); err != nil {
+			return nil, err
+		}
+		if probe.parentID == soarID {
+			children = append(children, id)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// subSoar 返回 parent 中 flapID 对应的 Flap 尚未失败或取消的子 Soar, 不存在时从配置创建名为 name 的子 Soar
+func (w *Wyvern) subSoar(parent *Soar, flapID ID, name string) (*Soar, error) {
+	w.soarsLock.RLock()
+	for _, soar := range w.Soars {
+		if soar.parentID != parent.id || soar.parentFlap != flapID {
+			continue
+		}
+		if status := soar.Status(); status != SoarStatusFailed && status != SoarStatusCompensating && status != SoarStatusCancelled {
+			w.soarsLock.RUnlock()
+			return soar, nil
+		}
+	}
+	w.soarsLock.RUnlock()
+
+	// 子 Soar 不能是自身或任何祖先
+	for ancestor := parent; ancestor != nil; {
+		if ancestor.name == name {
+			return nil, fmt.Errorf("%w: %s", ErrSubSoarCycle, name)
+		}
+		if ancestor.parentID == "" {
+			break
+		}
+		ancestor, _ = w.GetSoar(ancestor.parentID)
+	}
+
+	conf := parent.config
+	if conf == nil {
+		conf = w.config
+	}
+	if conf == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSoarNotFound, name)
+	}
+	return w.load(conf, name, parent, flapID)
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrTemplateRefNotFound 表示模板表达式引用的值不存在
+	ErrTemplateRefNotFound = errors.New("template reference not found")
+
+	// templatePattern 匹配模板表达式, 例如 ${{ flaps.fetch.output.url }}
+	templatePattern = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
+)
+
+// hasTemplate 判断配置中是否包含模板表达式
+func hasTemplate(config any) bool {
+	switch v := config.(type) {
+	case string:
+		return templatePattern.MatchString(v)
+	case map[string]any:
+		for _, item := range v {
+			if hasTemplate(item) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if hasTemplate(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderTemplate 使用 scope 渲染配置中的所有模板表达式, 返回新的配置, 不修改原配置
+// 字符串整体为一个模板表达式时保留引用值的类型, 否则将引用值格式化后拼接到字符串中
+// strict 为 false 时, 根节点不在 scope 中的表达式保持原样, 以便分阶段渲染
+func renderTemplate(config any, scope map[string]any, strict bool) (any, error) {
+	switch v := config.(type) {
+	case string:
+		return renderString(v, scope, strict)
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for key, item := range v {
+			rendered, err := renderTemplate(item, scope, strict)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = rendered
+		}
+		return ret, nil
+	case []any:
+		ret := make([]any, 0, len(v))
+		for _, item := range v {
+			rendered, err := renderTemplate(item, scope, strict)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, rendered)
+		}
+		return ret, nil
+	}
+	return config, nil
+}
+
+// renderString 渲染单个字符串中的模板表达式
+func renderString(str string, scope map[string]any, strict bool) (any, error) {
+	matches := templatePattern.FindAllStringSubmatchIndex(str, -1)
+	if len(matches) == 0 {
+		return str, nil
+	}
+	// 整个字符串就是一个表达式, 直接返回引用值
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(str) {
+		val, ok, err := lookupTemplatePath(str[matches[0][2]:matches[0][3]], scope, strict)
+		if err != nil || !ok {
+			return str, err
+		}
+		return val, nil
+	}
+
+	builder := strings.Builder{}
+	last := 0
+	for _, m := range matches {
+		builder.WriteString(str[last:m[0]])
+		val, ok, err := lookupTemplatePath(str[m[2]:m[3]], scope, strict)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			builder.WriteString(fmt.Sprint(val))
+		} else {
+			builder.WriteString(str[m[0]:m[1]])
+		}
+		last = m[1]
+	}
+	builder.WriteString(str[last:])
+	return builder.String(), nil
+}
+
+// lookupTemplatePath 按 . 分隔的路径在 scope 中查找值
+// 非 strict 模式下根节点不在 scope 中时返回 ok 为 false, 其余找不到的情况均返回 ErrTemplateRefNotFound
+func lookupTemplatePath(path string, scope map[string]any, strict bool) (val any, ok bool, err error) {
+	keys := strings.Split(path, ".")
+	if _, exist := scope[keys[0]]; !exist && !strict {
+		return nil, false, nil
+	}
+	var cur any = scope
+	for _, key := range keys {
+		m, isMap := cur.(map[string]any)
+		if !isMap {
+			return nil, false, fmt.Errorf("%w: %s", ErrTemplateRefNotFound, path)
+		}
+		if cur, isMap = m[key]; !isMap {
+			return nil, false, fmt.Errorf("%w: %s", ErrTemplateRefNotFound, path)
+		}
+	}
+	return cur, true, nil
+}
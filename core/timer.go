@@ -0,0 +1,65 @@
+package core
+
+import (
+	"container/heap"
+	"time"
+)
+
+// awakeItem 定时唤醒项, 表示在 at 时刻需要重新检查 flapID 对应的 Flap
+type awakeItem struct {
+	at     time.Time
+	flapID ID
+}
+
+// awakeQueue 按唤醒时间排序的小顶堆, 实现 heap.Interface
+type awakeQueue []awakeItem
+
+func (q awakeQueue) Len() int            { return len(q) }
+func (q awakeQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q awakeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *awakeQueue) Push(x interface{}) { *q = append(*q, x.(awakeItem)) }
+func (q *awakeQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// schedule 登记一个定时唤醒, 同一个 Flap 的同一时刻只登记一次, 调用方需持有 soar.lock
+func (soar *Soar) schedule(flapID ID, at time.Time) {
+	if t, ok := soar.scheduled[flapID]; ok && t.Equal(at) {
+		return
+	}
+	soar.scheduled[flapID] = at
+	heap.Push(&soar.timers, awakeItem{at: at, flapID: flapID})
+}
+
+// popDue 弹出所有已到期的唤醒项, 返回对应的 Flap ID, 调用方需持有 soar.lock
+func (soar *Soar) popDue(now time.Time) []ID {
+	var due []ID
+	for soar.timers.Len() > 0 && !soar.timers[0].at.After(now) {
+		item := heap.Pop(&soar.timers).(awakeItem)
+		// 已被更新的登记项视为过期, 直接丢弃
+		if t, ok := soar.scheduled[item.flapID]; ok && t.Equal(item.at) {
+			delete(soar.scheduled, item.flapID)
+			due = append(due, item.flapID)
+		}
+	}
+	return due
+}
+
+// nextAwake 返回距离下一个唤醒时刻的时长, 没有待唤醒项时返回 false, 调用方需持有 soar.lock
+func (soar *Soar) nextAwake(now time.Time) (time.Duration, bool) {
+	if soar.timers.Len() == 0 {
+		return 0, false
+	}
+	return soar.timers[0].at.Sub(now), true
+}
+
+// notify 唤醒 Soar 的调度循环, 不会阻塞
+func (soar *Soar) notify() {
+	select {
+	case soar.wake <- struct{}{}:
+	default:
+	}
+}
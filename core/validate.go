@@ -0,0 +1,562 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bagaking/wyvern/core/flaps"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrInvalidConfig 表示 Wyvern 配置存在问题, 由 ValidateWyvernConfig 和 NewSoar 返回的 ConfigErrors 匹配
+	ErrInvalidConfig = errors.New("invalid wyvern config")
+	// ErrEmptyName 表示 Soar 或 Flap 的名称为空
+	ErrEmptyName = errors.New("empty name")
+	// ErrDuplicateSoarName 表示存在同名的 Soar
+	ErrDuplicateSoarName = errors.New("duplicate soar name")
+	// ErrUnknownFlapRef 表示 prevFlaps 或 nextFlaps 引用了不存在的 Flap
+	ErrUnknownFlapRef = errors.New("unknown flap reference")
+	// ErrFlapCycle 表示 Flap 之间的依赖存在环
+	ErrFlapCycle = errors.New("flap dependency cycle")
+	// ErrUnreachableFlap 表示 Flap 依赖环上的 Flap, 永远不会被执行
+	ErrUnreachableFlap = errors.New("unreachable flap")
+)
+
+// position 配置字段在 YAML 文本中的位置
+type position struct {
+	file         string
+	line, column int
+}
+
+// String 返回 file:line 形式的位置, 不是从文件加载时返回 line N
+func (pos position) String() string {
+	if pos.file != "" {
+		return fmt.Sprintf("%s:%d", pos.file, pos.line)
+	}
+	return fmt.Sprintf("line %d", pos.line)
+}
+
+// ConfigError 配置中的一个问题
+type ConfigError struct {
+	// File 问题字段所在的文件, 配置不是从文件加载时为空
+	File string
+	// Line 问题字段在 YAML 中的行号, 从 1 开始, 配置不是从 YAML 加载时为 0
+	Line int
+	// Column 问题字段在 YAML 中的列号, 从 1 开始, 配置不是从 YAML 加载时为 0
+	Column int
+	// Soar 问题所在的 Soar 名称
+	Soar string
+	// Flap 问题所在的 Flap 名称, 问题不属于某个 Flap 时为空
+	Flap string
+	// Err 具体的错误
+	Err error
+}
+
+// Error 实现 error 接口
+func (e *ConfigError) Error() string {
+	b := strings.Builder{}
+	if e.Line > 0 {
+		b.WriteString(position{file: e.File, line: e.Line}.String())
+		b.WriteString(": ")
+	}
+	fmt.Fprintf(&b, "soar %q", e.Soar)
+	if e.Flap != "" {
+		fmt.Fprintf(&b, ", flap %q", e.Flap)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+// Unwrap 返回具体的错误
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors 配置中的所有问题, 从 YAML 加载的配置按文件和行号排列
+type ConfigErrors []*ConfigError
+
+// sortByLine 按文件和行号排列问题, 位置相同或未知时保持原有顺序
+func (errs ConfigErrors) sortByLine() {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].File != errs[j].File {
+			return errs[i].File < errs[j].File
+		}
+		return errs[i].Line < errs[j].Line
+	})
+}
+
+// Error 实现 error 接口, 每个问题以 "; " 分隔
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidConfig, strings.Join(msgs, "; "))
+}
+
+// Is 匹配 ErrInvalidConfig 以及任意一个问题的错误
+func (errs ConfigErrors) Is(target error) bool {
+	if target == ErrInvalidConfig {
+		return true
+	}
+	for _, e := range errs {
+		if errors.Is(e, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWyvernConfig 检查配置中的所有 Soar 以及子 Soar 插件的引用, 一次返回所有问题, 没有问题时返回 nil
+// 从 LoadWyvernConfig 加载的配置会在问题中带上 YAML 行号, 返回的错误为 ConfigErrors
+func ValidateWyvernConfig(conf *WyvernConfig) error {
+	errs := ConfigErrors{}
+	defined := make(map[string]position)
+	for _, soarConf := range conf.Soars {
+		errs = append(errs, soarConf.validate()...)
+		if soarConf.Name == "" {
+			continue
+		}
+		if pos, ok := defined[soarConf.Name]; ok {
+			errs = append(errs, soarConf.configError("name", "", fmt.Errorf("%w: first defined at %s", ErrDuplicateSoarName, pos)))
+			continue
+		}
+		defined[soarConf.Name] = soarConf.positionOf("name")
+	}
+	errs = append(errs, validateSubSoars(conf, defined)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	errs.sortByLine()
+	return errs
+}
+
+// validateSubSoars 检查子 Soar 插件引用的 Soar 都存在, 且 Soar 之间的引用没有环
+func validateSubSoars(conf *WyvernConfig, defined map[string]position) ConfigErrors {
+	errs := ConfigErrors{}
+	names := make([]string, 0, len(defined))
+	refs := make(map[string][]string, len(defined))
+	for _, soarConf := range conf.Soars {
+		if _, ok := refs[soarConf.Name]; ok || soarConf.Name == "" {
+			continue
+		}
+		names = append(names, soarConf.Name)
+		refs[soarConf.Name] = []string{}
+		for i, flapConf := range soarConf.Flaps {
+			path := fmt.Sprintf("flaps[%d]", i)
+			refPaths := []string{path + ".pluginConfig"}
+			refNames := []string{subSoarRef(flapConf.Plugin, flapConf.PluginConfig)}
+			if flapConf.Compensate != nil {
+				refPaths = append(refPaths, path+".compensate.pluginConfig")
+				refNames = append(refNames, subSoarRef(flapConf.Compensate.Plugin, flapConf.Compensate.PluginConfig))
+			}
+			for j, name := range refNames {
+				if name == "" {
+					continue
+				}
+				if _, exist := defined[name]; !exist {
+					errs = append(errs, soarConf.configError(refPaths[j], flapConf.Name, fmt.Errorf("%w: sub soar %q", ErrSoarNotFound, name)))
+					continue
+				}
+				refs[soarConf.Name] = append(refs[soarConf.Name], name)
+			}
+		}
+	}
+	for _, cycle := range findCycles(names, refs) {
+		soarConf, _ := conf.GetSoarConfByName(cycle[0])
+		errs = append(errs, soarConf.configError("name", "", fmt.Errorf("%w: %s", ErrSubSoarCycle, strings.Join(cycle, " -> "))))
+	}
+	return errs
+}
+
+// subSoarRef 返回子 Soar 插件配置中引用的 Soar 配置名, 不是子 Soar 插件或配置名为模板表达式时返回空字符串
+func subSoarRef(plugin string, pluginConfig any) string {
+	if plugin != SubSoarPluginName {
+		return ""
+	}
+	conf, _ := pluginConfig.(map[string]any)
+	name, _ := conf["soar"].(string)
+	if hasTemplate(name) {
+		return ""
+	}
+	return name
+}
+
+// Validate 检查 Soar 配置, 一次返回所有问题, 没有问题时返回 nil, 返回的错误为 ConfigErrors
+func (conf SoarConfig) Validate() error {
+	if errs := conf.validate(); len(errs) > 0 {
+		errs.sortByLine()
+		return errs
+	}
+	return nil
+}
+
+// validate 检查 Soar 配置的名称、运行参数的声明、Flap 的名称、引用、插件、启动条件、重试策略以及 Flap 之间的依赖关系
+func (conf SoarConfig) validate() ConfigErrors {
+	errs := ConfigErrors{}
+	if conf.Name == "" {
+		errs = append(errs, conf.configError("name", "", fmt.Errorf("%w: soar", ErrEmptyName)))
+	}
+
+	// 运行参数的声明
+	inputs := make(map[string]bool, len(conf.Inputs))
+	for i, input := range conf.Inputs {
+		path := fmt.Sprintf("inputs[%d]", i)
+		switch {
+		case input.Name == "":
+			errs = append(errs, conf.configError(path+".name", "", fmt.Errorf("%w: input", ErrEmptyName)))
+		case inputs[input.Name]:
+			errs = append(errs, conf.configError(path+".name", "", fmt.Errorf("%w: duplicate input %s", ErrInvalidInput, input.Name)))
+		default:
+			inputs[input.Name] = true
+		}
+		if err := input.Validate(); err != nil {
+			errs = append(errs, conf.configError(path, "", err))
+		}
+	}
+
+	// 第一个同名 Flap 的下标
+	index := make(map[string]int, len(conf.Flaps))
+	for i, flapConf := range conf.Flaps {
+		path := fmt.Sprintf("flaps[%d]", i)
+		if flapConf.Name == "" {
+			errs = append(errs, conf.configError(path+".name", "", fmt.Errorf("%w: flap", ErrEmptyName)))
+		} else if first, ok := index[flapConf.Name]; ok {
+			errs = append(errs, conf.configError(path+".name", flapConf.Name,
+				fmt.Errorf("%w: first defined at %s", ErrDuplicateFlapName, conf.positionOf(fmt.Sprintf("flaps[%d].name", first)))))
+		} else {
+			index[flapConf.Name] = i
+		}
+		errs = append(errs, conf.validateFlap(path, flapConf)...)
+		errs = append(errs, conf.validateInputRefs(path, flapConf, inputs)...)
+	}
+
+	// 由 prevFlaps 和 nextFlaps 共同确定的依赖关系, 只包含存在的 Flap
+	next := make(map[string][]string, len(index))
+	parents := make(map[string]map[string]bool, len(index))
+	addEdge := func(from, to string) {
+		for _, name := range next[from] {
+			if name == to {
+				return
+			}
+		}
+		next[from] = append(next[from], to)
+		if parents[to] == nil {
+			parents[to] = make(map[string]bool)
+		}
+		parents[to][from] = true
+	}
+	for i, flapConf := range conf.Flaps {
+		for j, name := range flapConf.NextFlaps {
+			if _, ok := index[name]; !ok {
+				errs = append(errs, conf.configError(fmt.Sprintf("flaps[%d].nextFlaps[%d]", i, j), flapConf.Name,
+					fmt.Errorf("%w: %q in nextFlaps", ErrUnknownFlapRef, name)))
+			} else if flapConf.Name != "" {
+				addEdge(flapConf.Name, name)
+			}
+		}
+		for j, name := range flapConf.PrevFlaps {
+			if _, ok := index[name]; !ok {
+				errs = append(errs, conf.configError(fmt.Sprintf("flaps[%d].prevFlaps[%d]", i, j), flapConf.Name,
+					fmt.Errorf("%w: %q in prevFlaps", ErrUnknownFlapRef, name)))
+			} else if flapConf.Name != "" {
+				addEdge(name, flapConf.Name)
+			}
+		}
+	}
+
+	// 启动条件只能引用父节点的输出
+	for i, flapConf := range conf.Flaps {
+		for j, src := range flapConf.Conditions {
+			programs, err := compileConditions(flapConf.Name, []string{src})
+			if err != nil {
+				continue
+			}
+			for _, ref := range programs[0].Refs() {
+				if ref[0] == "flaps" && len(ref) > 1 && !parents[flapConf.Name][ref[1]] {
+					errs = append(errs, conf.configError(fmt.Sprintf("flaps[%d].conditions[%d]", i, j), flapConf.Name,
+						fmt.Errorf("%w: %q: %q is not a parent flap", ErrInvalidCondition, src, ref[1])))
+				}
+			}
+		}
+	}
+
+	// 按配置顺序排列的 Flap 名称, 同名的 Flap 只保留第一个
+	names := make([]string, 0, len(index))
+	for i, flapConf := range conf.Flaps {
+		if flapConf.Name != "" && index[flapConf.Name] == i {
+			names = append(names, flapConf.Name)
+		}
+	}
+
+	// 检查环, 每个环只报告一次, 路径从环上第一个出现在配置中的 Flap 开始
+	onCycle := make(map[string]bool)
+	for _, cycle := range findCycles(names, next) {
+		for _, name := range cycle[:len(cycle)-1] {
+			onCycle[name] = true
+		}
+		errs = append(errs, conf.configError(fmt.Sprintf("flaps[%d]", index[cycle[0]]), cycle[0],
+			fmt.Errorf("%w: %s", ErrFlapCycle, strings.Join(cycle, " -> "))))
+	}
+
+	// 按拓扑序从根 Flap 开始推进, 无法推进到的 Flap 永远不会被执行, 位于环上的 Flap 已经报告过
+	remaining := make(map[string]int, len(names))
+	ready := make([]string, 0, len(names))
+	for _, name := range names {
+		remaining[name] = len(parents[name])
+		if remaining[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		for _, child := range next[name] {
+			if remaining[child]--; remaining[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	for _, name := range names {
+		if remaining[name] > 0 && !onCycle[name] {
+			errs = append(errs, conf.configError(fmt.Sprintf("flaps[%d]", index[name]), name,
+				fmt.Errorf("%w: depends on a flap in a cycle", ErrUnreachableFlap)))
+		}
+	}
+	return errs
+}
+
+// validateFlap 检查单个 Flap 的插件、补偿动作、启动条件和重试策略
+func (conf SoarConfig) validateFlap(path string, flapConf flaps.FlapConfig) ConfigErrors {
+	errs := ConfigErrors{}
+	if err := validatePlugin(flapConf.Plugin, flapConf.PluginConfig); err != nil {
+		field := ".pluginConfig"
+		if errors.Is(err, flaps.ErrPluginNotFound) {
+			field = ".plugin"
+		}
+		errs = append(errs, conf.configError(path+field, flapConf.Name, err))
+	}
+	if flapConf.Compensate != nil {
+		if err := validatePlugin(flapConf.Compensate.Plugin, flapConf.Compensate.PluginConfig); err != nil {
+			field := ".compensate.pluginConfig"
+			if errors.Is(err, flaps.ErrPluginNotFound) {
+				field = ".compensate.plugin"
+			}
+			errs = append(errs, conf.configError(path+field, flapConf.Name, fmt.Errorf("compensate: %w", err)))
+		}
+	}
+	for i, src := range flapConf.Conditions {
+		if _, err := compileConditions(flapConf.Name, []string{src}); err != nil {
+			errs = append(errs, conf.configError(fmt.Sprintf("%s.conditions[%d]", path, i), flapConf.Name, err))
+		}
+	}
+	if flapConf.Retry != nil {
+		if err := flapConf.Retry.Validate(); err != nil {
+			errs = append(errs, conf.configError(path+".retry", flapConf.Name, err))
+		}
+	}
+	return errs
+}
+
+// validateInputRefs 检查插件配置、补偿动作配置和启动条件引用的运行参数都已声明
+func (conf SoarConfig) validateInputRefs(path string, flapConf flaps.FlapConfig, inputs map[string]bool) ConfigErrors {
+	errs := ConfigErrors{}
+	check := func(field, name string) {
+		if !inputs[name] {
+			errs = append(errs, conf.configError(path+field, flapConf.Name, fmt.Errorf("%w: inputs.%s is not declared", ErrInvalidInput, name)))
+		}
+	}
+	for _, name := range templateInputRefs(flapConf.PluginConfig) {
+		check(".pluginConfig", name)
+	}
+	if flapConf.Compensate != nil {
+		for _, name := range templateInputRefs(flapConf.Compensate.PluginConfig) {
+			check(".compensate.pluginConfig", name)
+		}
+	}
+	for i, src := range flapConf.Conditions {
+		programs, err := compileConditions(flapConf.Name, []string{src})
+		if err != nil {
+			continue
+		}
+		for _, ref := range programs[0].Refs() {
+			if ref[0] == "inputs" && len(ref) > 1 {
+				check(fmt.Sprintf(".conditions[%d]", i), ref[1])
+			}
+		}
+	}
+	return errs
+}
+
+// templateInputRefs 返回配置中的模板表达式引用的所有运行参数名
+func templateInputRefs(config any) []string {
+	var names []string
+	switch v := config.(type) {
+	case string:
+		for _, match := range templatePattern.FindAllStringSubmatch(v, -1) {
+			if keys := strings.Split(match[1], "."); keys[0] == "inputs" && len(keys) > 1 {
+				names = append(names, keys[1])
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			names = append(names, templateInputRefs(v[key])...)
+		}
+	case []any:
+		for _, item := range v {
+			names = append(names, templateInputRefs(item)...)
+		}
+	}
+	return names
+}
+
+// validatePlugin 检查插件是否已注册, 并通过实例化检查插件配置
+// 包含模板表达式的配置在渲染前无法由插件检查, 只检查插件已注册
+func validatePlugin(plugin string, pluginConfig any) error {
+	if plugin == "" {
+		return fmt.Errorf("%w: plugin is empty", flaps.ErrPluginNotFound)
+	}
+	if flaps.GetFlapActionMaker(plugin) == nil {
+		return fmt.Errorf("%w: %q", flaps.ErrPluginNotFound, plugin)
+	}
+	if hasTemplate(pluginConfig) {
+		return nil
+	}
+	if _, err := flaps.MakeFlapAction(plugin, pluginConfig); err != nil {
+		if errors.Is(err, flaps.ErrInvalidPluginConfig) {
+			return err
+		}
+		return fmt.Errorf("%w: %s: %v", flaps.ErrInvalidPluginConfig, plugin, err)
+	}
+	return nil
+}
+
+// findCycles 按 names 的顺序 DFS 查找依赖关系中的环, 每个环以起点结尾, 例如 [a b c a]
+func findCycles(names []string, next map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	order := make(map[string]int, len(names))
+	for i, name := range names {
+		order[name] = i
+	}
+	state := make(map[string]int, len(names))
+	stack := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	cycles := make([][]string, 0)
+
+	var dfs func(name string)
+	dfs = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, child := range next[name] {
+			switch state[child] {
+			case unvisited:
+				dfs(child)
+			case visiting:
+				// 从栈中截取环, 并旋转到配置中最靠前的 Flap 以便去重
+				start := len(stack) - 1
+				for stack[start] != child {
+					start--
+				}
+				cycle := append([]string{}, stack[start:]...)
+				first := 0
+				for i, n := range cycle {
+					if order[n] < order[cycle[first]] {
+						first = i
+					}
+				}
+				cycle = append(cycle[first:], cycle[:first]...)
+				cycle = append(cycle, cycle[0])
+				if key := strings.Join(cycle, "\x00"); !seen[key] {
+					seen[key] = true
+					cycles = append(cycles, cycle)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			dfs(name)
+		}
+	}
+	return cycles
+}
+
+// configError 创建位于 path 字段的 ConfigError
+func (conf SoarConfig) configError(path, flap string, err error) *ConfigError {
+	pos := conf.positionOf(path)
+	return &ConfigError{File: pos.file, Line: pos.line, Column: pos.column, Soar: conf.Name, Flap: flap, Err: err}
+}
+
+// positionOf 返回字段在 YAML 中的位置, 字段不存在时依次使用上层字段的位置
+func (conf SoarConfig) positionOf(path string) position {
+	for {
+		if pos, ok := conf.positions[path]; ok {
+			return pos
+		}
+		if path == "" {
+			return position{}
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			path = ""
+		} else {
+			path = path[:i]
+		}
+	}
+}
+
+// collectPositions 记录 node 下所有字段的位置, key 为相对 node 的字段路径, node 自身的 key 为空
+// files 记录节点所在的文件, 为 nil 时位置中不包含文件
+func collectPositions(node *yaml.Node, files map[*yaml.Node]string) map[string]position {
+	positions := make(map[string]position)
+	var walk func(path string, n *yaml.Node)
+	walk = func(path string, n *yaml.Node) {
+		positions[path] = position{file: files[n], line: n.Line, column: n.Column}
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := n.Content[i].Value
+				if path != "" {
+					key = path + "." + key
+				}
+				walk(key, n.Content[i+1])
+				// 字段的位置以 key 为准, 值为多行的映射或数组时仍指向字段所在的行
+				positions[key] = position{file: files[n.Content[i]], line: n.Content[i].Line, column: n.Content[i].Column}
+			}
+		case yaml.SequenceNode:
+			for i, item := range n.Content {
+				walk(fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+	}
+	walk("", node)
+	return positions
+}
+
+// mappingValue 返回映射节点中 key 对应的值, 不存在时返回 nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -3,11 +3,18 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bagaking/wyvern/util"
 )
 
 var (
 	//ErrSoarNotFound - Soar 不存在
 	ErrSoarNotFound = errors.New("soar not found")
+	// ErrWyvernClosed - Wyvern 已经关闭, 不再运行 Soar
+	ErrWyvernClosed = errors.New("wyvern is closed")
 )
 
 // Wyvern 结构体表示 Wyvern 编排系统
@@ -18,41 +25,311 @@ type Wyvern struct {
 	// Store 用于序列化和存储 soar 和 flap 的数据
 	// 默认情况下, Soar 运行在内存中, 当故障发生时, 可以通过 Store 进行恢复
 	Store
+
+	// pool 全局 worker 池, 限制当前实例上所有 Soar 同时执行的 Flap 数量
+	pool *WorkerPool
+	// checkpointOpts 新加载的 Soar 写入 Store 的批量设置
+	checkpointOpts CheckpointOptions
+	// recoverPolicy Recover 时处理中断 Flap 的策略
+	recoverPolicy RecoverPolicy
+	// config 从 Store 恢复的 Soar 运行子 Soar 时使用的配置
+	config *WyvernConfig
+	// id 当前实例的 ID, 作为审计事件的 Actor
+	id string
+	// events 记录状态变化的审计日志, 为 nil 时不记录
+	events EventLog
+	// lease 多实例共享的租约, 为 nil 时不限制 Soar 在哪个实例上运行
+	lease Lease
+	// leaseOpts 租约的续期设置
+	leaseOpts LeaseOptions
+	// soarsLock 保护 Soars 的并发读写
+	soarsLock sync.RWMutex
+
+	// closeLock 保护 closed, 保证 Close 之后不会再有新的运行加入 running
+	closeLock sync.Mutex
+	closed    bool
+	// done 在 Close 时关闭, 通知 Serve 退出
+	done chan struct{}
+	// running 跟踪 start 启动的协程, Close 时等待其全部退出
+	running sync.WaitGroup
+	// ctx 由 Wyvern 持有, 补偿等不随单次运行结束的收尾工作在其下执行, Close 结束时取消
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// NewWyvern 创建一个 Wyvern
+// NewWyvern 创建一个 Wyvern, 默认不限制全局并行度
 func NewWyvern(s Store) *Wyvern {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Wyvern{
-		Soars: make(map[string]*Soar),
-		Store: s,
+		Soars:  make(map[string]*Soar),
+		Store:  s,
+		pool:   NewWorkerPool(0),
+		id:     newInstanceID(),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-// Run 运行指定名称的 Soar
-func (w *Wyvern) Run(ctx context.Context, name string) error {
-	// 获取指定名称的 Soar
-	soar, ok := w.Soars[name]
+// ID 返回当前实例的 ID
+func (w *Wyvern) ID() string {
+	return w.id
+}
+
+// SetEventLog 设置记录状态变化的审计日志, 只对之后加载的 Soar 生效
+func (w *Wyvern) SetEventLog(events EventLog) {
+	w.events = events
+}
+
+// Events 查询审计日志中的事件, 未设置审计日志时返回 nil
+func (w *Wyvern) Events(q EventQuery) ([]Event, error) {
+	if w.events == nil {
+		return nil, nil
+	}
+	return w.events.Query(q)
+}
+
+// History 通过重放审计日志还原 Soar 在 at 时刻的状态, at 为零值时还原最新的状态
+func (w *Wyvern) History(soarID ID, at time.Time) (RunResult, error) {
+	events, err := w.Events(EventQuery{SoarID: soarID, Until: at})
+	if err != nil {
+		return RunResult{}, err
+	}
+	if len(events) == 0 {
+		return RunResult{}, ErrSoarNotFound
+	}
+	return ReplayEvents(soarID, events, at)
+}
+
+// SetMaxParallelism 设置当前实例上所有 Soar 同时执行的 Flap 数量上限, 小于等于 0 表示不限制
+// 只对之后加载的 Soar 生效
+func (w *Wyvern) SetMaxParallelism(n int) {
+	w.pool = NewWorkerPool(n)
+}
+
+// SetCheckpointOptions 设置 Soar 将状态变化写入 Store 的批量方式, 只对之后加载的 Soar 生效
+func (w *Wyvern) SetCheckpointOptions(opts CheckpointOptions) {
+	w.checkpointOpts = opts
+}
+
+// Run 运行指定 ID 的 Soar, 返回可以等待运行结果的句柄, 等同于不传入运行参数的 RunWithInputs
+// 运行过程中的状态变化由 Soar 写入 Store, 写入失败时 Soar 以 ErrSoarCheckpoint 失败
+// 设置了租约时先获取 Soar 的租约, 租约由其他实例持有时返回 ErrSoarLeased
+func (w *Wyvern) Run(ctx context.Context, soarID string) (*RunHandle, error) {
+	return w.RunWithInputs(ctx, soarID, nil)
+}
+
+// RunWithInputs 以 inputs 为运行参数运行指定 ID 的 Soar, 返回可以等待运行结果的句柄
+// 运行参数在第一次运行时按 Soar 的参数声明检查并绑定, 不符合声明时返回 ErrInvalidInput;
+// 之后再次运行 (例如停止后继续运行) 沿用已绑定的参数, 此时传入不为 nil 的 inputs 返回 ErrInputsBound
+// 参数在获取租约之后绑定, 未能获取租约或启动失败时 Soar 保持未绑定, 之后可以重新传入参数运行
+func (w *Wyvern) RunWithInputs(ctx context.Context, soarID string, inputs map[string]any) (*RunHandle, error) {
+	if w.isClosed() {
+		return nil, ErrWyvernClosed
+	}
+	// 获取指定 ID 的 Soar
+	soar, ok := w.GetSoar(soarID)
+	if !ok {
+		return nil, ErrSoarNotFound
+	}
+	ok, err := w.acquireLease(soarID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSoarLeased, soarID)
+	}
+	unbind, err := soar.bindInputs(inputs)
+	if err != nil {
+		w.releaseLease(soarID)
+		return nil, err
+	}
+	handle, err := w.start(ctx, soar)
+	if err != nil {
+		if unbind != nil {
+			unbind()
+		}
+		w.releaseLease(soarID)
+	}
+	return handle, err
+}
+
+// GetSoar 获取当前实例上指定 ID 的 Soar
+func (w *Wyvern) GetSoar(soarID string) (*Soar, bool) {
+	w.soarsLock.RLock()
+	defer w.soarsLock.RUnlock()
+	soar, ok := w.Soars[soarID]
+	return soar, ok
+}
+
+// Pause 暂停指定 ID 的 Soar, 并持久化其状态
+func (w *Wyvern) Pause(soarID string) error {
+	return w.control(soarID, (*Soar).Pause)
+}
+
+// Resume 恢复被暂停的 Soar, 并持久化其状态
+func (w *Wyvern) Resume(soarID string) error {
+	return w.control(soarID, (*Soar).Resume)
+}
+
+// Stop 停止在当前实例上运行指定 ID 的 Soar, 等待执行中的 Flap 结束, 不改变 Soar 的状态
+func (w *Wyvern) Stop(soarID string) error {
+	return w.control(soarID, (*Soar).Stop)
+}
+
+// Cancel 取消指定 ID 的 Soar, 执行中的 Flap 会通过 context 收到取消信号, 并持久化其状态
+func (w *Wyvern) Cancel(soarID string) error {
+	return w.control(soarID, (*Soar).Cancel)
+}
+
+// control 对指定 ID 的 Soar 执行生命周期操作, 成功后将 Soar 的状态写入 Store
+func (w *Wyvern) control(soarID string, op func(*Soar) error) error {
+	soar, ok := w.GetSoar(soarID)
 	if !ok {
 		return ErrSoarNotFound
 	}
-	// 运行 Soar
-	soar.Soar(ctx)
-	return nil
+	if err := op(soar); err != nil {
+		return err
+	}
+	err := soar.checkpoint(true)
+	// 运行中的 Soar 在调度循环退出后重新加载
+	if errors.Is(err, ErrRevisionConflict) && !soar.isRunning() {
+		w.reload(soar)
+	}
+	return err
+}
+
+// Close 关闭 Wyvern: 之后 Run 和 Recover 返回 ErrWyvernClosed, Serve 退出,
+// 当前实例上运行中的 Soar 与 Stop 一样不再派发新的 Flap, Close 等待执行中的 Flap 结束和所有运行的协程退出
+// ctx 先结束时通过 context 中断执行中的 Flap 和补偿, 不再等待并返回 ctx 的错误
+// Soar 的状态保持不变, 之后可以再由其他实例通过 Recover 继续运行或补偿
+func (w *Wyvern) Close(ctx context.Context) error {
+	w.closeLock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+	}
+	w.closeLock.Unlock()
+
+	soars := w.listSoars()
+	for _, soar := range soars {
+		_ = soar.Stop()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		// 中断执行中的补偿和 Flap
+		w.cancel()
+		for _, soar := range soars {
+			soar.interrupt()
+		}
+		return ctx.Err()
+	}
+}
+
+// isClosed 判断 Wyvern 是否已经关闭
+func (w *Wyvern) isClosed() bool {
+	w.closeLock.Lock()
+	defer w.closeLock.Unlock()
+	return w.closed
+}
+
+// listSoars 返回当前实例上所有 Soar 的快照
+func (w *Wyvern) listSoars() []*Soar {
+	w.soarsLock.RLock()
+	defer w.soarsLock.RUnlock()
+	soars := make([]*Soar, 0, len(w.Soars))
+	for _, soar := range w.Soars {
+		soars = append(soars, soar)
+	}
+	return soars
 }
 
 // LoadFromConfig 从 WyvernConfig 配置加载某个名字的 Soar, 并返回其 id
 func (w *Wyvern) LoadFromConfig(conf *WyvernConfig, name string) (string, error) {
+	soar, err := w.load(conf, name, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return soar.id, nil
+}
+
+// load 从配置创建名为 name 的 Soar 并加入 Soar 清单, parent 不为 nil 时创建的是 parent 中 flapID 对应的 Flap 的子 Soar
+func (w *Wyvern) load(conf *WyvernConfig, name string, parent *Soar, flapID ID) (*Soar, error) {
 	// 遍历获取指定名称的 Soar 配置
 	soarConf, ok := conf.GetSoarConfByName(name)
 	if !ok {
-		return "", ErrSoarNotFound
+		return nil, fmt.Errorf("%w: %s", ErrSoarNotFound, name)
 	}
 	// 使用 NewSoar 方法从配置创建 Soar
 	soar, err := NewSoar(soarConf, w.Store)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	soar.config = conf
+	if parent != nil {
+		soar.parentID, soar.parentFlap = parent.id, flapID
+		// NewSoar 保存的记录中还没有父 Soar, 由下面的 checkpoint 写入
+		soar.soarDirty = true
 	}
 	// 将 Soar 加入到 Wyvern 的 Soar 清单中
+	w.addSoar(soar)
+	// 记录创建事件
+	soar.lock.Lock()
+	soar.recordCreated()
+	soar.lock.Unlock()
+	if err = soar.checkpoint(true); err != nil {
+		return nil, err
+	}
+	return soar, nil
+}
+
+// addSoar 注入运行时依赖, 并将 Soar 加入到 Wyvern 的 Soar 清单中
+func (w *Wyvern) addSoar(soar *Soar) {
+	w.inject(soar)
+	w.soarsLock.Lock()
 	w.Soars[soar.id] = soar
-	return soar.id, nil
+	w.soarsLock.Unlock()
+}
+
+// inject 注入全局 worker 池、批量设置和审计日志
+func (w *Wyvern) inject(soar *Soar) {
+	soar.pool, soar.checkpointOpts = w.pool, w.checkpointOpts
+	soar.events, soar.actor = w.events, w.id
+	soar.wyvern = w
+}
+
+// reload 在写入冲突后从 Store 重新加载 Soar, 替换 Soar 清单中的旧 Soar, 重新加载的 Soar 不会自动运行
+// 加载失败时将旧 Soar 从清单中移除, 之后可以通过 Recover 恢复
+func (w *Wyvern) reload(stale *Soar) {
+	soar, err := RestoreSoar(stale.id, w.Store)
+	if err == nil {
+		w.inject(soar)
+	}
+	w.soarsLock.Lock()
+	defer w.soarsLock.Unlock()
+	if w.Soars[stale.id] != stale {
+		return
+	}
+	if err != nil {
+		delete(w.Soars, stale.id)
+		return
+	}
+	w.Soars[stale.id] = soar
+}
+
+// newInstanceID 生成 Wyvern 实例的 ID
+func newInstanceID() string {
+	id, err := util.GenID(0)
+	if err != nil {
+		panic(err)
+	}
+	return util.Base58EncodeUInt64(id)
 }
@@ -0,0 +1,149 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+	"github.com/bagaking/wyvern/store/memory"
+)
+
+func TestClose(t *testing.T) {
+	w, s := newWyvern(t)
+	started, release := make(chan string, 1), make(chan struct{})
+	first := behave(t, gated(started, release))
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, "none"), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the running flap finished: %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(runTimeout):
+		t.Fatal("Close did not return")
+	}
+
+	// Close 返回时运行已经结束, 与 Stop 一样保持 Soar 的状态
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("expect run to be finished after Close")
+	}
+	if _, err := h.Wait(context.Background()); !errors.Is(err, core.ErrSoarStopped) {
+		t.Errorf("expect ErrSoarStopped, got %v", err)
+	}
+	if _, err := w.Run(context.Background(), id); !errors.Is(err, core.ErrWyvernClosed) {
+		t.Errorf("Run after Close: expect ErrWyvernClosed, got %v", err)
+	}
+	if _, err := w.Recover(context.Background()); !errors.Is(err, core.ErrWyvernClosed) {
+		t.Errorf("Recover after Close: expect ErrWyvernClosed, got %v", err)
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// 其他实例可以继续运行被关闭的实例上停止的 Soar
+	w2 := core.NewWyvern(s)
+	handles, err := w2.Recover(context.Background())
+	if err != nil || len(handles) != 1 {
+		t.Fatalf("Recover: expect 1 handle, got %d (%v)", len(handles), err)
+	}
+	if _, err = waitRun(t, handles[0]); err != nil {
+		t.Errorf("recovered run: %v", err)
+	}
+}
+
+func TestCloseInterruptsOnContextEnd(t *testing.T) {
+	w, _ := newWyvern(t)
+	started := make(chan string, 1)
+	interrupted := make(chan struct{})
+	first := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		started <- ac.FlapName
+		<-ctx.Done()
+		close(interrupted)
+		return nil, ctx.Err()
+	})
+	id := mustLoad(t, w, fmt.Sprintf(chainYAML, first, "none"), "chain")
+	h := mustRun(t, w, id)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-interrupted:
+	case <-time.After(runTimeout):
+		t.Fatal("expect running flap to be interrupted")
+	}
+	if _, err := waitRun(t, h); !errors.Is(err, core.ErrSoarStopped) {
+		t.Errorf("expect ErrSoarStopped, got %v", err)
+	}
+}
+
+func TestCloseInterruptsCompensation(t *testing.T) {
+	w, s := newWyvern(t)
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	// 补偿动作忽略取消信号且没有配置超时
+	undo := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		entered <- struct{}{}
+		<-release
+		return &flaps.ActionResult{}, nil
+	})
+	fail := behave(t, func(ctx context.Context, ac *flaps.ActionContext, config map[string]any) (*flaps.ActionResult, error) {
+		return nil, errors.New("boom")
+	})
+	id := mustLoad(t, w, fmt.Sprintf(compensateYAML, undo, fail), "rollback")
+	h := mustRun(t, w, id)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+	result, _ := waitRun(t, h)
+	// 被中断的补偿不记录结果, 之后由 Recover 继续补偿
+	if result.Status != core.SoarStatusCompensating || result.Flaps["a"].Compensation != core.CompensationNone {
+		t.Errorf("expect interrupted compensation, got %s / %s", result.Status, result.Flaps["a"].Compensation)
+	}
+	probe := &core.Soar{}
+	if err := s.LoadSoar(probe, id); err != nil || probe.Status() != core.SoarStatusCompensating {
+		t.Errorf("expect compensating status in store, got %s (%v)", probe.Status(), err)
+	}
+}
+
+func TestCloseStopsServe(t *testing.T) {
+	w, _ := newWyvern(t)
+	w.SetLease(memory.NewLease(), core.LeaseOptions{TTL: time.Second, RenewInterval: 5 * time.Millisecond})
+	served := make(chan error, 1)
+	go func() { served <- w.Serve(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, core.ErrWyvernClosed) {
+			t.Errorf("expect ErrWyvernClosed, got %v", err)
+		}
+	case <-time.After(runTimeout):
+		t.Fatal("Serve did not return after Close")
+	}
+}
@@ -0,0 +1,111 @@
+// Package codec 定义 soar 和 flap 记录的版本化序列化格式, 供各个 Store 实现使用
+//
+// 每条编码后的记录以格式标识开头, 解码时根据标识选择 Codec, 因此同一个存储中可以混合不同格式写入的记录.
+// 目前提供 JSON 格式, 二进制格式可以通过 Register 注册新的标识接入.
+// 记录的版本只增加字段, 旧版本的记录在解码时升级到当前版本, 更新版本写入的未知字段在解码时被忽略.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// Version 当前的记录格式版本
+//
+//	1: 未包装版本信息的记录, 状态以整数表示
+//	2: 包装版本信息的记录, 状态以名称表示
+const Version = 2
+
+var (
+	// ErrUnknownFormat 表示记录的格式标识没有对应的 Codec
+	ErrUnknownFormat = errors.New("unknown record format")
+	// ErrInvalidRecord 表示记录无法解码, 或者既不是 soar 也不是 flap
+	ErrInvalidRecord = errors.New("invalid record")
+
+	// codecs 已注册的 Codec, key 为格式标识
+	codecs     = map[byte]Codec{}
+	codecsLock sync.RWMutex
+)
+
+// Record 一条 soar 或 flap 的记录, Soar 和 Flap 恰好有一个不为 nil
+type Record struct {
+	Soar *core.SoarRecord
+	Flap *core.FlapRecord
+}
+
+// Codec 将记录编码为以格式标识开头的字节
+type Codec interface {
+	// Name 格式的名称
+	Name() string
+	// Magic 格式标识, 即编码结果的第一个字节
+	Magic() byte
+	// Encode 以当前版本编码记录
+	Encode(rec Record) ([]byte, error)
+	// Decode 解码该格式的记录, 旧版本的记录会被升级到当前版本
+	Decode(data []byte) (Record, error)
+}
+
+// Register 注册 Codec, 之后 Decode 可以识别其格式标识, 相同标识的 Codec 会被覆盖
+func Register(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.Magic()] = c
+}
+
+// Decode 根据格式标识选择 Codec 解码记录
+func Decode(data []byte) (Record, error) {
+	if len(data) == 0 {
+		return Record{}, fmt.Errorf("%w: empty data", ErrInvalidRecord)
+	}
+	codecsLock.RLock()
+	c, ok := codecs[data[0]]
+	codecsLock.RUnlock()
+	if !ok {
+		return Record{}, fmt.Errorf("%w: 0x%02x", ErrUnknownFormat, data[0])
+	}
+	rec, err := c.Decode(data)
+	if err != nil {
+		return Record{}, err
+	}
+	if (rec.Soar == nil) == (rec.Flap == nil) {
+		return Record{}, fmt.Errorf("%w: record must hold exactly one soar or flap", ErrInvalidRecord)
+	}
+	return rec, nil
+}
+
+// EncodeSoar 使用 c 编码 soar 的记录
+func EncodeSoar(c Codec, rec core.SoarRecord) ([]byte, error) {
+	return c.Encode(Record{Soar: &rec})
+}
+
+// EncodeFlap 使用 c 编码 flap 的记录
+func EncodeFlap(c Codec, rec core.FlapRecord) ([]byte, error) {
+	return c.Encode(Record{Flap: &rec})
+}
+
+// DecodeSoar 解码 soar 的记录
+func DecodeSoar(data []byte) (core.SoarRecord, error) {
+	rec, err := Decode(data)
+	if err != nil {
+		return core.SoarRecord{}, err
+	}
+	if rec.Soar == nil {
+		return core.SoarRecord{}, fmt.Errorf("%w: not a soar record", ErrInvalidRecord)
+	}
+	return *rec.Soar, nil
+}
+
+// DecodeFlap 解码 flap 的记录
+func DecodeFlap(data []byte) (core.FlapRecord, error) {
+	rec, err := Decode(data)
+	if err != nil {
+		return core.FlapRecord{}, err
+	}
+	if rec.Flap == nil {
+		return core.FlapRecord{}, fmt.Errorf("%w: not a flap record", ErrInvalidRecord)
+	}
+	return *rec.Flap, nil
+}
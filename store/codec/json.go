@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// JSON 以 JSON 对象编码记录的 Codec, 格式标识为 '{'
+//
+//	{"v":2,"soar":{...}} 或 {"v":2,"flap":{...}}
+//
+// 同时可以解码版本 1 的记录: 未包装的 {"soar":{...}} / {"flap":{...}}, 以及直接序列化的 SoarRecord / FlapRecord
+var JSON Codec = jsonCodec{}
+
+func init() {
+	Register(JSON)
+}
+
+type jsonCodec struct{}
+
+// jsonEnvelope JSON 格式的记录, V 为 0 表示版本 1 的记录
+type jsonEnvelope struct {
+	V    int             `json:"v,omitempty"`
+	Soar json.RawMessage `json:"soar,omitempty"`
+	Flap json.RawMessage `json:"flap,omitempty"`
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Magic() byte { return '{' }
+
+// Encode 以当前版本编码记录
+func (jsonCodec) Encode(rec Record) ([]byte, error) {
+	env := jsonEnvelope{V: Version}
+	var err error
+	switch {
+	case rec.Soar != nil && rec.Flap == nil:
+		env.Soar, err = json.Marshal(rec.Soar)
+	case rec.Flap != nil && rec.Soar == nil:
+		env.Flap, err = json.Marshal(rec.Flap)
+	default:
+		return nil, fmt.Errorf("%w: record must hold exactly one soar or flap", ErrInvalidRecord)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Decode 解码 JSON 格式的记录, 版本 1 的记录会被升级, 更高版本的记录忽略未知字段
+func (jsonCodec) Decode(data []byte) (Record, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Record{}, fmt.Errorf("%w: %s", ErrInvalidRecord, err)
+	}
+	env := jsonEnvelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Record{}, fmt.Errorf("%w: %s", ErrInvalidRecord, err)
+	}
+	// 直接序列化的 SoarRecord / FlapRecord, 只有 flap 包含 soarID
+	if env.Soar == nil && env.Flap == nil {
+		if _, ok := raw["id"]; !ok {
+			return Record{}, fmt.Errorf("%w: neither soar nor flap", ErrInvalidRecord)
+		}
+		if _, ok := raw["soarID"]; ok {
+			env.Flap = data
+		} else {
+			env.Soar = data
+		}
+	}
+	version := env.V
+	if version == 0 {
+		version = 1
+	}
+
+	rec := Record{}
+	if env.Soar != nil {
+		rec.Soar = &core.SoarRecord{}
+		if err := decodeJSONRecord(env.Soar, version, soarUpgrades, rec.Soar); err != nil {
+			return Record{}, fmt.Errorf("%w: soar: %s", ErrInvalidRecord, err)
+		}
+	}
+	if env.Flap != nil {
+		rec.Flap = &core.FlapRecord{}
+		if err := decodeJSONRecord(env.Flap, version, flapUpgrades, rec.Flap); err != nil {
+			return Record{}, fmt.Errorf("%w: flap: %s", ErrInvalidRecord, err)
+		}
+	}
+	return rec, nil
+}
+
+// upgrade 将 version 版本的记录升级到 version+1 版本, 记录以 JSON 对象的字段表示
+type upgrade func(fields map[string]json.RawMessage) error
+
+var (
+	// soarUpgrades soar 记录的升级步骤, key 为升级前的版本
+	soarUpgrades = map[int]upgrade{
+		1: statusToName("status", func(n int) string { return core.SoarStatus(n).String() }),
+	}
+	// flapUpgrades flap 记录的升级步骤, key 为升级前的版本
+	flapUpgrades = map[int]upgrade{
+		1: chain(
+			statusToName("state", func(n int) string { return core.FlapStatus(n).String() }),
+			statusToName("compensation", func(n int) string { return core.CompensationStatus(n).String() }),
+		),
+	}
+)
+
+// decodeJSONRecord 将 version 版本的记录逐步升级到当前版本后解码到 v 中
+func decodeJSONRecord(data json.RawMessage, version int, upgrades map[int]upgrade, v any) error {
+	if version < Version {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		for ; version < Version; version++ {
+			if up, ok := upgrades[version]; ok {
+				if err := up(fields); err != nil {
+					return fmt.Errorf("upgrade from version %d: %w", version, err)
+				}
+			}
+		}
+		var err error
+		if data, err = json.Marshal(fields); err != nil {
+			return err
+		}
+	}
+	// 更高版本的记录只会增加字段, 未知字段直接忽略
+	return json.Unmarshal(data, v)
+}
+
+// statusToName 将整数表示的状态字段转换为名称
+func statusToName(field string, name func(int) string) upgrade {
+	return func(fields map[string]json.RawMessage) error {
+		raw, ok := fields[field]
+		if !ok || bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+			return nil
+		}
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("field %s: %w", field, err)
+		}
+		text, err := json.Marshal(name(n))
+		if err != nil {
+			return err
+		}
+		fields[field] = text
+		return nil
+	}
+}
+
+// chain 依次执行多个升级步骤
+func chain(ups ...upgrade) upgrade {
+	return func(fields map[string]json.RawMessage) error {
+		for _, up := range ups {
+			if err := up(fields); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,118 @@
+package codec_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/store/codec"
+)
+
+// fixture 读取 testdata 中的记录
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return data
+}
+
+func TestDecodeSoarFixtures(t *testing.T) {
+	for _, c := range []struct {
+		file string
+		want core.SoarRecord
+	}{
+		{"v1_soar.json", core.SoarRecord{ID: "s1", Name: "legacy", RootFlaps: []core.ID{"f1"}, FlapIDs: []core.ID{"f1", "f2"}, Status: core.SoarStatusFailed, Count: 3, Err: "boom"}},
+		{"v1_wrapped_soar.json", core.SoarRecord{ID: "s2", Name: "wrapped", RootFlaps: []core.ID{"f1"}, FlapIDs: []core.ID{"f1"}, Status: core.SoarStatusPaused, Count: 1}},
+		{"v3_soar.json", core.SoarRecord{ID: "s3", Revision: 7, Name: "future", RootFlaps: []core.ID{}, FlapIDs: []core.ID{}, Status: core.SoarStatusPaused, Count: 2}},
+	} {
+		got, err := codec.DecodeSoar(fixture(t, c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.file, got, c.want)
+		}
+	}
+}
+
+func TestDecodeFlapFixtures(t *testing.T) {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	awake := start.Add(time.Minute)
+	for _, c := range []struct {
+		file string
+		want core.FlapRecord
+	}{
+		{"v1_flap.json", core.FlapRecord{
+			ID: "f2", SoarID: "s1", ConfName: "b", PrevFlaps: []core.ID{"f1"}, State: core.FlapStatusErrorAndRetry,
+			Start: start, NextAwakeTime: &awake, AttemptRetryCount: 2, Err: "boom",
+			Plugin: "http", PluginConfig: map[string]any{"url": "http://x"},
+		}},
+		{"v1_wrapped_flap.json", core.FlapRecord{
+			ID: "f1", SoarID: "s1", ConfName: "a", NextFlaps: []core.ID{"f2"}, State: core.FlapStateSuccess,
+			Start: start, Plugin: "http", Output: map[string]any{"code": 200.0}, Compensation: core.CompensationSucceeded,
+		}},
+		{"v2_flap.json", core.FlapRecord{
+			ID: "f1", Revision: 4, SoarID: "s1", ConfName: "a", NextFlaps: []core.ID{"f2"}, State: core.FlapStateSuccess,
+			Start: start, Plugin: "http", Compensation: core.CompensationFailed, CompensationErr: "undo",
+		}},
+	} {
+		got, err := codec.DecodeFlap(fixture(t, c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.file, got, c.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	soar := core.SoarRecord{ID: "s", Revision: 2, Name: "n", RootFlaps: []core.ID{"a"}, FlapIDs: []core.ID{"a"}, Status: core.SoarStatusCompensating}
+	data, err := codec.EncodeSoar(codec.JSON, soar)
+	if err != nil {
+		t.Fatalf("EncodeSoar: %v", err)
+	}
+	if got, err := codec.DecodeSoar(data); err != nil || !reflect.DeepEqual(got, soar) {
+		t.Errorf("soar round trip: got %+v (%v), want %+v", got, err, soar)
+	}
+
+	flap := core.FlapRecord{ID: "a", SoarID: "s", ConfName: "a", State: core.FlapStateFailed, Start: time.Unix(100, 0).UTC(), Plugin: "p", Compensation: core.CompensationFailed}
+	data, err = codec.EncodeFlap(codec.JSON, flap)
+	if err != nil {
+		t.Fatalf("EncodeFlap: %v", err)
+	}
+	if got, err := codec.DecodeFlap(data); err != nil || !reflect.DeepEqual(got, flap) {
+		t.Errorf("flap round trip: got %+v (%v), want %+v", got, err, flap)
+	}
+	if _, err = codec.DecodeSoar(data); !errors.Is(err, codec.ErrInvalidRecord) {
+		t.Errorf("DecodeSoar on a flap: expect ErrInvalidRecord, got %v", err)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want error
+	}{
+		{"", codec.ErrInvalidRecord},
+		{"\x00abc", codec.ErrUnknownFormat},
+		{"{not json", codec.ErrInvalidRecord},
+		{`{"v":2}`, codec.ErrInvalidRecord},
+		{`{"name":"no id"}`, codec.ErrInvalidRecord},
+		{`{"v":2,"soar":{"id":"s"},"flap":{"id":"f"}}`, codec.ErrInvalidRecord},
+		{`{"soar":{"id":"s","status":"nope"}}`, codec.ErrInvalidRecord},
+		{`{"soar":{"id":"s","status":1.5}}`, codec.ErrInvalidRecord},
+	} {
+		if _, err := codec.Decode([]byte(c.data)); !errors.Is(err, c.want) {
+			t.Errorf("Decode(%q): expect %v, got %v", c.data, c.want, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package file
+
+import "os"
+
+// lockDir 在不支持 flock 的平台上只创建锁文件, 不阻止其他进程打开同一目录
+func lockDir(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+}
+
+// unlockDir 关闭 lockDir 打开的锁文件
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
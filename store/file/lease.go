@@ -0,0 +1,127 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+const (
+	// leaseLockWait 等待其他进程释放租约文件锁的最长时间
+	leaseLockWait = time.Second
+	// leaseLockStale 锁文件超过该时间未被删除时, 认为持有锁的进程已经崩溃
+	leaseLockStale = 10 * time.Second
+	// leaseLockRetry 获取锁失败后重试的间隔
+	leaseLockRetry = 2 * time.Millisecond
+)
+
+// ErrLeaseLocked 表示在 leaseLockWait 内未能获取租约文件的锁
+var ErrLeaseLocked = errors.New("lease file is locked")
+
+// leaseFile 租约文件的内容
+type leaseFile struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lease 基于本地文件的租约, 每个租约保存为目录下的一个文件, 适用于共享同一目录的多个进程
+// 读写租约文件前通过以 O_EXCL 创建的锁文件互斥, 租约文件通过 rename 原子地替换
+type Lease struct {
+	dir string
+}
+
+// OpenLease 打开或创建 dir 下的租约
+func OpenLease(dir string) (*Lease, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Lease{dir: dir}, nil
+}
+
+// Acquire 为 owner 获取或续期 key 的租约, 由其他 owner 持有且未过期时返回 false
+func (l *Lease) Acquire(key core.ID, owner string, ttl time.Duration) (ok bool, err error) {
+	err = l.withLock(key, func(path string) error {
+		cur, err := readLeaseFile(path)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if cur.Owner != "" && cur.Owner != owner && now.Before(cur.Expires) {
+			return nil
+		}
+		data, err := json.Marshal(leaseFile{Owner: owner, Expires: now.Add(ttl)})
+		if err != nil {
+			return err
+		}
+		if err = writeFileSync(path+".tmp", data); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	return ok, err
+}
+
+// Release 释放 owner 持有的租约
+func (l *Lease) Release(key core.ID, owner string) error {
+	return l.withLock(key, func(path string) error {
+		cur, err := readLeaseFile(path)
+		if err != nil || cur.Owner != owner {
+			return err
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// withLock 持有 key 的锁文件时执行 fn, fn 的参数为租约文件的路径
+func (l *Lease) withLock(key core.ID, fn func(path string) error) error {
+	path := filepath.Join(l.dir, key+".lease")
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(leaseLockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_ = f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		// 持有锁的进程崩溃后遗留的锁文件
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > leaseLockStale {
+			_ = os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return ErrLeaseLocked
+		}
+		time.Sleep(leaseLockRetry)
+	}
+	defer os.Remove(lockPath)
+	return fn(path)
+}
+
+// readLeaseFile 读取租约文件, 文件不存在时返回零值
+func readLeaseFile(path string) (leaseFile, error) {
+	cur := leaseFile{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cur, nil
+	} else if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(data, &cur)
+	return cur, err
+}
+
+var _ core.Lease = (*Lease)(nil)
@@ -0,0 +1,448 @@
+// Package file 提供基于本地文件的 core.Store 实现
+// 所有状态变化先追加到预写日志 (WAL) 再生效, 定期压缩为快照, 进程崩溃后通过快照和 WAL 恢复
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/store/codec"
+	"github.com/bagaking/wyvern/store/memory"
+)
+
+const (
+	// walFileName WAL 的文件名
+	walFileName = "wal.log"
+	// snapshotFileName 快照的文件名, 快照与 WAL 使用相同的记录格式
+	snapshotFileName = "snapshot.log"
+	// legacySnapshotFileName 旧版本写入的 JSON 快照, 打开时读取, 下次压缩后删除
+	legacySnapshotFileName = "snapshot.json"
+	// lockFileName 打开 Store 的进程持有排他锁的文件, 防止多个进程同时写入同一目录
+	lockFileName = "LOCK"
+
+	// DefaultSnapshotEvery 默认每追加多少条 WAL 记录压缩一次快照
+	DefaultSnapshotEvery = 1024
+)
+
+var (
+	// ErrClosed 表示 Store 已经关闭
+	ErrClosed = errors.New("file store is closed")
+	// ErrBroken 表示写入 WAL 失败后未能将其恢复到上一条完整记录的结尾, Store 不再接受写入, 需要重新打开
+	ErrBroken = errors.New("file store is broken")
+	// ErrLocked 表示目录已经被其他进程或同一进程中的其他 Store 打开
+	ErrLocked = errors.New("file store directory is locked")
+)
+
+// Options 文件 Store 的配置
+type Options struct {
+	// Dir 存放 WAL 和快照的目录, 不存在时自动创建
+	Dir string
+	// SyncEvery 每追加多少条记录 fsync 一次, 0 表示每条记录都 fsync, 负数表示只在快照、定时同步和关闭时 fsync
+	SyncEvery int
+	// SyncInterval 大于 0 时, 后台每隔该时间 fsync 一次尚未同步的记录
+	SyncInterval time.Duration
+	// SnapshotEvery 每追加多少条记录压缩一次快照, 0 表示使用 DefaultSnapshotEvery, 负数表示不自动压缩
+	SnapshotEvery int
+	// Codec 写入记录时使用的编码格式, 为 nil 时使用 codec.JSON; 读取时根据记录的格式标识自动识别
+	Codec codec.Codec
+}
+
+// legacySnapshot 旧版本 JSON 快照文件的内容
+type legacySnapshot struct {
+	Soars []json.RawMessage `json:"soars"`
+	Flaps []json.RawMessage `json:"flaps"`
+}
+
+// walFile WAL 文件需要的操作, 由 *os.File 实现
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Store 基于本地文件的 Store, 读操作由内存 Store 完成, 写操作先写入 WAL
+type Store struct {
+	// mem 与 WAL 和快照一致的内存状态
+	mem *memory.Store
+
+	opts Options
+	// dirLock 持有排他锁的锁文件, 关闭时释放
+	dirLock *os.File
+	// lock 保证 WAL 的写入顺序与内存状态的更新顺序一致
+	lock sync.Mutex
+	wal  walFile
+	// offset WAL 中最后一条完整记录结束处的偏移
+	offset int64
+	// err 不为 nil 时 WAL 已损坏, 所有写入都返回该错误
+	err error
+	// unsynced 尚未 fsync 的记录数
+	unsynced int
+	// appended 上次快照之后追加的记录数
+	appended int
+	closed   bool
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+}
+
+// Open 打开或创建 opts.Dir 下的 Store, 并从快照和 WAL 恢复所有数据
+// WAL 末尾不完整或校验失败的记录 (通常由写入时崩溃导致) 会被丢弃并从文件中截断
+// 打开期间持有目录的排他锁, 目录已被其他 Store 打开时返回 ErrLocked
+func Open(opts Options) (s *Store, err error) {
+	if opts.SnapshotEvery == 0 {
+		opts.SnapshotEvery = DefaultSnapshotEvery
+	}
+	if opts.Codec == nil {
+		opts.Codec = codec.JSON
+	}
+	if err = os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	dirLock, err := lockDir(filepath.Join(opts.Dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = unlockDir(dirLock)
+		}
+	}()
+	s = &Store{mem: memory.New(), opts: opts, dirLock: dirLock, stop: make(chan struct{})}
+	if err = s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(opts.Dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := readWAL(wal, s.apply)
+	if errors.Is(err, errTornRecord) {
+		if err = wal.Truncate(offset); err == nil {
+			err = wal.Sync()
+		}
+	}
+	if err == nil {
+		_, err = wal.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+	s.wal, s.offset = wal, offset
+
+	if opts.SyncInterval > 0 {
+		s.stopped.Add(1)
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// loadSnapshot 加载快照, 快照不存在时尝试加载旧版本的 JSON 快照
+func (s *Store) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(s.opts.Dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return s.loadLegacySnapshot()
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	// 快照通过 rename 原子地替换, 不应该出现不完整的记录
+	if _, err = readWAL(f, s.apply); err != nil {
+		return fmt.Errorf("load snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadLegacySnapshot 加载旧版本的 JSON 快照, 其中的记录按版本 1 升级
+func (s *Store) loadLegacySnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.opts.Dir, legacySnapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snap := legacySnapshot{}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("load snapshot: %w", err)
+	}
+	for _, raw := range append(snap.Soars, snap.Flaps...) {
+		if err = s.apply(raw); err != nil {
+			return fmt.Errorf("load snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply 将一条记录应用到内存状态
+func (s *Store) apply(payload []byte) error {
+	rec, err := codec.Decode(payload)
+	if err != nil {
+		return fmt.Errorf("decode record: %w", err)
+	}
+	if rec.Soar != nil {
+		s.mem.PutSoarRecord(*rec.Soar)
+	}
+	if rec.Flap != nil {
+		s.mem.PutFlapRecord(*rec.Flap)
+	}
+	return nil
+}
+
+// Rebuild 从内存状态重建 soar 的 Flap 索引
+func (s *Store) Rebuild(soarID core.ID) (*core.FlapIDTable, error) {
+	return s.mem.Rebuild(soarID)
+}
+
+// LoadSoar 从内存状态加载 soar 的数据
+func (s *Store) LoadSoar(soar *core.Soar, id core.ID) error {
+	return s.mem.LoadSoar(soar, id)
+}
+
+// LoadFlap 从内存状态加载 flap 的数据
+func (s *Store) LoadFlap(index core.IFlapIndex, id core.ID) error {
+	return s.mem.LoadFlap(index, id)
+}
+
+// ListSoars 列出所有已保存的 soar 的 ID
+func (s *Store) ListSoars() ([]core.ID, error) {
+	return s.mem.ListSoars()
+}
+
+// MakeSoarID 创建 Soar 的 ID
+func (s *Store) MakeSoarID() core.ID {
+	return s.mem.MakeSoarID()
+}
+
+// MakeFlapID 创建 Flap 的 ID
+func (s *Store) MakeFlapID() core.ID {
+	return s.mem.MakeFlapID()
+}
+
+// SaveSoar 比较 Revision 后将 soar 的数据写入 WAL, 再更新内存状态
+func (s *Store) SaveSoar(soar *core.Soar) error {
+	rec := soar.Record()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.mem.CheckSoarRevision(rec); err != nil {
+		return err
+	}
+	rec.Revision++
+	payload, err := codec.EncodeSoar(s.opts.Codec, rec)
+	if err != nil {
+		return err
+	}
+	return s.append(payload)
+}
+
+// SaveFlap 比较 Revision 后将 flap 的数据写入 WAL, 再更新内存状态
+func (s *Store) SaveFlap(flap *core.Flap) error {
+	rec := flap.Record()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.mem.CheckFlapRevision(rec); err != nil {
+		return err
+	}
+	rec.Revision++
+	payload, err := codec.EncodeFlap(s.opts.Codec, rec)
+	if err != nil {
+		return err
+	}
+	return s.append(payload)
+}
+
+// append 追加一条编码后的记录, 并按配置 fsync 和压缩快照, 调用方需持有 s.lock
+// 所有写入都在 s.lock 内完成, 写入前的 Revision 检查与写入之间不会有其他写入
+// 记录写入并按配置 fsync 成功后才更新内存状态; 写入或 fsync 失败时将 WAL 截断到上一条完整记录的结尾并返回错误,
+// 内存状态和 Revision 保持不变, 调用方可以用原来的 Revision 重试
+// 记录生效后压缩快照失败不影响本次写入, 只记录日志, 下次追加时重新尝试压缩
+func (s *Store) append(payload []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	record := encodeWALRecord(payload)
+	if _, err := s.wal.Write(record); err != nil {
+		s.rollback()
+		return err
+	}
+	if s.opts.SyncEvery >= 0 && s.unsynced+1 >= s.opts.SyncEvery {
+		if err := s.wal.Sync(); err != nil {
+			s.rollback()
+			return err
+		}
+		s.unsynced = 0
+	} else {
+		s.unsynced++
+	}
+	if err := s.apply(payload); err != nil {
+		s.rollback()
+		return err
+	}
+	s.offset += int64(len(record))
+	s.appended++
+
+	if s.opts.SnapshotEvery > 0 && s.appended >= s.opts.SnapshotEvery {
+		if err := s.compact(); err != nil {
+			log.Printf("file store %s: compact: %v", s.opts.Dir, err)
+		}
+	}
+	return nil
+}
+
+// rollback 将 WAL 截断到上一条完整记录的结尾, 失败时将 Store 标记为损坏, 调用方需持有 s.lock
+func (s *Store) rollback() {
+	err := s.wal.Truncate(s.offset)
+	if err == nil {
+		_, err = s.wal.Seek(s.offset, io.SeekStart)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("%w: truncate wal to %d: %v", ErrBroken, s.offset, err)
+	}
+}
+
+// sync fsync WAL, 调用方需持有 s.lock
+func (s *Store) sync() error {
+	if s.unsynced == 0 {
+		return nil
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.unsynced = 0
+	return nil
+}
+
+// Snapshot 立即将当前状态压缩为快照并清空 WAL
+func (s *Store) Snapshot() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+// compact 将内存状态写入快照并清空 WAL, 调用方需持有 s.lock
+// 快照先写入临时文件并 fsync, 再原子地替换旧快照; 替换后崩溃时重放 WAL 的结果与快照一致
+func (s *Store) compact() error {
+	soars, flaps := s.mem.Records()
+	var data []byte
+	for _, rec := range soars {
+		payload, err := codec.EncodeSoar(s.opts.Codec, rec)
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeWALRecord(payload)...)
+	}
+	for _, rec := range flaps {
+		payload, err := codec.EncodeFlap(s.opts.Codec, rec)
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeWALRecord(payload)...)
+	}
+	tmpPath := filepath.Join(s.opts.Dir, snapshotFileName+".tmp")
+	err := writeFileSync(tmpPath, data)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(s.opts.Dir, snapshotFileName)); err != nil {
+		return err
+	}
+	if err = os.Remove(filepath.Join(s.opts.Dir, legacySnapshotFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = syncDir(s.opts.Dir); err != nil {
+		return err
+	}
+	if err = s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = s.wal.Sync(); err != nil {
+		return err
+	}
+	s.offset, s.unsynced, s.appended = 0, 0, 0
+	return nil
+}
+
+// syncLoop 后台定时 fsync
+func (s *Store) syncLoop() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if !s.closed {
+				_ = s.sync()
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Close fsync 尚未同步的记录并关闭 WAL
+func (s *Store) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.sync()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	if unlockErr := unlockDir(s.dirLock); err == nil {
+		err = unlockErr
+	}
+	s.lock.Unlock()
+
+	close(s.stop)
+	s.stopped.Wait()
+	return err
+}
+
+// writeFileSync 写入文件并 fsync
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir fsync 目录, 保证目录项 (例如 rename 的结果) 落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var _ core.Store = (*Store)(nil)
@@ -0,0 +1,297 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) core.Store {
+		return mustOpen(t, Options{Dir: t.TempDir()})
+	})
+}
+
+func TestStoreSnapshotEveryRecord(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) core.Store {
+		return mustOpen(t, Options{Dir: t.TempDir(), SnapshotEvery: 1, SyncEvery: -1})
+	})
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, Options{Dir: dir, SnapshotEvery: 3})
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		mustSave(t, s, core.SoarRecord{ID: core.ID(name), Name: name, Count: i})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = mustOpen(t, Options{Dir: dir})
+	ids, err := s.ListSoars()
+	if err != nil || len(ids) != 5 {
+		t.Fatalf("expect 5 soars after reopen, got %v (%v)", ids, err)
+	}
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		if got := load(t, s, core.ID(name)); got.Count != i || got.Revision != 1 {
+			t.Errorf("soar %s: expect count %d revision 1, got %d %d", name, i, got.Count, got.Revision)
+		}
+	}
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join("testdata", "legacy", legacySnapshotFileName))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, legacySnapshotFileName), data, 0o644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+	check := func(s *Store, count int) {
+		t.Helper()
+		if got := load(t, s, "s1"); got.Status != core.SoarStatusRunning || got.Count != count {
+			t.Errorf("expect running soar with count %d, got %s %d", count, got.Status, got.Count)
+		}
+		table, err := s.Rebuild("s1")
+		if err != nil {
+			t.Fatalf("Rebuild: %v", err)
+		}
+		a, b := table.GetFlap("f1").Record(), table.GetFlap("f2").Record()
+		if a.State != core.FlapStateSuccess || a.Output["code"] != 200.0 || a.PluginConfig.(map[string]any)["url"] != "http://x" {
+			t.Errorf("unexpected flap a %+v", a)
+		}
+		if b.State != core.FlapStatusErrorAndRetry || b.AttemptRetryCount != 1 || b.Err != "boom" || len(b.PrevFlaps) != 1 {
+			t.Errorf("unexpected flap b %+v", b)
+		}
+	}
+
+	s := mustOpen(t, Options{Dir: dir, SnapshotEvery: -1})
+	check(s, 4)
+	rec := load(t, s, "s1")
+	rec.Count = 5
+	mustSave(t, s, rec)
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// WAL 中的记录覆盖旧版本快照中的记录
+	s = mustOpen(t, Options{Dir: dir, SnapshotEvery: -1})
+	check(s, 5)
+	if err = s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, legacySnapshotFileName)); !os.IsNotExist(err) {
+		t.Errorf("expect legacy snapshot to be removed after compaction, got %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = mustOpen(t, Options{Dir: dir})
+	check(s, 5)
+}
+
+func TestSyncEvery(t *testing.T) {
+	for _, c := range []struct {
+		syncEvery, saves, syncs int
+	}{
+		{0, 3, 3},
+		{1, 3, 3},
+		{2, 4, 2},
+		{3, 5, 1},
+		{-1, 5, 0},
+	} {
+		s := mustOpen(t, Options{Dir: t.TempDir(), SyncEvery: c.syncEvery, SnapshotEvery: -1})
+		f := &faultyWAL{walFile: s.wal}
+		s.wal = f
+		for i := 0; i < c.saves; i++ {
+			mustSave(t, s, core.SoarRecord{ID: core.ID(rune('a' + i))})
+		}
+		if f.syncs != c.syncs {
+			t.Errorf("SyncEvery %d: expect %d fsync after %d saves, got %d", c.syncEvery, c.syncs, c.saves, f.syncs)
+		}
+	}
+}
+
+func TestShortWriteIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, Options{Dir: dir, SnapshotEvery: -1})
+	mustSave(t, s, core.SoarRecord{ID: "a", Name: "a"})
+
+	f := &faultyWAL{walFile: s.wal, shortWrite: true}
+	s.wal = f
+	if err := save(s, core.SoarRecord{ID: "b", Name: "b"}); !errors.Is(err, errShortWrite) {
+		t.Fatalf("expect short write error, got %v", err)
+	}
+	if err := s.LoadSoar(&core.Soar{}, "b"); err == nil {
+		t.Error("failed write must not be applied")
+	}
+	// 截断后追加的记录可以在重新打开时恢复
+	mustSave(t, s, core.SoarRecord{ID: "c", Name: "c"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = mustOpen(t, Options{Dir: dir})
+	ids, err := s.ListSoars()
+	if err != nil || len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Fatalf("expect soars [a c] after reopen, got %v (%v)", ids, err)
+	}
+}
+
+func TestBrokenAfterFailedTruncate(t *testing.T) {
+	s := mustOpen(t, Options{Dir: t.TempDir(), SnapshotEvery: -1})
+	s.wal = &faultyWAL{walFile: s.wal, shortWrite: true, failTruncate: true}
+	if err := save(s, core.SoarRecord{ID: "a"}); !errors.Is(err, errShortWrite) {
+		t.Fatalf("expect short write error, got %v", err)
+	}
+	if err := save(s, core.SoarRecord{ID: "b"}); !errors.Is(err, ErrBroken) {
+		t.Fatalf("expect ErrBroken after failed truncate, got %v", err)
+	}
+}
+
+func TestFailedSyncIsNotApplied(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, Options{Dir: dir, SnapshotEvery: -1})
+	mustSave(t, s, core.SoarRecord{ID: "a", Name: "a"})
+
+	s.wal = &faultyWAL{walFile: s.wal, failSync: true}
+	if err := save(s, core.SoarRecord{ID: "a", Name: "b", Revision: 1}); !errors.Is(err, errSync) {
+		t.Fatalf("expect sync error, got %v", err)
+	}
+	if rec := load(t, s, "a"); rec.Name != "a" || rec.Revision != 1 {
+		t.Fatalf("failed sync must not be applied, got %+v", rec)
+	}
+	// 内存状态未变, 调用方可以用原来的 Revision 重试
+	mustSave(t, s, core.SoarRecord{ID: "a", Name: "c", Revision: 1})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = mustOpen(t, Options{Dir: dir})
+	if rec := load(t, s, "a"); rec.Name != "c" || rec.Revision != 2 {
+		t.Fatalf("expect retried record after reopen, got %+v", rec)
+	}
+}
+
+func TestFailedCompactKeepsSave(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, Options{Dir: dir, SnapshotEvery: 2})
+	// 临时快照路径被目录占用, 压缩无法写入
+	tmpPath := filepath.Join(dir, snapshotFileName+".tmp")
+	if err := os.MkdirAll(filepath.Join(tmpPath, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mustSave(t, s, core.SoarRecord{ID: "a"})
+	mustSave(t, s, core.SoarRecord{ID: "b"})
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expect no snapshot after failed compact, got %v", err)
+	}
+
+	// 下次追加时重新尝试压缩
+	if err := os.RemoveAll(tmpPath); err != nil {
+		t.Fatal(err)
+	}
+	mustSave(t, s, core.SoarRecord{ID: "c"})
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatalf("expect snapshot after retried compact: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s = mustOpen(t, Options{Dir: dir})
+	if ids, err := s.ListSoars(); err != nil || len(ids) != 3 {
+		t.Fatalf("expect 3 soars after reopen, got %v (%v)", ids, err)
+	}
+}
+
+func TestDirLock(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, Options{Dir: dir})
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	mustOpen(t, Options{Dir: dir})
+}
+
+var (
+	errShortWrite = errors.New("short write")
+	errTruncate   = errors.New("truncate failed")
+	errSync       = errors.New("sync failed")
+)
+
+// faultyWAL 记录 fsync 次数, 并按配置模拟只写入一半的记录, 截断失败和 fsync 失败
+type faultyWAL struct {
+	walFile
+	syncs        int
+	shortWrite   bool
+	failTruncate bool
+	failSync     bool
+}
+
+func (f *faultyWAL) Write(p []byte) (int, error) {
+	if f.shortWrite {
+		f.shortWrite = false
+		n, _ := f.walFile.Write(p[:len(p)/2])
+		return n, errShortWrite
+	}
+	return f.walFile.Write(p)
+}
+
+func (f *faultyWAL) Truncate(size int64) error {
+	if f.failTruncate {
+		return errTruncate
+	}
+	return f.walFile.Truncate(size)
+}
+
+func (f *faultyWAL) Sync() error {
+	f.syncs++
+	if f.failSync {
+		f.failSync = false
+		return errSync
+	}
+	return f.walFile.Sync()
+}
+
+func mustOpen(t *testing.T, opts Options) *Store {
+	t.Helper()
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// save 保存 rec 描述的 soar
+func save(s *Store, rec core.SoarRecord) error {
+	soar := &core.Soar{}
+	soar.ApplyRecord(rec)
+	return s.SaveSoar(soar)
+}
+
+func mustSave(t *testing.T, s *Store, rec core.SoarRecord) {
+	t.Helper()
+	if err := save(s, rec); err != nil {
+		t.Fatalf("SaveSoar(%s): %v", rec.ID, err)
+	}
+}
+
+func load(t *testing.T, s *Store, id core.ID) core.SoarRecord {
+	t.Helper()
+	soar := &core.Soar{}
+	if err := s.LoadSoar(soar, id); err != nil {
+		t.Fatalf("LoadSoar(%s): %v", id, err)
+	}
+	return soar.Record()
+}
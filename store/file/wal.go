@@ -0,0 +1,61 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// walHeaderSize 每条 WAL 记录的头部长度: 4 字节负载长度 + 4 字节 CRC32 校验和
+const walHeaderSize = 8
+
+// maxWALRecordSize 单条 WAL 记录负载的上限, 超过该长度的头部视为损坏
+const maxWALRecordSize = 64 << 20
+
+// errTornRecord 表示读到了不完整或校验失败的记录, 通常是写入过程中崩溃导致
+var errTornRecord = errors.New("torn wal record")
+
+// encodeWALRecord 为负载加上长度和校验和头部
+func encodeWALRecord(payload []byte) []byte {
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+	return buf
+}
+
+// readWAL 依次读取 WAL 中的所有完整记录并交给 apply 处理, 返回最后一条完整记录结束处的偏移
+// 遇到不完整或校验失败的记录时停止读取并返回 errTornRecord, 调用方应将文件截断到返回的偏移
+func readWAL(f *os.File, apply func(payload []byte) error) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTornRecord
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxWALRecordSize {
+			return offset, errTornRecord
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, errTornRecord
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errTornRecord
+		}
+		if err := apply(payload); err != nil {
+			return offset, err
+		}
+		offset += int64(walHeaderSize) + int64(size)
+	}
+}
@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// EventLog 将审计事件保存在内存中, 可以被并发使用
+type EventLog struct {
+	lock   sync.RWMutex
+	events []core.Event
+	// bySoar 每个 Soar 的事件在 events 中的下标
+	bySoar map[core.ID][]int
+	seq    uint64
+}
+
+// NewEventLog 创建一个空的内存 EventLog
+func NewEventLog() *EventLog {
+	return &EventLog{bySoar: make(map[core.ID][]int)}
+}
+
+// Append 按顺序追加事件, 并为每个事件分配 Seq
+func (l *EventLog) Append(events ...core.Event) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, e := range events {
+		l.seq++
+		e.Seq = l.seq
+		l.bySoar[e.SoarID] = append(l.bySoar[e.SoarID], len(l.events))
+		l.events = append(l.events, e)
+	}
+	return nil
+}
+
+// Query 按 Seq 顺序返回满足条件的事件
+func (l *EventLog) Query(q core.EventQuery) ([]core.Event, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	var ret []core.Event
+	match := func(e core.Event) bool {
+		if !q.Match(e) {
+			return true
+		}
+		ret = append(ret, e)
+		return q.Limit <= 0 || len(ret) < q.Limit
+	}
+	if q.SoarID != "" {
+		for _, i := range l.bySoar[q.SoarID] {
+			if !match(l.events[i]) {
+				break
+			}
+		}
+		return ret, nil
+	}
+	for _, e := range l.events {
+		if !match(e) {
+			break
+		}
+	}
+	return ret, nil
+}
+
+var _ core.EventLog = (*EventLog)(nil)
@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// lease 一个租约的持有者和过期时间
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+// Lease 将租约保存在内存中, 用于同一进程内的多个 Wyvern 实例, 可以被并发使用
+type Lease struct {
+	lock   sync.Mutex
+	leases map[core.ID]lease
+}
+
+// NewLease 创建一个空的内存 Lease
+func NewLease() *Lease {
+	return &Lease{leases: make(map[core.ID]lease)}
+}
+
+// Acquire 为 owner 获取或续期 key 的租约, 由其他 owner 持有且未过期时返回 false
+func (l *Lease) Acquire(key core.ID, owner string, ttl time.Duration) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if cur, ok := l.leases[key]; ok && cur.owner != owner && now.Before(cur.expires) {
+		return false, nil
+	}
+	l.leases[key] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Release 释放 owner 持有的租约
+func (l *Lease) Release(key core.ID, owner string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if cur, ok := l.leases[key]; ok && cur.owner == owner {
+		delete(l.leases, key)
+	}
+	return nil
+}
+
+var _ core.Lease = (*Lease)(nil)
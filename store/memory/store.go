@@ -0,0 +1,227 @@
+// Package memory 提供 core.Store 的内存实现, 可以作为测试和单进程部署的默认 Store
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/util"
+)
+
+const (
+	// idKindSoar 生成 Soar ID 时使用的保留位
+	idKindSoar uint8 = 1
+	// idKindFlap 生成 Flap ID 时使用的保留位
+	idKindFlap uint8 = 2
+)
+
+// Store 将 soar 和 flap 的数据保存在内存中, 可以被并发使用
+// 保存和加载时都会深拷贝数据, 调用方持有的 Soar 和 Flap 不会与 Store 共享内存
+type Store struct {
+	lock sync.RWMutex
+
+	// soars 所有 Soar 的数据, key 为 Soar ID
+	soars map[core.ID]core.SoarRecord
+	// flaps 所有 Flap 的数据, key 为 Flap ID
+	flaps map[core.ID]core.FlapRecord
+	// soarFlaps 每个 Soar 下的 Flap ID, 按首次保存的顺序排列
+	soarFlaps map[core.ID][]core.ID
+}
+
+// New 创建一个空的内存 Store
+func New() *Store {
+	return &Store{
+		soars:     make(map[core.ID]core.SoarRecord),
+		flaps:     make(map[core.ID]core.FlapRecord),
+		soarFlaps: make(map[core.ID][]core.ID),
+	}
+}
+
+// Rebuild 从保存的数据重建 soar 的所有 flap 及其索引, 重建的 flap 没有 Action
+func (s *Store) Rebuild(soarID core.ID) (*core.FlapIDTable, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if _, ok := s.soars[soarID]; !ok {
+		return nil, fmt.Errorf("%w: %s", core.ErrSoarNotFound, soarID)
+	}
+	flaps := make([]*core.Flap, 0, len(s.soarFlaps[soarID]))
+	for _, flapID := range s.soarFlaps[soarID] {
+		flap, err := core.NewFlapFromRecord(s.flaps[flapID].Clone())
+		if err != nil {
+			return nil, err
+		}
+		flaps = append(flaps, flap)
+	}
+	return core.NewFlapIDTable(flaps...), nil
+}
+
+// SaveSoar 比较 Revision 后保存 soar 的数据
+func (s *Store) SaveSoar(soar *core.Soar) error {
+	rec := soar.Record()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.checkSoarRevision(rec); err != nil {
+		return err
+	}
+	rec.Revision++
+	s.putSoar(rec)
+	return nil
+}
+
+// SaveFlap 比较 Revision 后保存 flap 的数据
+func (s *Store) SaveFlap(flap *core.Flap) error {
+	rec := flap.Record()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.checkFlapRevision(rec); err != nil {
+		return err
+	}
+	rec.Revision++
+	s.putFlap(rec)
+	return nil
+}
+
+// CheckSoarRevision 检查 rec 的 Revision 是否与保存的 soar 一致, 不一致时返回 *core.ConflictError
+// 供基于内存 Store 构建的其他 Store 在写入前检查, 调用方需自行保证检查和写入之间没有其他写入
+func (s *Store) CheckSoarRevision(rec core.SoarRecord) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.checkSoarRevision(rec)
+}
+
+// CheckFlapRevision 检查 rec 的 Revision 是否与保存的 flap 一致, 不一致时返回 *core.ConflictError
+// 供基于内存 Store 构建的其他 Store 在写入前检查, 调用方需自行保证检查和写入之间没有其他写入
+func (s *Store) CheckFlapRevision(rec core.FlapRecord) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.checkFlapRevision(rec)
+}
+
+// PutSoarRecord 不比较 Revision, 直接保存 soar 的持久化数据, 供基于内存 Store 构建的其他 Store 使用
+func (s *Store) PutSoarRecord(rec core.SoarRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.putSoar(rec)
+}
+
+// PutFlapRecord 不比较 Revision, 直接保存 flap 的持久化数据, 供基于内存 Store 构建的其他 Store 使用
+func (s *Store) PutFlapRecord(rec core.FlapRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.putFlap(rec)
+}
+
+// checkSoarRevision 比较 soar 的 Revision, 调用方需持有 s.lock
+func (s *Store) checkSoarRevision(rec core.SoarRecord) error {
+	if cur := s.soars[rec.ID].Revision; cur != rec.Revision {
+		return &core.ConflictError{Kind: "soar", ID: rec.ID, Revision: rec.Revision, Current: cur}
+	}
+	return nil
+}
+
+// checkFlapRevision 比较 flap 的 Revision, 调用方需持有 s.lock
+func (s *Store) checkFlapRevision(rec core.FlapRecord) error {
+	if cur := s.flaps[rec.ID].Revision; cur != rec.Revision {
+		return &core.ConflictError{Kind: "flap", ID: rec.ID, Revision: rec.Revision, Current: cur}
+	}
+	return nil
+}
+
+// putSoar 保存 soar 的数据, 调用方需持有 s.lock
+func (s *Store) putSoar(rec core.SoarRecord) {
+	s.soars[rec.ID] = rec.Clone()
+}
+
+// putFlap 保存 flap 的数据, 调用方需持有 s.lock
+func (s *Store) putFlap(rec core.FlapRecord) {
+	if _, ok := s.flaps[rec.ID]; !ok {
+		s.soarFlaps[rec.SoarID] = append(s.soarFlaps[rec.SoarID], rec.ID)
+	}
+	s.flaps[rec.ID] = rec.Clone()
+}
+
+// Records 返回所有 soar 和 flap 的持久化数据, 同一个 soar 的 flap 按首次保存的顺序排列
+func (s *Store) Records() ([]core.SoarRecord, []core.FlapRecord) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	soars := make([]core.SoarRecord, 0, len(s.soars))
+	flaps := make([]core.FlapRecord, 0, len(s.flaps))
+	for soarID, rec := range s.soars {
+		soars = append(soars, rec.Clone())
+		for _, flapID := range s.soarFlaps[soarID] {
+			flaps = append(flaps, s.flaps[flapID].Clone())
+		}
+	}
+	// 所属 soar 尚未保存的 flap
+	for soarID, flapIDs := range s.soarFlaps {
+		if _, ok := s.soars[soarID]; ok {
+			continue
+		}
+		for _, flapID := range flapIDs {
+			flaps = append(flaps, s.flaps[flapID].Clone())
+		}
+	}
+	return soars, flaps
+}
+
+// LoadSoar 加载 soar 的数据
+func (s *Store) LoadSoar(soar *core.Soar, id core.ID) error {
+	s.lock.RLock()
+	rec, ok := s.soars[id]
+	s.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", core.ErrSoarNotFound, id)
+	}
+	soar.ApplyRecord(rec.Clone())
+	return nil
+}
+
+// LoadFlap 加载 flap 的数据到 index 中 ID 相同的 flap 上
+func (s *Store) LoadFlap(index core.IFlapIndex, id core.ID) error {
+	flap := index.GetFlap(id)
+	if flap == nil {
+		return fmt.Errorf("%w: %s is not in index", core.ErrFlapNotFound, id)
+	}
+	s.lock.RLock()
+	rec, ok := s.flaps[id]
+	s.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", core.ErrFlapNotFound, id)
+	}
+	return flap.ApplyRecord(rec.Clone())
+}
+
+// ListSoars 列出所有已保存的 soar 的 ID, 按 ID 排序
+func (s *Store) ListSoars() ([]core.ID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ids := make([]core.ID, 0, len(s.soars))
+	for id := range s.soars {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// MakeSoarID 创建 Soar 的 ID
+func (s *Store) MakeSoarID() core.ID {
+	return makeID(idKindSoar)
+}
+
+// MakeFlapID 创建 Flap 的 ID
+func (s *Store) MakeFlapID() core.ID {
+	return makeID(idKindFlap)
+}
+
+// makeID 使用 util.GenID 生成 base58 编码的 ID
+func makeID(kind uint8) core.ID {
+	id, err := util.GenID(kind)
+	if err != nil {
+		panic(err)
+	}
+	return util.Base58EncodeUInt64(id)
+}
+
+var _ core.Store = (*Store)(nil)
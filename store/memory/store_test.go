@@ -0,0 +1,82 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/store/memory"
+	"github.com/bagaking/wyvern/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) core.Store { return memory.New() })
+}
+
+func TestEventLog(t *testing.T) {
+	l := memory.NewEventLog()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := l.Append(
+		core.Event{SoarID: "a", Type: core.EventSoarStatus, Time: base},
+		core.Event{SoarID: "b", Type: core.EventSoarStatus, Time: base.Add(time.Second)},
+		core.Event{SoarID: "a", FlapID: "f", Type: core.EventFlapStatus, Time: base.Add(2 * time.Second)},
+		core.Event{SoarID: "a", FlapID: "f", Type: core.EventFlapStatus, Time: base.Add(3 * time.Second)},
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	for _, c := range []struct {
+		name string
+		q    core.EventQuery
+		want []uint64
+	}{
+		{"all", core.EventQuery{}, []uint64{1, 2, 3, 4}},
+		{"soar", core.EventQuery{SoarID: "a"}, []uint64{1, 3, 4}},
+		{"flap", core.EventQuery{FlapID: "f"}, []uint64{3, 4}},
+		{"type", core.EventQuery{Types: []core.EventType{core.EventSoarStatus}}, []uint64{1, 2}},
+		{"range", core.EventQuery{Since: base.Add(time.Second), Until: base.Add(2 * time.Second)}, []uint64{2, 3}},
+		{"limit", core.EventQuery{SoarID: "a", Limit: 2}, []uint64{1, 3}},
+	} {
+		events, err := l.Query(c.q)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", c.name, err)
+		}
+		got := make([]uint64, 0, len(events))
+		for _, e := range events {
+			got = append(got, e.Seq)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: expect seq %v, got %v", c.name, c.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: expect seq %v, got %v", c.name, c.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestLease(t *testing.T) {
+	l := memory.NewLease()
+	acquire := func(owner string, want bool) {
+		t.Helper()
+		if ok, err := l.Acquire("soar", owner, 20*time.Millisecond); err != nil || ok != want {
+			t.Fatalf("Acquire(%s): expect %v, got %v (%v)", owner, want, ok, err)
+		}
+	}
+	acquire("a", true)
+	acquire("b", false)
+	acquire("a", true)
+	time.Sleep(30 * time.Millisecond)
+	acquire("b", true)
+	if err := l.Release("soar", "a"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	acquire("a", false)
+	if err := l.Release("soar", "b"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	acquire("a", true)
+}
@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect 屏蔽不同数据库之间的 SQL 差异
+// Store 中的语句统一使用 ? 作为占位符, 执行前通过 Placeholder 转换; upsert 使用 SQLite 和 PostgreSQL 都支持的 ON CONFLICT 语法
+type Dialect interface {
+	// Name 方言的名称, 同时也是 migrations 下迁移脚本所在的目录名
+	Name() string
+	// Placeholder 返回第 n 个 (从 1 开始) 参数的占位符
+	Placeholder(n int) string
+}
+
+var (
+	// SQLite SQLite 方言, 需要 SQLite 3.24 及以上版本
+	SQLite Dialect = sqliteDialect{}
+	// Postgres PostgreSQL 方言, 需要 PostgreSQL 9.5 及以上版本
+	Postgres Dialect = postgresDialect{}
+)
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) Placeholder(int) string { return "?" }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+// rebind 将语句中的 ? 占位符转换为方言的占位符
+func rebind(d Dialect, query string) string {
+	if d.Placeholder(1) == "?" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
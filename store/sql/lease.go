@@ -0,0 +1,47 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+)
+
+// Lease 将租约保存在关系数据库中, 适用于共享同一个数据库的多个实例
+// 获取和续期通过一条带条件的 upsert 原子地完成, 过期时间使用各实例的本地时钟, 实例之间的时钟偏差应远小于租约的有效期
+type Lease struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewLease 使用 db 创建 Lease, 并执行尚未执行的迁移脚本
+func NewLease(db *sql.DB, dialect Dialect) (*Lease, error) {
+	if err := Migrate(context.Background(), db, dialect); err != nil {
+		return nil, err
+	}
+	return &Lease{db: db, dialect: dialect}, nil
+}
+
+// Acquire 为 owner 获取或续期 key 的租约, 由其他 owner 持有且未过期时返回 false
+func (l *Lease) Acquire(key core.ID, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := l.db.Exec(rebind(l.dialect, `INSERT INTO leases (lease_key, owner, expires_ns)
+		VALUES (?, ?, ?)
+		ON CONFLICT (lease_key) DO UPDATE SET owner = excluded.owner, expires_ns = excluded.expires_ns
+		WHERE leases.owner = excluded.owner OR leases.expires_ns <= ?`),
+		key, owner, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Release 释放 owner 持有的租约
+func (l *Lease) Release(key core.ID, owner string) error {
+	_, err := l.db.Exec(rebind(l.dialect, `DELETE FROM leases WHERE lease_key = ? AND owner = ?`), key, owner)
+	return err
+}
+
+var _ core.Lease = (*Lease)(nil)
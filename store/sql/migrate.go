@@ -0,0 +1,128 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// migrationTable 记录已经执行的迁移版本
+const migrationTable = "wyvern_schema_migrations"
+
+// migration 一个版本的迁移脚本, 文件名格式为 <version>_<name>.sql
+type migration struct {
+	version int
+	name    string
+	stmts   []string
+}
+
+// SchemaVersion 返回 dialect 内置迁移脚本的最新版本
+func SchemaVersion(dialect Dialect) (int, error) {
+	ms, err := loadMigrations(dialect)
+	if err != nil || len(ms) == 0 {
+		return 0, err
+	}
+	return ms[len(ms)-1].version, nil
+}
+
+// Migrate 按版本顺序执行 db 中尚未执行的迁移脚本, 每个版本在一个事务中执行
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	ms, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationTable+
+		" (version INTEGER PRIMARY KEY, name TEXT NOT NULL)"); err != nil {
+		return fmt.Errorf("create %s: %w", migrationTable, err)
+	}
+
+	current := 0
+	row := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+migrationTable)
+	if err = row.Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for _, m := range ms {
+		if m.version <= current {
+			continue
+		}
+		if err = applyMigration(ctx, db, dialect, m); err != nil {
+			return fmt.Errorf("migrate to version %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration 在一个事务中执行一个版本的迁移脚本并记录版本号
+func applyMigration(ctx context.Context, db *sql.DB, dialect Dialect, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range m.stmts {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, rebind(dialect, "INSERT INTO "+migrationTable+
+		" (version, name) VALUES (?, ?)"), m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadMigrations 加载 dialect 的迁移脚本并按版本排序
+func loadMigrations(dialect Dialect) ([]migration, error) {
+	dir := path.Join("migrations", dialect.Name())
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %s: %w", dialect.Name(), err)
+	}
+	ms := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		versionStr, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(migrations, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version: version, name: name, stmts: splitStatements(string(data))})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	return ms, nil
+}
+
+// splitStatements 将迁移脚本拆分为单条语句, 逐条执行以兼容不支持多语句的驱动
+// 迁移脚本中的分号只用于分隔语句, 并忽略 -- 开头的注释行
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
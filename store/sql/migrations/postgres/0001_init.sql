@@ -0,0 +1,56 @@
+-- soar 的数据, 每个 soar 一行
+CREATE TABLE soars (
+    id              TEXT    PRIMARY KEY,
+    name            TEXT    NOT NULL,
+    status          INTEGER NOT NULL,
+    count           INTEGER NOT NULL DEFAULT 0,
+    err             TEXT    NOT NULL DEFAULT '',
+    max_parallelism INTEGER NOT NULL DEFAULT 0,
+    timeout_ns      BIGINT  NOT NULL DEFAULT 0,
+    root_flaps      TEXT    NOT NULL DEFAULT '[]'
+);
+
+-- flap 的数据, seq 记录 flap 在所属 soar 中首次保存的顺序
+CREATE TABLE flaps (
+    id                  TEXT    PRIMARY KEY,
+    soar_id             TEXT    NOT NULL,
+    seq                 BIGINT  NOT NULL,
+    conf_name           TEXT    NOT NULL,
+    state               INTEGER NOT NULL,
+    start_ns            BIGINT,
+    next_awake_ns       BIGINT,
+    attempt_retry_count INTEGER NOT NULL DEFAULT 0,
+    output              TEXT,
+    err                 TEXT    NOT NULL DEFAULT '',
+    plugin              TEXT    NOT NULL,
+    plugin_config       TEXT,
+    conditions          TEXT,
+    retry               TEXT,
+    timeout_ns          BIGINT  NOT NULL DEFAULT 0,
+    compensate          TEXT,
+    compensation        INTEGER NOT NULL DEFAULT 0,
+    compensation_err    TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX flaps_soar_id ON flaps (soar_id, seq);
+
+-- flap 之间的依赖关系, from_id 是 to_id 的 parent
+CREATE TABLE edges (
+    soar_id TEXT NOT NULL,
+    from_id TEXT NOT NULL,
+    to_id   TEXT NOT NULL,
+    PRIMARY KEY (from_id, to_id)
+);
+CREATE INDEX edges_soar_id ON edges (soar_id);
+
+-- flap 每次尝试的最终状态
+CREATE TABLE attempts (
+    flap_id    TEXT    NOT NULL,
+    attempt    INTEGER NOT NULL,
+    soar_id    TEXT    NOT NULL,
+    state      INTEGER NOT NULL,
+    err        TEXT    NOT NULL DEFAULT '',
+    start_ns   BIGINT,
+    updated_ns BIGINT  NOT NULL,
+    PRIMARY KEY (flap_id, attempt)
+);
+CREATE INDEX attempts_soar_id ON attempts (soar_id);
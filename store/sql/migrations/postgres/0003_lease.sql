@@ -0,0 +1,6 @@
+-- soar 的租约, 保证每个 soar 同一时刻只由一个实例运行
+CREATE TABLE leases (
+    lease_key  TEXT   PRIMARY KEY,
+    owner      TEXT   NOT NULL,
+    expires_ns BIGINT NOT NULL
+);
@@ -0,0 +1,3 @@
+-- 记录被写入的次数, 用于比较并写入; 已有的行从 0 开始
+ALTER TABLE soars ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flaps ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
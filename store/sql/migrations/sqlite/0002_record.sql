@@ -0,0 +1,3 @@
+-- 以 codec 编码的完整记录, 包含尚未拆分为独立列的字段; 为 NULL 时从各列还原记录
+ALTER TABLE soars ADD COLUMN record BLOB;
+ALTER TABLE flaps ADD COLUMN record BLOB;
@@ -0,0 +1,4 @@
+// Package sqlitetest 使用 modernc.org/sqlite 驱动测试 store/sql
+// 本目录是独立的模块, 驱动依赖只出现在这里的 go.mod 中, 引用 wyvern 的项目不会因此引入驱动
+// 在本目录下执行 go test ./... 运行测试
+package sqlitetest
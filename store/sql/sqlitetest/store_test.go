@@ -0,0 +1,66 @@
+package sqlitetest
+
+import (
+	dbsql "database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	wsql "github.com/bagaking/wyvern/store/sql"
+	"github.com/bagaking/wyvern/store/storetest"
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) core.Store {
+		s, err := wsql.Open(openSQLite(t, filepath.Join(t.TempDir(), "wyvern.db")), wsql.SQLite)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return s
+	})
+}
+
+func TestMigrateTwice(t *testing.T) {
+	db := openSQLite(t, filepath.Join(t.TempDir(), "wyvern.db"))
+	for i := 0; i < 2; i++ {
+		if _, err := wsql.Open(db, wsql.SQLite); err != nil {
+			t.Fatalf("Open #%d: %v", i+1, err)
+		}
+	}
+}
+
+func TestSQLiteLease(t *testing.T) {
+	l, err := wsql.NewLease(openSQLite(t, filepath.Join(t.TempDir(), "wyvern.db")), wsql.SQLite)
+	if err != nil {
+		t.Fatalf("NewLease: %v", err)
+	}
+	acquire := func(owner string, want bool) {
+		t.Helper()
+		if ok, err := l.Acquire("soar", owner, 50*time.Millisecond); err != nil || ok != want {
+			t.Fatalf("Acquire(%s): expect %v, got %v (%v)", owner, want, ok, err)
+		}
+	}
+	acquire("a", true)
+	acquire("b", false)
+	acquire("a", true)
+	time.Sleep(60 * time.Millisecond)
+	acquire("b", true)
+	if err = l.Release("soar", "b"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	acquire("a", true)
+}
+
+// openSQLite 打开 path 处的 SQLite 数据库, SQLite 只允许一个写入者, 因此只使用一个连接
+func openSQLite(t *testing.T, path string) *dbsql.DB {
+	t.Helper()
+	db, err := dbsql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
@@ -0,0 +1,554 @@
+// Package sql 提供基于 database/sql 的 core.Store 实现, 适用于多个实例共享的部署
+// 包内不引入任何数据库驱动, 由调用方导入驱动并创建 *sql.DB, 再通过 Dialect 选择 SQLite 或 PostgreSQL
+// 使用 SQLite 驱动的测试位于独立模块 store/sql/sqlitetest 中
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+	"github.com/bagaking/wyvern/store/codec"
+	"github.com/bagaking/wyvern/util"
+)
+
+const (
+	// idKindSoar 生成 Soar ID 时使用的保留位
+	idKindSoar uint8 = 1
+	// idKindFlap 生成 Flap ID 时使用的保留位
+	idKindFlap uint8 = 2
+)
+
+// Store 将 soar 和 flap 的数据保存在关系数据库中, 可以被并发使用
+// 每次 SaveSoar 和 SaveFlap 都在一个事务中完成
+// 除了便于查询的各列外, 每行还保存以 codec 编码的完整记录, 加载时优先使用完整记录, 以保留新版本增加的字段
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+	codec   codec.Codec
+}
+
+// Open 使用 db 创建 Store, 并执行尚未执行的迁移脚本, 记录默认以 codec.JSON 编码
+func Open(db *sql.DB, dialect Dialect) (*Store, error) {
+	if err := Migrate(context.Background(), db, dialect); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, dialect: dialect, codec: codec.JSON}, nil
+}
+
+// SetCodec 设置写入完整记录时使用的编码格式, 读取时根据记录的格式标识自动识别, 需要在使用 Store 前调用
+func (s *Store) SetCodec(c codec.Codec) {
+	s.codec = c
+}
+
+// DB 返回 Store 使用的 *sql.DB
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// Rebuild 从数据库重建 soar 的所有 flap 及其索引, 重建的 flap 没有 Action
+func (s *Store) Rebuild(soarID core.ID) (*core.FlapIDTable, error) {
+	ctx := context.Background()
+	if _, err := s.loadSoarRecord(ctx, soarID); err != nil {
+		return nil, err
+	}
+	recs, err := s.loadFlapRecords(ctx, "soar_id = ?", soarID)
+	if err != nil {
+		return nil, err
+	}
+	flapList := make([]*core.Flap, 0, len(recs))
+	for _, rec := range recs {
+		flap, err := core.NewFlapFromRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		flapList = append(flapList, flap)
+	}
+	return core.NewFlapIDTable(flapList...), nil
+}
+
+// SaveSoar 比较 Revision 后保存 soar 的数据
+func (s *Store) SaveSoar(soar *core.Soar) error {
+	rec := soar.Record()
+	rootFlaps, err := json.Marshal(nonNilIDs(rec.RootFlaps))
+	if err != nil {
+		return err
+	}
+	expected := rec.Revision
+	rec.Revision++
+	record, err := codec.EncodeSoar(s.codec, rec)
+	if err != nil {
+		return err
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := s.checkRevision(tx, "soars", "soar", rec.ID, expected); err != nil {
+			return err
+		}
+		res, err := tx.Exec(rebind(s.dialect, `INSERT INTO soars
+			(id, name, status, count, err, max_parallelism, timeout_ns, root_flaps, record, revision)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name, status = excluded.status, count = excluded.count, err = excluded.err,
+				max_parallelism = excluded.max_parallelism, timeout_ns = excluded.timeout_ns,
+				root_flaps = excluded.root_flaps, record = excluded.record, revision = excluded.revision
+			WHERE soars.revision = ?`),
+			rec.ID, rec.Name, int(rec.Status), rec.Count, rec.Err, rec.MaxParallelism,
+			int64(rec.Timeout), string(rootFlaps), record, rec.Revision, expected)
+		if err != nil {
+			return err
+		}
+		return s.checkWritten(tx, res, "soars", "soar", rec.ID, expected)
+	})
+}
+
+// SaveFlap 比较 Revision 后保存 flap 的数据, 同时更新 flap 的依赖关系和本次尝试的状态
+func (s *Store) SaveFlap(flap *core.Flap) error {
+	rec := flap.Record()
+	cols, err := encodeFlapColumns(rec)
+	if err != nil {
+		return err
+	}
+	expected := rec.Revision
+	rec.Revision++
+	record, err := codec.EncodeFlap(s.codec, rec)
+	if err != nil {
+		return err
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := s.checkRevision(tx, "flaps", "flap", rec.ID, expected); err != nil {
+			return err
+		}
+		res, err := tx.Exec(rebind(s.dialect, `INSERT INTO flaps
+			(id, soar_id, seq, conf_name, state, start_ns, next_awake_ns, attempt_retry_count, output, err,
+				plugin, plugin_config, conditions, retry, timeout_ns, compensate, compensation, compensation_err,
+				record, revision)
+			VALUES (?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM flaps WHERE soar_id = ?),
+				?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				soar_id = excluded.soar_id, conf_name = excluded.conf_name, state = excluded.state,
+				start_ns = excluded.start_ns, next_awake_ns = excluded.next_awake_ns,
+				attempt_retry_count = excluded.attempt_retry_count, output = excluded.output, err = excluded.err,
+				plugin = excluded.plugin, plugin_config = excluded.plugin_config, conditions = excluded.conditions,
+				retry = excluded.retry, timeout_ns = excluded.timeout_ns, compensate = excluded.compensate,
+				compensation = excluded.compensation, compensation_err = excluded.compensation_err,
+				record = excluded.record, revision = excluded.revision
+			WHERE flaps.revision = ?`),
+			rec.ID, rec.SoarID, rec.SoarID, rec.ConfName, int(rec.State), cols.start, cols.nextAwake,
+			rec.AttemptRetryCount, cols.output, rec.Err, rec.Plugin, cols.pluginConfig, cols.conditions,
+			cols.retry, int64(rec.Timeout), cols.compensate, int(rec.Compensation), rec.CompensationErr, record,
+			rec.Revision, expected,
+		)
+		if err != nil {
+			return err
+		}
+		if err = s.checkWritten(tx, res, "flaps", "flap", rec.ID, expected); err != nil {
+			return err
+		}
+
+		// 依赖关系以最近一次保存的 flap 为准
+		if _, err := tx.Exec(rebind(s.dialect, `DELETE FROM edges WHERE from_id = ? OR to_id = ?`),
+			rec.ID, rec.ID); err != nil {
+			return err
+		}
+		insertEdge := rebind(s.dialect, `INSERT INTO edges (soar_id, from_id, to_id) VALUES (?, ?, ?)
+			ON CONFLICT (from_id, to_id) DO NOTHING`)
+		for _, prev := range rec.PrevFlaps {
+			if _, err := tx.Exec(insertEdge, rec.SoarID, prev, rec.ID); err != nil {
+				return err
+			}
+		}
+		for _, next := range rec.NextFlaps {
+			if _, err := tx.Exec(insertEdge, rec.SoarID, rec.ID, next); err != nil {
+				return err
+			}
+		}
+
+		if rec.State == core.FlapStateWait {
+			return nil
+		}
+		_, err = tx.Exec(rebind(s.dialect, `INSERT INTO attempts
+			(flap_id, attempt, soar_id, state, err, start_ns, updated_ns)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (flap_id, attempt) DO UPDATE SET
+				state = excluded.state, err = excluded.err, start_ns = excluded.start_ns,
+				updated_ns = excluded.updated_ns`),
+			rec.ID, rec.AttemptRetryCount, rec.SoarID, int(rec.State), rec.Err, cols.start, time.Now().UnixNano())
+		return err
+	})
+}
+
+// LoadSoar 加载 soar 的数据
+func (s *Store) LoadSoar(soar *core.Soar, id core.ID) error {
+	rec, err := s.loadSoarRecord(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	soar.ApplyRecord(rec)
+	return nil
+}
+
+// LoadFlap 加载 flap 的数据到 index 中 ID 相同的 flap 上
+func (s *Store) LoadFlap(index core.IFlapIndex, id core.ID) error {
+	flap := index.GetFlap(id)
+	if flap == nil {
+		return fmt.Errorf("%w: %s is not in index", core.ErrFlapNotFound, id)
+	}
+	recs, err := s.loadFlapRecords(context.Background(), "id = ?", id)
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return fmt.Errorf("%w: %s", core.ErrFlapNotFound, id)
+	}
+	return flap.ApplyRecord(recs[0])
+}
+
+// ListSoars 列出所有已保存的 soar 的 ID, 按 ID 排序
+func (s *Store) ListSoars() ([]core.ID, error) {
+	rows, err := s.db.Query(`SELECT id FROM soars ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []core.ID
+	for rows.Next() {
+		var id core.ID
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Attempt flap 一次尝试的最终状态
+type Attempt struct {
+	FlapID  core.ID
+	Attempt int
+	State   core.FlapStatus
+	Err     string
+	Start   time.Time
+	Updated time.Time
+}
+
+// Attempts 按时间顺序返回 flap 每次尝试的最终状态
+func (s *Store) Attempts(flapID core.ID) ([]Attempt, error) {
+	rows, err := s.db.Query(rebind(s.dialect, `SELECT attempt, state, err, start_ns, updated_ns
+		FROM attempts WHERE flap_id = ? ORDER BY attempt`), flapID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []Attempt
+	for rows.Next() {
+		a := Attempt{FlapID: flapID}
+		var state int
+		var start sql.NullInt64
+		var updated int64
+		if err = rows.Scan(&a.Attempt, &state, &a.Err, &start, &updated); err != nil {
+			return nil, err
+		}
+		a.State = core.FlapStatus(state)
+		a.Start = decodeTime(start)
+		a.Updated = time.Unix(0, updated)
+		ret = append(ret, a)
+	}
+	return ret, rows.Err()
+}
+
+// MakeSoarID 创建 Soar 的 ID
+func (s *Store) MakeSoarID() core.ID {
+	return makeID(idKindSoar)
+}
+
+// MakeFlapID 创建 Flap 的 ID
+func (s *Store) MakeFlapID() core.ID {
+	return makeID(idKindFlap)
+}
+
+// withTx 在事务中执行 fn, fn 返回错误时回滚
+func (s *Store) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkRevision 在写入前比较记录当前的 Revision, 记录不存在时 Revision 为 0
+// 只用于提前发现冲突, 并发写入由 upsert 的 WHERE 条件保证
+func (s *Store) checkRevision(tx *sql.Tx, table, kind string, id core.ID, expected uint64) error {
+	var current uint64
+	err := tx.QueryRow(rebind(s.dialect, `SELECT revision FROM `+table+` WHERE id = ?`), id).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if current != expected {
+		return &core.ConflictError{Kind: kind, ID: id, Revision: expected, Current: current}
+	}
+	return nil
+}
+
+// checkWritten 检查 upsert 是否写入了记录, 没有写入时说明记录已被并发修改, 返回 ConflictError
+func (s *Store) checkWritten(tx *sql.Tx, res sql.Result, table, kind string, id core.ID, expected uint64) error {
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	var current uint64
+	if err = tx.QueryRow(rebind(s.dialect, `SELECT revision FROM `+table+` WHERE id = ?`), id).Scan(&current); err != nil {
+		return err
+	}
+	return &core.ConflictError{Kind: kind, ID: id, Revision: expected, Current: current}
+}
+
+// loadSoarRecord 加载 soar 的数据, FlapIDs 按 flap 首次保存的顺序排列
+func (s *Store) loadSoarRecord(ctx context.Context, id core.ID) (core.SoarRecord, error) {
+	rec := core.SoarRecord{ID: id}
+	var status int
+	var timeout int64
+	var rootFlaps string
+	var record []byte
+	var revision uint64
+	err := s.db.QueryRowContext(ctx, rebind(s.dialect, `SELECT name, status, count, err, max_parallelism,
+		timeout_ns, root_flaps, record, revision FROM soars WHERE id = ?`), id).
+		Scan(&rec.Name, &status, &rec.Count, &rec.Err, &rec.MaxParallelism, &timeout, &rootFlaps, &record, &revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rec, fmt.Errorf("%w: %s", core.ErrSoarNotFound, id)
+	} else if err != nil {
+		return rec, err
+	}
+	if len(record) > 0 {
+		if rec, err = codec.DecodeSoar(record); err != nil {
+			return rec, fmt.Errorf("decode soar %s: %w", id, err)
+		}
+	} else {
+		// 迁移到版本 2 之前写入的行没有完整记录
+		rec.Status = core.SoarStatus(status)
+		rec.Timeout = flaps.Duration(timeout)
+		if err = json.Unmarshal([]byte(rootFlaps), &rec.RootFlaps); err != nil {
+			return rec, fmt.Errorf("decode root flaps of soar %s: %w", id, err)
+		}
+	}
+	rec.FlapIDs, rec.Revision = nil, revision
+
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT id FROM flaps WHERE soar_id = ? ORDER BY seq, id`), id)
+	if err != nil {
+		return rec, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var flapID core.ID
+		if err = rows.Scan(&flapID); err != nil {
+			return rec, err
+		}
+		rec.FlapIDs = append(rec.FlapIDs, flapID)
+	}
+	return rec, rows.Err()
+}
+
+// loadFlapRecords 加载满足 where 条件的 flap, 按首次保存的顺序排列, 并从 edges 还原依赖关系
+func (s *Store) loadFlapRecords(ctx context.Context, where string, args ...any) ([]core.FlapRecord, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT id, soar_id, seq, conf_name, state, start_ns,
+		next_awake_ns, attempt_retry_count, output, err, plugin, plugin_config, conditions, retry, timeout_ns,
+		compensate, compensation, compensation_err, record, revision FROM flaps WHERE `+where+` ORDER BY seq, id`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []core.FlapRecord
+	for rows.Next() {
+		rec := core.FlapRecord{}
+		var seq, timeout int64
+		var state, compensation int
+		cols := flapColumns{}
+		var record []byte
+		var revision uint64
+		if err = rows.Scan(&rec.ID, &rec.SoarID, &seq, &rec.ConfName, &state, &cols.start, &cols.nextAwake,
+			&rec.AttemptRetryCount, &cols.output, &rec.Err, &rec.Plugin, &cols.pluginConfig, &cols.conditions,
+			&cols.retry, &timeout, &cols.compensate, &compensation, &rec.CompensationErr, &record, &revision); err != nil {
+			return nil, err
+		}
+		if len(record) > 0 {
+			id := rec.ID
+			if rec, err = codec.DecodeFlap(record); err != nil {
+				return nil, fmt.Errorf("decode flap %s: %w", id, err)
+			}
+		} else {
+			// 迁移到版本 2 之前写入的行没有完整记录
+			rec.State = core.FlapStatus(state)
+			rec.Timeout = flaps.Duration(timeout)
+			rec.Compensation = core.CompensationStatus(compensation)
+			if err = cols.decode(&rec); err != nil {
+				return nil, fmt.Errorf("decode flap %s: %w", rec.ID, err)
+			}
+		}
+		rec.Revision = revision
+		recs = append(recs, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range recs {
+		if recs[i].PrevFlaps, recs[i].NextFlaps, err = s.loadEdges(ctx, recs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// loadEdges 加载 flap 的 parent 和 child, 按对方 flap 首次保存的顺序排列
+func (s *Store) loadEdges(ctx context.Context, flapID core.ID) (prev, next []core.ID, err error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT e.from_id, e.to_id,
+		COALESCE(pf.seq, 0), COALESCE(nf.seq, 0) FROM edges e
+		LEFT JOIN flaps pf ON pf.id = e.from_id
+		LEFT JOIN flaps nf ON nf.id = e.to_id
+		WHERE e.from_id = ? OR e.to_id = ?`), flapID, flapID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	type edge struct {
+		id  core.ID
+		seq int64
+	}
+	var prevEdges, nextEdges []edge
+	for rows.Next() {
+		var from, to core.ID
+		var fromSeq, toSeq int64
+		if err = rows.Scan(&from, &to, &fromSeq, &toSeq); err != nil {
+			return nil, nil, err
+		}
+		if to == flapID {
+			prevEdges = append(prevEdges, edge{id: from, seq: fromSeq})
+		} else {
+			nextEdges = append(nextEdges, edge{id: to, seq: toSeq})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	sortIDs := func(edges []edge) []core.ID {
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].seq != edges[j].seq {
+				return edges[i].seq < edges[j].seq
+			}
+			return edges[i].id < edges[j].id
+		})
+		ids := make([]core.ID, 0, len(edges))
+		for _, e := range edges {
+			ids = append(ids, e.id)
+		}
+		return ids
+	}
+	return sortIDs(prevEdges), sortIDs(nextEdges), nil
+}
+
+// flapColumns flap 中需要编码后保存的列
+type flapColumns struct {
+	start, nextAwake                                    sql.NullInt64
+	output, pluginConfig, conditions, retry, compensate sql.NullString
+}
+
+// encodeFlapColumns 编码 flap 中的时间和 JSON 列
+func encodeFlapColumns(rec core.FlapRecord) (cols flapColumns, err error) {
+	cols.start = encodeTime(rec.Start)
+	if rec.NextAwakeTime != nil {
+		cols.nextAwake = encodeTime(*rec.NextAwakeTime)
+	}
+	for _, c := range []struct {
+		dst   *sql.NullString
+		v     any
+		empty bool
+	}{
+		{&cols.output, rec.Output, rec.Output == nil},
+		{&cols.pluginConfig, rec.PluginConfig, rec.PluginConfig == nil},
+		{&cols.conditions, rec.Conditions, len(rec.Conditions) == 0},
+		{&cols.retry, rec.Retry, rec.Retry == nil},
+		{&cols.compensate, rec.Compensate, rec.Compensate == nil},
+	} {
+		if c.empty {
+			continue
+		}
+		data, err := json.Marshal(c.v)
+		if err != nil {
+			return cols, err
+		}
+		*c.dst = sql.NullString{String: string(data), Valid: true}
+	}
+	return cols, nil
+}
+
+// decode 将编码后的列还原到 rec 中
+func (cols flapColumns) decode(rec *core.FlapRecord) error {
+	rec.Start = decodeTime(cols.start)
+	if cols.nextAwake.Valid {
+		t := decodeTime(cols.nextAwake)
+		rec.NextAwakeTime = &t
+	}
+	for _, c := range []struct {
+		src sql.NullString
+		dst any
+	}{
+		{cols.output, &rec.Output},
+		{cols.pluginConfig, &rec.PluginConfig},
+		{cols.conditions, &rec.Conditions},
+		{cols.retry, &rec.Retry},
+		{cols.compensate, &rec.Compensate},
+	} {
+		if !c.src.Valid {
+			continue
+		}
+		if err := json.Unmarshal([]byte(c.src.String), c.dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTime 将时间编码为 unix 纳秒, 零值编码为 NULL
+func encodeTime(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// decodeTime 将 unix 纳秒还原为时间, NULL 还原为零值
+func decodeTime(v sql.NullInt64) time.Time {
+	if !v.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, v.Int64)
+}
+
+// nonNilIDs 将 nil 转换为空切片, 使其编码为 []
+func nonNilIDs(ids []core.ID) []core.ID {
+	if ids == nil {
+		return []core.ID{}
+	}
+	return ids
+}
+
+// makeID 使用 util.GenID 生成 base58 编码的 ID
+func makeID(kind uint8) core.ID {
+	id, err := util.GenID(kind)
+	if err != nil {
+		panic(err)
+	}
+	return util.Base58EncodeUInt64(id)
+}
+
+var _ core.Store = (*Store)(nil)
@@ -0,0 +1,639 @@
+// Package storetest 提供 core.Store 的一致性测试, 任何 Store 实现都可以在自己的测试中运行这些用例
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) core.Store { return memory.New() })
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bagaking/wyvern/core"
+	"github.com/bagaking/wyvern/core/flaps"
+)
+
+// NewStore 为每个用例创建一个空的 Store, 需要清理的资源可以通过 t.Cleanup 注册
+type NewStore func(t *testing.T) core.Store
+
+// cases 所有一致性用例
+var cases = []struct {
+	name string
+	fn   func(t *testing.T, s core.Store)
+}{
+	{"MakeIDUnique", testMakeIDUnique},
+	{"SoarRoundTrip", testSoarRoundTrip},
+	{"SoarOverwrite", testSoarOverwrite},
+	{"FlapRoundTrip", testFlapRoundTrip},
+	{"FlapOverwrite", testFlapOverwrite},
+	{"RebuildEdges", testRebuildEdges},
+	{"RebuildIsolation", testRebuildIsolation},
+	{"RebuildSeparatesSoars", testRebuildSeparatesSoars},
+	{"LoadFlap", testLoadFlap},
+	{"UnknownIDs", testUnknownIDs},
+	{"ListSoars", testListSoars},
+	{"ConcurrentSaves", testConcurrentSaves},
+	{"Revision", testRevision},
+	{"SoarConflict", testSoarConflict},
+	{"FlapConflict", testFlapConflict},
+	{"ConcurrentConflict", testConcurrentConflict},
+}
+
+// Run 对 newStore 创建的 Store 运行所有一致性用例, 每个用例使用一个新的 Store
+func Run(t *testing.T, newStore NewStore) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.fn(t, newStore(t))
+		})
+	}
+}
+
+func testMakeIDUnique(t *testing.T, s core.Store) {
+	const workers, perWorker = 8, 500
+	ids := make(chan core.ID, workers*perWorker*2)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				ids <- s.MakeSoarID()
+				ids <- s.MakeFlapID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[core.ID]bool, workers*perWorker*2)
+	for id := range ids {
+		if id == "" {
+			t.Fatal("generated an empty id")
+		}
+		if seen[id] {
+			t.Fatalf("generated duplicate id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func testSoarRoundTrip(t *testing.T, s core.Store) {
+	soar, _ := saveDiamond(t, s)
+	want := soar.Record()
+	want.FlapIDs = nil
+
+	loaded := &core.Soar{}
+	if err := s.LoadSoar(loaded, soar.ID()); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	got := loaded.Record()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("LoadSoar mismatch\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func testSoarOverwrite(t *testing.T, s core.Store) {
+	soar, _ := saveDiamond(t, s)
+	rec := soar.Record()
+	rec.Status = core.SoarStatusFailed
+	rec.Count = 42
+	rec.Err = "overwritten"
+	soar.ApplyRecord(rec)
+	mustSaveSoar(t, s, soar)
+
+	loaded := &core.Soar{}
+	if err := s.LoadSoar(loaded, soar.ID()); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	got := loaded.Record()
+	if got.Status != rec.Status || got.Count != rec.Count || got.Err != rec.Err {
+		t.Fatalf("LoadSoar returned stale data: %+v", got)
+	}
+}
+
+func testFlapRoundTrip(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	rebuilt := mustRebuild(t, s, soar.ID())
+	if len(*rebuilt) != len(*table) {
+		t.Fatalf("Rebuild returned %d flaps, want %d", len(*rebuilt), len(*table))
+	}
+	for id, flap := range *table {
+		got := rebuilt.GetFlap(id)
+		if got == nil {
+			t.Fatalf("Rebuild lost flap %s", id)
+		}
+		assertFlapRecord(t, got.Record(), flap.Record())
+	}
+}
+
+func testFlapOverwrite(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	flap := table.GetFlap(soar.RootFlaps[0])
+	flap.State = core.FlapStateSuccess
+	flap.AttemptRetryCount = 7
+	flap.Output = map[string]any{"result": "done"}
+	flap.Err = nil
+	mustSaveFlap(t, s, flap)
+
+	rebuilt := mustRebuild(t, s, soar.ID())
+	if len(*rebuilt) != len(*table) {
+		t.Fatalf("saving a flap twice changed the flap count to %d, want %d", len(*rebuilt), len(*table))
+	}
+	assertFlapRecord(t, rebuilt.GetFlap(flap.ID).Record(), flap.Record())
+}
+
+func testRebuildEdges(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	rebuilt := mustRebuild(t, s, soar.ID())
+	for id, flap := range *table {
+		got := rebuilt.GetFlap(id)
+		if !sameIDs(got.PrevFlaps, flap.PrevFlaps) || !sameIDs(got.NextFlaps, flap.NextFlaps) {
+			t.Fatalf("edges of %s changed: prev %v next %v, want prev %v next %v",
+				flap.ConfName, got.PrevFlaps, got.NextFlaps, flap.PrevFlaps, flap.NextFlaps)
+		}
+		for _, neighbour := range append(append([]core.ID(nil), got.PrevFlaps...), got.NextFlaps...) {
+			if rebuilt.GetFlap(neighbour) == nil {
+				t.Fatalf("flap %s references %s which is not in the rebuilt index", flap.ConfName, neighbour)
+			}
+		}
+	}
+	// 重建的 flap 需要指向重建的索引
+	for _, id := range rebuilt.ListAllFlapID() {
+		rebuilt.GetFlap(id).CheckAllParentsSuccess()
+	}
+}
+
+func testRebuildIsolation(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	first := mustRebuild(t, s, soar.ID())
+	for _, id := range first.ListAllFlapID() {
+		flap := first.GetFlap(id)
+		flap.State = core.FlapStateWait
+		flap.Output = map[string]any{"mutated": true}
+		flap.PrevFlaps = nil
+	}
+
+	second := mustRebuild(t, s, soar.ID())
+	for id, flap := range *table {
+		assertFlapRecord(t, second.GetFlap(id).Record(), flap.Record())
+	}
+}
+
+func testRebuildSeparatesSoars(t *testing.T, s core.Store) {
+	soarA, tableA := saveDiamond(t, s)
+	soarB, tableB := saveDiamond(t, s)
+	for _, c := range []struct {
+		soar  *core.Soar
+		table *core.FlapIDTable
+	}{{soarA, tableA}, {soarB, tableB}} {
+		rebuilt := mustRebuild(t, s, c.soar.ID())
+		if !sameIDs(rebuilt.ListAllFlapID(), c.table.ListAllFlapID()) {
+			t.Fatalf("Rebuild(%s) returned flaps %v, want %v",
+				c.soar.ID(), rebuilt.ListAllFlapID(), c.table.ListAllFlapID())
+		}
+	}
+}
+
+func testLoadFlap(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	for id, flap := range *table {
+		blank, err := core.NewFlapFromRecord(core.FlapRecord{ID: id, SoarID: soar.ID()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := core.NewFlapIDTable(blank)
+		if err = s.LoadFlap(index, id); err != nil {
+			t.Fatalf("LoadFlap(%s): %v", flap.ConfName, err)
+		}
+		assertFlapRecord(t, blank.Record(), flap.Record())
+	}
+}
+
+func testUnknownIDs(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	unknown := s.MakeSoarID()
+
+	if _, err := s.Rebuild(unknown); !errors.Is(err, core.ErrSoarNotFound) {
+		t.Fatalf("Rebuild of an unknown soar returned %v, want ErrSoarNotFound", err)
+	}
+	if err := s.LoadSoar(&core.Soar{}, unknown); !errors.Is(err, core.ErrSoarNotFound) {
+		t.Fatalf("LoadSoar of an unknown soar returned %v, want ErrSoarNotFound", err)
+	}
+	if err := s.LoadFlap(table, s.MakeFlapID()); !errors.Is(err, core.ErrFlapNotFound) {
+		t.Fatalf("LoadFlap of a flap missing from the index returned %v, want ErrFlapNotFound", err)
+	}
+	unsaved, err := core.NewFlapFromRecord(core.FlapRecord{ID: s.MakeFlapID(), SoarID: soar.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.LoadFlap(core.NewFlapIDTable(unsaved), unsaved.ID); !errors.Is(err, core.ErrFlapNotFound) {
+		t.Fatalf("LoadFlap of an unsaved flap returned %v, want ErrFlapNotFound", err)
+	}
+}
+
+func testListSoars(t *testing.T, s core.Store) {
+	ids, err := s.ListSoars()
+	if err != nil {
+		t.Fatalf("ListSoars: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("ListSoars of an empty store returned %v", ids)
+	}
+	soarA, _ := saveDiamond(t, s)
+	soarB, _ := saveDiamond(t, s)
+	// 重复保存不会重复列出
+	mustSaveSoar(t, s, soarA)
+
+	if ids, err = s.ListSoars(); err != nil {
+		t.Fatalf("ListSoars: %v", err)
+	}
+	if want := []core.ID{soarA.ID(), soarB.ID()}; !sameIDs(ids, want) {
+		t.Fatalf("ListSoars returned %v, want %v", ids, want)
+	}
+}
+
+func testConcurrentSaves(t *testing.T, s core.Store) {
+	const flapCount, saves = 16, 5
+	soarID := s.MakeSoarID()
+	records := make([]core.FlapRecord, 0, flapCount)
+	for i := 0; i < flapCount; i++ {
+		records = append(records, core.FlapRecord{
+			ID:       s.MakeFlapID(),
+			SoarID:   soarID,
+			ConfName: fmt.Sprintf("flap-%d", i),
+			Plugin:   "print",
+		})
+	}
+	flapList := make([]*core.Flap, 0, flapCount)
+	for _, rec := range records {
+		flapList = append(flapList, mustFlap(t, rec))
+	}
+	table := core.NewFlapIDTable(flapList...)
+	soar := newSoar(soarID, table, nil)
+	mustSaveSoar(t, s, soar)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, flapCount*saves+saves)
+	for _, flap := range flapList {
+		wg.Add(1)
+		go func(flap *core.Flap) {
+			defer wg.Done()
+			for i := 0; i < saves; i++ {
+				// 每个 goroutine 只修改自己的 flap
+				flap.AttemptRetryCount = i
+				errs <- saveFlap(s, flap)
+			}
+		}(flap)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < saves; i++ {
+			errs <- saveSoar(s, soar)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent save: %v", err)
+		}
+	}
+
+	rebuilt := mustRebuild(t, s, soarID)
+	if len(*rebuilt) != flapCount {
+		t.Fatalf("Rebuild returned %d flaps, want %d", len(*rebuilt), flapCount)
+	}
+	for _, flap := range flapList {
+		if got := rebuilt.GetFlap(flap.ID); got == nil || got.AttemptRetryCount != saves-1 {
+			t.Fatalf("flap %s was not saved with its last state: %+v", flap.ConfName, got)
+		}
+	}
+}
+
+func testRevision(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	flap := table.GetFlap(soar.RootFlaps[0])
+	mustSaveSoar(t, s, soar)
+	mustSaveFlap(t, s, flap)
+
+	loaded := &core.Soar{}
+	if err := s.LoadSoar(loaded, soar.ID()); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	if got := loaded.Record().Revision; got != 2 {
+		t.Fatalf("soar saved twice has revision %d, want 2", got)
+	}
+	rebuilt := mustRebuild(t, s, soar.ID())
+	for _, id := range rebuilt.ListAllFlapID() {
+		want := uint64(1)
+		if id == flap.ID {
+			want = 2
+		}
+		if got := rebuilt.GetFlap(id).Record().Revision; got != want {
+			t.Fatalf("flap %s has revision %d, want %d", id, got, want)
+		}
+	}
+}
+
+func testSoarConflict(t *testing.T, s core.Store) {
+	soar, _ := saveDiamond(t, s)
+	stale := soar.Record()
+	rec := soar.Record()
+	rec.Count = 42
+	soar.ApplyRecord(rec)
+	mustSaveSoar(t, s, soar)
+
+	// 基于旧 Revision 的写入
+	writer := &core.Soar{}
+	stale.Count = 7
+	writer.ApplyRecord(stale)
+	assertConflict(t, s.SaveSoar(writer), "soar", soar.ID(), stale.Revision, stale.Revision+1)
+	// 不存在的记录的 Revision 为 0
+	missing := &core.Soar{}
+	missing.ApplyRecord(core.SoarRecord{ID: s.MakeSoarID(), Revision: 3})
+	assertConflict(t, s.SaveSoar(missing), "soar", missing.ID(), 3, 0)
+
+	loaded := &core.Soar{}
+	if err := s.LoadSoar(loaded, soar.ID()); err != nil {
+		t.Fatalf("LoadSoar: %v", err)
+	}
+	if got := loaded.Record(); got.Count != 42 || got.Revision != stale.Revision+1 {
+		t.Fatalf("conflicting write changed the soar: %+v", got)
+	}
+}
+
+func testFlapConflict(t *testing.T, s core.Store) {
+	soar, table := saveDiamond(t, s)
+	flap := table.GetFlap(soar.RootFlaps[0])
+	stale := flap.Record()
+	flap.State = core.FlapStateSuccess
+	mustSaveFlap(t, s, flap)
+
+	// 成功的状态不会被基于旧 Revision 的执行中状态覆盖
+	stale.State = core.FlapStateInProgress
+	assertConflict(t, s.SaveFlap(mustFlap(t, stale)), "flap", flap.ID, stale.Revision, stale.Revision+1)
+	missing := fullFlapRecord(soar.ID(), s.MakeFlapID(), "missing", nil, nil)
+	missing.Revision = 1
+	assertConflict(t, s.SaveFlap(mustFlap(t, missing)), "flap", missing.ID, 1, 0)
+
+	rebuilt := mustRebuild(t, s, soar.ID())
+	if len(*rebuilt) != len(*table) {
+		t.Fatalf("conflicting write changed the flap count to %d, want %d", len(*rebuilt), len(*table))
+	}
+	assertFlapRecord(t, rebuilt.GetFlap(flap.ID).Record(), flap.Record())
+}
+
+func testConcurrentConflict(t *testing.T, s core.Store) {
+	const writers = 8
+	soar, table := saveDiamond(t, s)
+	rec := table.GetFlap(soar.RootFlaps[0]).Record()
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 每个写入者都基于同一个 Revision 认领 flap
+			rec := rec.Clone()
+			rec.State = core.FlapStateInProgress
+			rec.AttemptRetryCount = i
+			flap, err := core.NewFlapFromRecord(rec)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- s.SaveFlap(flap)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, core.ErrRevisionConflict):
+			t.Fatalf("concurrent save: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d writers saved the flap based on the same revision, want exactly 1", succeeded)
+	}
+	if got := mustRebuild(t, s, soar.ID()).GetFlap(rec.ID).Record().Revision; got != rec.Revision+1 {
+		t.Fatalf("flap has revision %d after concurrent saves, want %d", got, rec.Revision+1)
+	}
+}
+
+// assertConflict 检查 err 是描述了指定记录的 ConflictError
+func assertConflict(t *testing.T, err error, kind string, id core.ID, revision, current uint64) {
+	t.Helper()
+	if !errors.Is(err, core.ErrRevisionConflict) {
+		t.Fatalf("stale write of %s %s returned %v, want ErrRevisionConflict", kind, id, err)
+	}
+	var conflict *core.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("stale write of %s %s returned %T, want *core.ConflictError", kind, id, err)
+	}
+	want := core.ConflictError{Kind: kind, ID: id, Revision: revision, Current: current}
+	if *conflict != want {
+		t.Fatalf("conflict = %+v, want %+v", *conflict, want)
+	}
+}
+
+// saveDiamond 保存一个 a -> (b, c) -> d 的菱形 soar, flap 的每个字段都被赋值
+func saveDiamond(t *testing.T, s core.Store) (*core.Soar, *core.FlapIDTable) {
+	t.Helper()
+	soarID := s.MakeSoarID()
+	a, b, c, d := s.MakeFlapID(), s.MakeFlapID(), s.MakeFlapID(), s.MakeFlapID()
+	records := []core.FlapRecord{
+		fullFlapRecord(soarID, a, "a", nil, []core.ID{b, c}),
+		fullFlapRecord(soarID, b, "b", []core.ID{a}, []core.ID{d}),
+		fullFlapRecord(soarID, c, "c", []core.ID{a}, []core.ID{d}),
+		fullFlapRecord(soarID, d, "d", []core.ID{b, c}, nil),
+	}
+	flapList := make([]*core.Flap, 0, len(records))
+	for _, rec := range records {
+		flapList = append(flapList, mustFlap(t, rec))
+	}
+	table := core.NewFlapIDTable(flapList...)
+	soar := newSoar(soarID, table, []core.ID{a})
+
+	mustSaveSoar(t, s, soar)
+	for _, flap := range flapList {
+		mustSaveFlap(t, s, flap)
+	}
+	return soar, table
+}
+
+// newSoar 创建一个每个字段都被赋值的 soar, 参数声明和运行参数只使用 JSON 可以无损表示或可以按声明还原的类型
+func newSoar(id core.ID, table *core.FlapIDTable, roots []core.ID) *core.Soar {
+	soar := &core.Soar{}
+	soar.ApplyRecord(core.SoarRecord{
+		ID:             id,
+		Name:           "diamond",
+		RootFlaps:      roots,
+		Status:         core.SoarStatusPaused,
+		Count:          3,
+		Err:            "soar error",
+		MaxParallelism: 2,
+		Timeout:        flaps.Duration(time.Minute),
+		ParentID:       "parent",
+		ParentFlapID:   "parent-flap",
+		InputDecls: []core.InputConfig{
+			{Name: "env", Required: true, Enum: []any{"dev", "prod"}},
+			{Name: "region", Default: "eu"},
+			{Name: "n", Type: core.InputTypeInt},
+			{Name: "dry", Type: core.InputTypeBool},
+			{Name: "tags", Type: core.InputTypeList},
+		},
+		Inputs: map[string]any{
+			"env":    "prod",
+			"region": "eu",
+			"n":      2,
+			"dry":    true,
+			"tags":   []any{"a", "b"},
+		},
+		InputsBound: true,
+	})
+	soar.IFlapIndex = table
+	return soar
+}
+
+// fullFlapRecord 生成每个字段都被赋值的 flap 数据, 输出和配置只使用 JSON 可以无损表示的类型
+func fullFlapRecord(soarID, id core.ID, name string, prev, next []core.ID) core.FlapRecord {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	awake := start.Add(time.Minute)
+	return core.FlapRecord{
+		ID:                id,
+		SoarID:            soarID,
+		ConfName:          name,
+		PrevFlaps:         prev,
+		NextFlaps:         next,
+		State:             core.FlapStateFailed,
+		Start:             start,
+		NextAwakeTime:     &awake,
+		AttemptRetryCount: 2,
+		Output: map[string]any{
+			"url":    "https://example.com/" + name,
+			"count":  float64(3),
+			"nested": map[string]any{"ok": true},
+			"list":   []any{"x", float64(1)},
+		},
+		Err:          name + " failed",
+		Plugin:       "print",
+		PluginConfig: map[string]any{"msg": "hello " + name},
+		Conditions:   []string{"flap.attempt < 3"},
+		Retry: &flaps.RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     flaps.BackoffExponential,
+			Delay:       flaps.Duration(time.Second),
+			MaxDelay:    flaps.Duration(time.Minute),
+			Multiplier:  2,
+			Jitter:      0.1,
+			RetryOn:     []string{flaps.ErrorClassTimeout},
+		},
+		Timeout: flaps.Duration(30 * time.Second),
+		Compensate: &flaps.CompensateConfig{
+			Plugin:       "print",
+			PluginConfig: map[string]any{"msg": "undo " + name},
+			Timeout:      flaps.Duration(5 * time.Second),
+		},
+		Compensation:    core.CompensationFailed,
+		CompensationErr: "undo " + name + " failed",
+	}
+}
+
+// assertFlapRecord 比较两个 flap 数据, 时间按时刻比较, 依赖关系不要求顺序
+func assertFlapRecord(t *testing.T, got, want core.FlapRecord) {
+	t.Helper()
+	if !got.Start.Equal(want.Start) {
+		t.Fatalf("flap %s start = %v, want %v", want.ConfName, got.Start, want.Start)
+	}
+	got.Start = want.Start
+	if (got.NextAwakeTime == nil) != (want.NextAwakeTime == nil) ||
+		got.NextAwakeTime != nil && !got.NextAwakeTime.Equal(*want.NextAwakeTime) {
+		t.Fatalf("flap %s next awake time = %v, want %v", want.ConfName, got.NextAwakeTime, want.NextAwakeTime)
+	}
+	got.NextAwakeTime = want.NextAwakeTime
+	got.PrevFlaps, want.PrevFlaps = sortedIDs(got.PrevFlaps), sortedIDs(want.PrevFlaps)
+	got.NextFlaps, want.NextFlaps = sortedIDs(got.NextFlaps), sortedIDs(want.NextFlaps)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("flap %s mismatch\n got: %+v\nwant: %+v", want.ConfName, got, want)
+	}
+}
+
+// sameIDs 判断两组 ID 是否相同, 不要求顺序
+func sameIDs(a, b []core.ID) bool {
+	return reflect.DeepEqual(sortedIDs(a), sortedIDs(b))
+}
+
+// sortedIDs 返回排序后的 ID 副本, 空切片统一为 nil
+func sortedIDs(ids []core.ID) []core.ID {
+	if len(ids) == 0 {
+		return nil
+	}
+	ret := append([]core.ID(nil), ids...)
+	sort.Strings(ret)
+	return ret
+}
+
+func mustFlap(t *testing.T, rec core.FlapRecord) *core.Flap {
+	t.Helper()
+	flap, err := core.NewFlapFromRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flap
+}
+
+func mustSaveSoar(t *testing.T, s core.Store, soar *core.Soar) {
+	t.Helper()
+	if err := saveSoar(s, soar); err != nil {
+		t.Fatalf("SaveSoar: %v", err)
+	}
+}
+
+func mustSaveFlap(t *testing.T, s core.Store, flap *core.Flap) {
+	t.Helper()
+	if err := saveFlap(s, flap); err != nil {
+		t.Fatalf("SaveFlap(%s): %v", flap.ConfName, err)
+	}
+}
+
+// saveSoar 保存 soar, 并像引擎一样在写入成功后将其 Revision 加一
+func saveSoar(s core.Store, soar *core.Soar) error {
+	if err := s.SaveSoar(soar); err != nil {
+		return err
+	}
+	rec := soar.Record()
+	rec.Revision++
+	soar.ApplyRecord(rec)
+	return nil
+}
+
+// saveFlap 保存 flap, 并像引擎一样在写入成功后将其 Revision 加一
+func saveFlap(s core.Store, flap *core.Flap) error {
+	if err := s.SaveFlap(flap); err != nil {
+		return err
+	}
+	rec := flap.Record()
+	rec.Revision++
+	return flap.ApplyRecord(rec)
+}
+
+func mustRebuild(t *testing.T, s core.Store, soarID core.ID) *core.FlapIDTable {
+	t.Helper()
+	table, err := s.Rebuild(soarID)
+	if err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+	return table
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"math/big"
+	"sync"
 	"time"
 )
 
@@ -9,19 +10,34 @@ var (
 	sequence  uint8  = 0
 	lastTime  uint64 = 0
 	partialID uint8  = 0
+
+	// genLock 保护 sequence 和 lastTime, 使 GenID 可以被并发调用
+	genLock sync.Mutex
 )
 
 func init() {
 	partialID = uint8(time.Now().UnixNano() % 1e8)
 }
 
-// GenID 生成一个 64 位整形唯一 id
+// GenID 生成一个 64 位整形唯一 id, 可以被并发调用
 // 39 位时间戳, 8 位分区 id, 8 位序列号, 8 位保留
+// 同一毫秒内的序列号用尽时, 直接使用下一毫秒的时间戳, 不等待时钟; 时钟回拨时也不会因此阻塞
 func GenID(remain uint8) (uint64, error) {
+	genLock.Lock()
+	defer genLock.Unlock()
+
 	// 39 位时间戳
 	timestamp := uint64(time.Now().UnixNano() / 1e6)
+	if timestamp < lastTime {
+		// 时钟回拨时沿用上次的时间戳
+		timestamp = lastTime
+	}
 	if timestamp == lastTime {
 		sequence++
+		if sequence == 0 {
+			// 序列号用尽, 借用下一毫秒, 之后时钟追上之前继续沿用借用的时间戳
+			timestamp++
+		}
 	} else {
 		sequence = 0
 	}
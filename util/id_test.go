@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenIDClockRollback(t *testing.T) {
+	// 模拟时钟回拨了 10 秒: 上次生成的时间戳在当前时间之后
+	genLock.Lock()
+	lastTime, sequence = uint64(time.Now().Add(10*time.Second).UnixNano()/1e6), 0
+	genLock.Unlock()
+
+	start := time.Now()
+	var last uint64
+	for i := 0; i < 1000; i++ {
+		id, err := GenID(0)
+		if err != nil {
+			t.Fatalf("GenID: %v", err)
+		}
+		if id <= last {
+			t.Fatalf("expect increasing ids, got %d after %d", id, last)
+		}
+		last = id
+	}
+	// 序列号用尽时借用下一毫秒, 不等待时钟追上回拨的时间
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect GenID not to wait for the clock, took %s", elapsed)
+	}
+}